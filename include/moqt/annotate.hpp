@@ -0,0 +1,53 @@
+// annotate.hpp
+// Hex dumps labelling the bytes of every decoded field
+
+#ifndef MOQT_ANNOTATE_HPP
+#define MOQT_ANNOTATE_HPP
+
+#include <moqt/common.hpp>
+#include <moqt/formatter.hpp>
+#include <moqt/options.hpp>
+#include <moqt/session.hpp>
+#include <cstdint>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// A validated message and where each of its fields was read from
+struct AnnotatedMessage {
+    ValidationResult result;
+    // Offsets into the message bytes, sorted by start with a span that
+    // groups others, such as Objects[0], before its fields. A parameter's
+    // type and value are one span.
+    std::vector<FieldSpan> spans;
+};
+
+// Validates a single control message as validate_control_message does,
+// recording the type byte and every field the parser reads
+AnnotatedMessage annotate_control_message(const std::vector<uint8_t>& data, SessionState& state,
+                                          Direction direction = DIRECTION_UNKNOWN,
+                                          const ValidationOptions& options = {});
+
+// Validates a control stream as validate_control_stream does, one
+// annotated message per framed message. Each also records its type and
+// length. Trailing bytes that do not hold a whole message come last,
+// with an invalid result and no spans.
+std::vector<AnnotatedMessage> annotate_control_stream(const std::vector<uint8_t>& stream, SessionState& state,
+                                                      Direction direction = DIRECTION_UNKNOWN,
+                                                      const ValidationOptions& options = {});
+
+// Validates a data stream or datagram as validate_data_message does
+AnnotatedMessage annotate_data_message(const std::vector<uint8_t>& data, const SessionState& state,
+                                       const ValidationOptions& options = {});
+
+// Prints the report, then one line per span: its byte range, its bytes in
+// brackets (the first 8 of a longer field) and its field name. Fields a
+// span groups are indented under it, and bytes no span covers are shown
+// as not decoded. With color each top-level field is set in its own ANSI
+// color.
+std::string format_annotated(const AnnotatedMessage& message, bool color = false);
+
+} // namespace moqt
+
+#endif // MOQT_ANNOTATE_HPP
@@ -0,0 +1,48 @@
+// batch.hpp
+// Validating a file of hex messages, one per line
+
+#ifndef MOQT_BATCH_HPP
+#define MOQT_BATCH_HPP
+
+#include <moqt/formatter.hpp>
+#include <moqt/options.hpp>
+#include <cstdint>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// What the bytes on a batch line are validated as
+enum class BatchKind { CONTROL, STREAM, DATAGRAM };
+
+// A message read from one line of a batch file
+struct BatchEntry {
+    size_t line;  // 1-based line number in the file
+    BatchKind kind;
+    std::vector<uint8_t> bytes;
+};
+
+// Parses "control", "stream" or "datagram". Throws std::invalid_argument
+// for any other name.
+BatchKind parse_batch_kind(const std::string& name);
+
+// Reads a batch file: one hex message per line, optionally prefixed with
+// "control:", "stream:" or "datagram:". Text from '#' to the end of a
+// line is a comment, and blank lines are skipped. Lines without a prefix
+// take default_kind. Throws std::runtime_error naming the line for an
+// unknown prefix or malformed hex.
+std::vector<BatchEntry> read_batch(const std::string& text, BatchKind default_kind = BatchKind::CONTROL);
+
+// Validates every entry in order, control messages against one session.
+// A stream line holding a datagram, or a datagram line holding a stream
+// header, is reported invalid.
+std::vector<ValidationResult> validate_batch(const std::vector<BatchEntry>& entries,
+                                             const ValidationOptions& options = {});
+
+// One line tallying the results, e.g. "12 messages: 10 passed, 2 failed
+// (lines 4, 9)"
+std::string batch_summary(const std::vector<BatchEntry>& entries, const std::vector<ValidationResult>& results);
+
+} // namespace moqt
+
+#endif // MOQT_BATCH_HPP
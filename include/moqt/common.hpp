@@ -4,19 +4,315 @@
 #define MOQT_COMMON_HPP
 
 #include <cstdint>
+#include <istream>
+#include <stdexcept>
 #include <string>
 #include <vector>
 
 namespace moqt {
 
-// Reads a variable-length integer from the buffer starting at offset.
+// Reads a QUIC variable-length integer (1, 2, 4 or 8 bytes, length in the
+// top two bits) from the buffer starting at offset.
 // Advances offset to the next unread position.
 uint64_t read_varint(const std::vector<uint8_t>& data, size_t& offset);
 
+// Like read_varint, but throws ProtocolViolation if the value would fit
+// in a shorter encoding. Message types and lengths are always read this way.
+uint64_t read_varint_canonical(const std::vector<uint8_t>& data, size_t& offset);
+
+// Reads one varint from a stream, consuming exactly its bytes, so large
+// captures can be decoded without loading them into memory. Follows the
+// thread's VarintMode like read_varint. Throws std::out_of_range at end of
+// stream; bytes of a truncated varint stay consumed.
+uint64_t read_varint(std::istream& in);
+
+// Appends value to out as a varint in the fewest bytes that hold it.
+// Throws std::invalid_argument if value does not fit in 62 bits.
+void write_varint(std::vector<uint8_t>& out, uint64_t value);
+
+// How read_varint treats non-minimal encodings, which QUIC permits
+enum class VarintMode { LENIENT, CANONICAL };
+
+// Makes read_varint behave like read_varint_canonical on this thread
+// while the guard is alive, so every field of a message is checked
+class ScopedVarintMode {
+public:
+    explicit ScopedVarintMode(VarintMode mode);
+    ~ScopedVarintMode();
+    ScopedVarintMode(const ScopedVarintMode&) = delete;
+    ScopedVarintMode& operator=(const ScopedVarintMode&) = delete;
+
+private:
+    VarintMode previous_;
+};
+
+// A varint read_varint accepted in more bytes than its value needs
+struct NonMinimalVarint {
+    size_t offset;  // Counted like reported offsets, from the ScopedByteOffsetBase
+    size_t length;
+    uint64_t value;
+};
+
+// Appends each non-minimal varint read_varint accepts on this thread to
+// varints while the guard is alive, so a round trip can tell them from
+// fields it misreads. A null varints suspends the log, for reads from
+// buffers copied out of the message.
+class ScopedVarintLog {
+public:
+    explicit ScopedVarintLog(std::vector<NonMinimalVarint>* varints);
+    ~ScopedVarintLog();
+    ScopedVarintLog(const ScopedVarintLog&) = delete;
+    ScopedVarintLog& operator=(const ScopedVarintLog&) = delete;
+
+private:
+    std::vector<NonMinimalVarint>* previous_;
+};
+
+// Reads a single byte from the buffer (used for 8-bit fields such as priority).
+// Advances offset by one.
+uint8_t read_u8(const std::vector<uint8_t>& data, size_t& offset);
+
+// Reads a 16-bit big-endian integer (used for control message lengths).
+// Advances offset by two.
+uint16_t read_u16(const std::vector<uint8_t>& data, size_t& offset);
+
+// Throws std::out_of_range with message unless length bytes remain in
+// data from offset on. Declared lengths come from untrusted varints of up
+// to 2^62 - 1, so readers call this before allocating anything for them.
+void check_remaining(const std::vector<uint8_t>& data, size_t offset, uint64_t length, const std::string& message);
+
 // Reads a length-prefixed UTF-8 string (varint length + bytes) from buffer.
-// Advances offset appropriately.
+// The length must be minimally encoded. Advances offset appropriately.
 std::string read_lp_string(const std::vector<uint8_t>& data, size_t& offset);
 
+// Reads a tuple (varint field count followed by length-prefixed fields),
+// as used for track namespaces. Advances offset past the last field.
+// Throws ProtocolViolation before reading any field unless the count is
+// between min_fields and 32; namespace prefixes pass 0 since they may be
+// empty.
+std::vector<std::string> read_tuple(const std::vector<uint8_t>& data, size_t& offset, size_t min_fields = 1);
+
+// A position within a track: group ID and object ID
+struct Location {
+    uint64_t group;
+    uint64_t object;
+
+    bool operator<(const Location& other) const {
+        return group < other.group || (group == other.group && object < other.object);
+    }
+};
+
+// The locations from start to end, both included. A range whose end is
+// before its start holds none.
+struct LocationRange {
+    Location start;
+    Location end;
+
+    bool empty() const { return end < start; }
+
+    bool contains(const Location& location) const { return !(location < start) && !(end < location); }
+
+    // Whether a location is in both ranges
+    bool overlaps(const LocationRange& other) const {
+        return !empty() && !other.empty() && !(other.end < start) && !(end < other.start);
+    }
+};
+
+// Reads a Location (group varint followed by object varint)
+Location read_location(const std::vector<uint8_t>& data, size_t& offset);
+
+// The readers above, naming the field they read. When the read throws
+// while an issue collector is active, field is what the issue names.
+uint64_t read_varint(const std::vector<uint8_t>& data, size_t& offset, const std::string& field);
+uint64_t read_varint_canonical(const std::vector<uint8_t>& data, size_t& offset, const std::string& field);
+uint8_t read_u8(const std::vector<uint8_t>& data, size_t& offset, const std::string& field);
+std::string read_lp_string(const std::vector<uint8_t>& data, size_t& offset, const std::string& field);
+std::vector<std::string> read_tuple(const std::vector<uint8_t>& data, size_t& offset, size_t min_fields,
+                                    const std::string& field);
+Location read_location(const std::vector<uint8_t>& data, size_t& offset, const std::string& field);
+
+// Formats a Location as "group:object", the form used in every report
+std::string to_string(const Location& location);
+
+// Returns true if s is well-formed UTF-8 (no overlongs, surrogates or
+// code points above U+10FFFF)
+bool is_valid_utf8(const std::string& s);
+
+// Formats bytes as space-separated lowercase hex, e.g. "03 05 07"
+std::string to_hex(const std::vector<uint8_t>& data);
+
+// Parses hex such as "030507" or "03 05 07" into bytes
+// Throws std::invalid_argument on non-hex characters or an odd digit count
+std::vector<uint8_t> from_hex(const std::string& text);
+
+// Computes the CRC-32 (IEEE 802.3, as used by zlib) of data
+uint32_t crc32(const std::vector<uint8_t>& data);
+
+// Verifies and removes a trailing checksum wrapper: the last 4 bytes are the
+// big-endian CRC-32 of all preceding bytes. Returns the inner message.
+// Throws ChecksumMismatch if the checksum is missing or wrong.
+std::vector<uint8_t> strip_crc32(const std::vector<uint8_t>& data);
+
+// Thrown when a checksum wrapper does not match its contents
+class ChecksumMismatch : public std::runtime_error {
+public:
+    using std::runtime_error::runtime_error;
+};
+
+// Error codes for terminating a session
+enum SessionTerminationCode : uint64_t {
+    TERMINATION_NO_ERROR = 0x0,
+    TERMINATION_INTERNAL_ERROR = 0x1,
+    TERMINATION_UNAUTHORIZED = 0x2,
+    TERMINATION_PROTOCOL_VIOLATION = 0x3,
+    TERMINATION_INVALID_REQUEST_ID = 0x4,
+    TERMINATION_DUPLICATE_TRACK_ALIAS = 0x5,
+    TERMINATION_KEY_VALUE_FORMATTING_ERROR = 0x6,
+    TERMINATION_TOO_MANY_REQUESTS = 0x7,
+    TERMINATION_INVALID_PATH = 0x8,
+    TERMINATION_MALFORMED_PATH = 0x9,
+    TERMINATION_GOAWAY_TIMEOUT = 0x10,
+    TERMINATION_CONTROL_MESSAGE_TIMEOUT = 0x11,
+    TERMINATION_DATA_STREAM_TIMEOUT = 0x12,
+    TERMINATION_AUTH_TOKEN_CACHE_OVERFLOW = 0x13,
+    TERMINATION_DUPLICATE_AUTH_TOKEN_ALIAS = 0x14,
+    TERMINATION_VERSION_NEGOTIATION_FAILED = 0x15
+};
+
+// Returns the name of a session termination code, or "UNKNOWN" if undefined
+std::string termination_code_name(uint64_t code);
+
+// Thrown when a message is well-formed but breaks MoQT session rules,
+// e.g. it references a request the peer never made. Carries the code the
+// session would be terminated with; any code but PROTOCOL_VIOLATION is
+// named in parentheses at the end of the message. A violation in one
+// field names it and the offset it was read from, counted as for
+// parse_error_report; others are located where the parser stopped.
+class ProtocolViolation : public std::runtime_error {
+public:
+    explicit ProtocolViolation(const std::string& what,
+                               SessionTerminationCode code = TERMINATION_PROTOCOL_VIOLATION);
+    ProtocolViolation(const std::string& what, const std::string& field, size_t byte_offset,
+                      SessionTerminationCode code = TERMINATION_PROTOCOL_VIOLATION);
+
+    SessionTerminationCode code() const { return code_; }
+    bool located() const { return !field_.empty(); }
+    const std::string& field() const { return field_; }
+    size_t byte_offset() const { return byte_offset_; }
+
+private:
+    SessionTerminationCode code_;
+    std::string field_;
+    size_t byte_offset_ = 0;
+};
+
+// Sets where the first byte a parser is given sits in the message it is
+// part of while the guard is alive: the length of the type for a single
+// control message, of the type and length for a framed one. Reported
+// offsets add it, so they always index the bytes validated.
+class ScopedByteOffsetBase {
+public:
+    explicit ScopedByteOffsetBase(size_t base);
+    ~ScopedByteOffsetBase();
+    ScopedByteOffsetBase(const ScopedByteOffsetBase&) = delete;
+    ScopedByteOffsetBase& operator=(const ScopedByteOffsetBase&) = delete;
+
+private:
+    size_t previous_;
+};
+
+// Builds the "NAME parse error: ..." report for a message that could not
+// be decoded. byte_offset is where the parser stopped, counted from the
+// first byte it was given; the report adds the active ScopedByteOffsetBase
+// so that it indexes the message as validated.
+std::string parse_error_report(const std::string& name, const std::exception& e, size_t byte_offset);
+
+// Builds the "NAME protocol violation: ..." report. byte_offset is where
+// the parser was when it found the violation, counted as for
+// parse_error_report; a located ProtocolViolation overrides it with the
+// offset of its field.
+std::string protocol_violation_report(const std::string& name, const std::exception& e, size_t byte_offset);
+
+// How far an issue found in collect-all mode kept the parser from going
+enum class IssueSeverity {
+    // Parsing went on past it; the rest of the message is still reported
+    ERROR,
+    // Parsing stopped there; this is the message's report
+    FATAL
+};
+
+// One problem found while validating a message in collect-all mode
+struct ValidationIssue {
+    // Where the parser was when it found the problem, counted as for
+    // parse_error_report
+    size_t byte_offset = 0;
+    // The field the problem is in: the one a named read failed in, one a
+    // parser names, or else the message name
+    std::string field;
+    IssueSeverity severity = IssueSeverity::ERROR;
+    std::string message;
+    SessionTerminationCode code = TERMINATION_PROTOCOL_VIOLATION;
+};
+
+// Puts the thread in collect-all mode while the guard is alive: problems
+// parsers can step past are appended to issues instead of thrown, and so
+// is the one each report ends on. Without recover, parsers stop at the
+// first problem as usual and only that one is appended, to locate it. A
+// null issues suspends the mode, for trial parses that rely on the first
+// problem being thrown.
+class ScopedIssueCollector {
+public:
+    explicit ScopedIssueCollector(std::vector<ValidationIssue>* issues, bool recover = true);
+    ~ScopedIssueCollector();
+    ScopedIssueCollector(const ScopedIssueCollector&) = delete;
+    ScopedIssueCollector& operator=(const ScopedIssueCollector&) = delete;
+
+    struct State {
+        std::vector<ValidationIssue>* issues = nullptr;
+        bool recover = true;
+        // Set by a named read that threw, until an issue takes it
+        std::string failed_field;
+    };
+
+private:
+    State previous_;
+};
+
+// Called by a parser that caught e at a point it can continue from. In
+// collect-all mode, records e as an ERROR in field and returns true;
+// otherwise returns false and the parser rethrows.
+bool recover_from(const std::exception& e, size_t byte_offset, const std::string& field);
+
+// Names field as the one a parser is about to fail in, for problems the
+// named readers do not raise themselves
+void note_failed_field(const std::string& field);
+
+// The bytes a field was read from, [start, end), counted from the first
+// byte the parser was given; unlike reported offsets, no base is added
+struct FieldSpan {
+    std::string field;
+    size_t start = 0;
+    size_t end = 0;
+};
+
+// Appends the span of every named read that succeeds on this thread to
+// spans while the guard is alive, in the order they are read. A null
+// spans suspends recording, for trial parses that read bytes again.
+class ScopedFieldRecorder {
+public:
+    explicit ScopedFieldRecorder(std::vector<FieldSpan>* spans);
+    ~ScopedFieldRecorder();
+    ScopedFieldRecorder(const ScopedFieldRecorder&) = delete;
+    ScopedFieldRecorder& operator=(const ScopedFieldRecorder&) = delete;
+
+private:
+    std::vector<FieldSpan>* previous_;
+};
+
+// Records the span of a field the named readers do not read, such as an
+// object payload, or of a group of fields such as a whole object
+void note_field_span(const std::string& field, size_t start, size_t end);
+
 } // namespace moqt
 
 #endif // MOQT_COMMON_HPP
@@ -4,6 +4,8 @@
 #ifndef MOQT_CONTROL_PARSER_HPP
 #define MOQT_CONTROL_PARSER_HPP
 
+#include <moqt/options.hpp>
+#include <moqt/session.hpp>
 #include <cstdint>
 #include <string>
 #include <vector>
@@ -11,23 +13,395 @@
 namespace moqt {
 
 // Parses a SUBSCRIBE message and returns a descriptive string
-std::string parse_subscribe(const std::vector<uint8_t>& payload);
+// Records the subscription in the session state. Once a maximum Request
+// ID has been granted to the sender, the Request ID must be below it.
+std::string parse_subscribe(const std::vector<uint8_t>& payload, SessionState& state,
+                            Direction direction = DIRECTION_UNKNOWN,
+                            const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_UPDATE message and returns a descriptive string
+// The update may only narrow the subscription it refers to
+std::string parse_subscribe_update(const std::vector<uint8_t>& payload, SessionState& state,
+                                   Direction direction = DIRECTION_UNKNOWN,
+                                   const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_OK message and returns a descriptive string
+// The Request ID must refer to a subscription in the session state, and
+// the publisher must pick an ascending or descending group order
+std::string parse_subscribe_ok(const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction = DIRECTION_UNKNOWN,
+                               const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_ERROR message and returns a descriptive string
+// The Request ID must refer to a subscription in the session state
+std::string parse_subscribe_error(const std::vector<uint8_t>& payload, SessionState& state,
+                                  const ValidationOptions& options = {});
+
+// Parses an UNSUBSCRIBE_ANNOUNCES message and returns a descriptive string
+// The prefix must have been subscribed earlier in the session
+std::string parse_unsubscribe_announces(const std::vector<uint8_t>& payload, SessionState& state,
+                                        const ValidationOptions& options = {});
+
+// Parses a FETCH message and returns a descriptive string
+// Records the fetch in the session state. The Request ID is checked
+// against the sender's maximum like SUBSCRIBE's.
+std::string parse_fetch(const std::vector<uint8_t>& payload, SessionState& state, const ValidationOptions& options,
+                        Direction direction = DIRECTION_UNKNOWN);
+
+// Parses a FETCH_OK message and returns a descriptive string
+// Records the End Location on the pending fetch it answers
+std::string parse_fetch_ok(const std::vector<uint8_t>& payload, SessionState& state,
+                           Direction direction = DIRECTION_UNKNOWN,
+                           const ValidationOptions& options = {});
+
+// Parses an ANNOUNCE message and returns a descriptive string
+// Records the namespace as pending until ANNOUNCE_OK or ANNOUNCE_ERROR.
+// The Request ID must have the parity of the endpoint sending in direction.
+std::string parse_announce(const std::vector<uint8_t>& payload, SessionState& state,
+                           Direction direction = DIRECTION_UNKNOWN,
+                           const ValidationOptions& options = {});
+
+// Parses an ANNOUNCE_OK message and returns a descriptive string
+// Moves the pending namespace it answers to the announced set
+std::string parse_announce_ok(const std::vector<uint8_t>& payload, SessionState& state,
+                              const ValidationOptions& options = {});
+
+// Parses an ANNOUNCE_ERROR message and returns a descriptive string
+// Drops the pending namespace it answers
+std::string parse_announce_error(const std::vector<uint8_t>& payload, SessionState& state,
+                                 const ValidationOptions& options = {});
+
+// Parses an UNANNOUNCE message and returns a descriptive string
+// The namespace must have been announced earlier in the session
+std::string parse_unannounce(const std::vector<uint8_t>& payload, SessionState& state,
+                             const ValidationOptions& options = {});
+
+// Parses an ANNOUNCE_CANCEL message and returns a descriptive string
+// Removes the cancelled namespace from the announced set
+std::string parse_announce_cancel(const std::vector<uint8_t>& payload, SessionState& state,
+                                  const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_ANNOUNCES message and returns a descriptive string
+// Records the namespace prefix as pending
+std::string parse_subscribe_announces(const std::vector<uint8_t>& payload, SessionState& state,
+                                      Direction direction = DIRECTION_UNKNOWN,
+                                      const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_ANNOUNCES_OK message and returns a descriptive string
+// Moves the pending prefix it answers to the subscribed set
+std::string parse_subscribe_announces_ok(const std::vector<uint8_t>& payload, SessionState& state,
+                                         const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_ANNOUNCES_ERROR message and returns a descriptive string
+// Rejects undefined error codes and drops the pending prefix
+std::string parse_subscribe_announces_error(const std::vector<uint8_t>& payload, SessionState& state,
+                                            const ValidationOptions& options = {});
+
+// Parses a FETCH_ERROR message and returns a descriptive string
+// Drops the fetch it answers
+std::string parse_fetch_error(const std::vector<uint8_t>& payload, SessionState& state,
+                              Direction direction = DIRECTION_UNKNOWN,
+                              const ValidationOptions& options = {});
+
+// Parses a FETCH_CANCEL message and returns a descriptive string
+// Drops the fetch named by the Request ID
+std::string parse_fetch_cancel(const std::vector<uint8_t>& payload, SessionState& state,
+                               const ValidationOptions& options = {});
+
+// Parses a TRACK_STATUS_REQUEST message and returns a descriptive string
+std::string parse_track_status_request(const std::vector<uint8_t>& payload, SessionState& state,
+                                       Direction direction = DIRECTION_UNKNOWN,
+                                       const ValidationOptions& options = {});
+
+// Parses a TRACK_STATUS message and returns a descriptive string
+std::string parse_track_status(const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction = DIRECTION_UNKNOWN,
+                               const ValidationOptions& options = {});
+
+// Parses a MAX_REQUEST_ID message and returns a descriptive string
+// Records the new maximum for its direction, which must increase
+std::string parse_max_request_id(const std::vector<uint8_t>& payload, SessionState& state,
+                                 Direction direction = DIRECTION_UNKNOWN,
+                                 const ValidationOptions& options = {});
+
+// Parses a REQUESTS_BLOCKED message and returns a descriptive string
+// The blocked value must equal the maximum granted by the other peer
+std::string parse_requests_blocked(const std::vector<uint8_t>& payload, const SessionState& state,
+                                   Direction direction = DIRECTION_UNKNOWN,
+                                   const ValidationOptions& options = {});
 
 // Parses a CLIENT_SETUP message and returns a descriptive string
-std::string parse_client_setup(const std::vector<uint8_t>& payload);
+// Only the client may send it. Records the offered versions and seeds
+// the maximum Request ID granted in its direction from the MAX_REQUEST_ID
+// parameter. Without it the maximum is 0, and the server may make no
+// requests until a MAX_REQUEST_ID message raises it.
+std::string parse_client_setup(const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction = DIRECTION_UNKNOWN,
+                               const ValidationOptions& options = {});
+
+// Parses a SETUP message of a draft before 11, of type LEGACY_SETUP,
+// LEGACY_CLIENT_SETUP or LEGACY_SERVER_SETUP, and returns a descriptive
+// string. The fields are those of CLIENT_SETUP or SERVER_SETUP, checked
+// and recorded the same way, but every parameter carries a length. A
+// LEGACY_SETUP is the client's until one has been seen. The report names
+// the legacy type.
+std::string parse_legacy_setup(uint64_t type, const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction = DIRECTION_UNKNOWN, const ValidationOptions& options = {});
 
 // Parses a SERVER_SETUP message and returns a descriptive string
-std::string parse_server_setup(const std::vector<uint8_t>& payload);
+// Only the server may send it, and the selected version must be one
+// CLIENT_SETUP offered. Seeds the maximum Request ID granted to the
+// client the same way.
+std::string parse_server_setup(const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction = DIRECTION_UNKNOWN,
+                               const ValidationOptions& options = {});
+
+// Parses a GOAWAY message and returns a descriptive string
+// Only the server may send it
+std::string parse_goaway(const std::vector<uint8_t>& payload, Direction direction = DIRECTION_UNKNOWN,
+                         const ValidationOptions& options = {});
+
+// Parses a SUBSCRIBE_DONE message and returns a descriptive string
+// Ends the subscription and frees its track alias once unreferenced
+std::string parse_subscribe_done(const std::vector<uint8_t>& payload, SessionState& state,
+                                 const ValidationOptions& options = {});
+
+// Parses an UNSUBSCRIBE message and returns a descriptive string
+// Ends the subscription named by the Request ID
+std::string parse_unsubscribe(const std::vector<uint8_t>& payload, SessionState& state,
+                              Direction direction = DIRECTION_UNKNOWN,
+                              const ValidationOptions& options = {});
 
 // Enum for known control message types
 enum MoqtControlType : uint8_t {
-    CLIENT_SETUP = 0x01,
-    SERVER_SETUP = 0x02,
+    SUBSCRIBE_UPDATE = 0x02,
     SUBSCRIBE = 0x03,
     SUBSCRIBE_OK = 0x04,
-    SUBSCRIBE_ERROR = 0x05
+    SUBSCRIBE_ERROR = 0x05,
+    ANNOUNCE = 0x06,
+    ANNOUNCE_OK = 0x07,
+    ANNOUNCE_ERROR = 0x08,
+    UNANNOUNCE = 0x09,
+    UNSUBSCRIBE = 0x0A,
+    SUBSCRIBE_DONE = 0x0B,
+    ANNOUNCE_CANCEL = 0x0C,
+    TRACK_STATUS_REQUEST = 0x0D,
+    TRACK_STATUS = 0x0E,
+    GOAWAY = 0x10,
+    SUBSCRIBE_ANNOUNCES = 0x11,
+    SUBSCRIBE_ANNOUNCES_OK = 0x12,
+    SUBSCRIBE_ANNOUNCES_ERROR = 0x13,
+    UNSUBSCRIBE_ANNOUNCES = 0x14,
+    MAX_REQUEST_ID = 0x15,
+    FETCH = 0x16,
+    FETCH_CANCEL = 0x17,
+    FETCH_OK = 0x18,
+    FETCH_ERROR = 0x19,
+    REQUESTS_BLOCKED = 0x1A,
+    CLIENT_SETUP = 0x20,
+    SERVER_SETUP = 0x21
+};
+
+// Setup message types of drafts before 11, accepted with
+// ValidationOptions::accept_legacy_setup. Draft 00 had a single SETUP;
+// drafts 01 to 10 split it into CLIENT_SETUP and SERVER_SETUP.
+enum LegacySetupType : uint64_t {
+    LEGACY_SETUP = 0x01,
+    LEGACY_CLIENT_SETUP = 0x40,
+    LEGACY_SERVER_SETUP = 0x41
 };
 
+// Whether a control stream frames a message of type with a varint Length,
+// as drafts 07 to 10 did, instead of the 16 bits of draft 11. With
+// ValidationOptions::accept_legacy_setup their CLIENT_SETUP and
+// SERVER_SETUP are framed so, and so is every message after one of them
+// on the stream, which after_legacy_setup says.
+bool has_varint_length(uint64_t type, bool after_legacy_setup, const ValidationOptions& options);
+
+// Reads the Length of a control stream message: a minimal varint if
+// varint_length, otherwise 16 bits big-endian. A Length above
+// ValidationOptions::max_message_bytes is a protocol violation.
+uint64_t read_control_length(const std::vector<uint8_t>& stream, size_t& offset, bool varint_length,
+                             const ValidationOptions& options);
+
+// Returns the name of a control message type, or "UNKNOWN" if undefined
+std::string control_message_name(uint64_t type);
+
+// Filter types carried in SUBSCRIBE
+enum SubscribeFilterType : uint64_t {
+    FILTER_NEXT_GROUP_START = 0x1,
+    FILTER_LATEST_OBJECT = 0x2,
+    FILTER_ABSOLUTE_START = 0x3,
+    FILTER_ABSOLUTE_RANGE = 0x4
+};
+
+// Returns the name of a SUBSCRIBE filter type, or "UNKNOWN" if undefined
+std::string filter_type_name(uint64_t type);
+
+// Optional fields that follow Filter Type in SUBSCRIBE, per filter
+struct FilterFieldSpec {
+    uint64_t filter_type;
+    bool has_start;
+    bool has_end_group;
+};
+
+// Returns the field spec for a filter type, or nullptr if undefined
+const FilterFieldSpec* find_filter_field_spec(uint64_t filter_type);
+
+// Draft versions are 0xff000000 plus the draft number
+const uint64_t DRAFT_VERSION_BASE = 0xff000000;
+
+// Whether an ABSOLUTE_RANGE SUBSCRIBE in the negotiated version carries
+// an End Object after End Group, as it did before draft 8. End Object is
+// the last object plus one, with 0 for the whole end group. Before a
+// version is negotiated the draft 11 layout is read.
+bool subscribe_has_end_object(uint64_t version);
+
+// Whether ValidationOptions::require_group_aligned_fetch applies in the
+// negotiated version: every version but the drafts before 07, which had
+// no FETCH. Before a version is negotiated the draft 11 rules apply.
+bool checks_group_aligned_fetch(uint64_t version);
+
+// Error codes carried in ANNOUNCE_ERROR and ANNOUNCE_CANCEL
+enum AnnounceErrorCode : uint64_t {
+    ANNOUNCE_INTERNAL_ERROR = 0x0,
+    ANNOUNCE_UNAUTHORIZED = 0x1,
+    ANNOUNCE_TIMEOUT = 0x2,
+    ANNOUNCE_NOT_SUPPORTED = 0x3,
+    ANNOUNCE_UNINTERESTED = 0x4,
+    ANNOUNCE_MALFORMED_AUTH_TOKEN = 0x10,
+    ANNOUNCE_UNKNOWN_AUTH_TOKEN_ALIAS = 0x11,
+    ANNOUNCE_EXPIRED_AUTH_TOKEN = 0x12
+};
+
+// Returns the name of an ANNOUNCE_ERROR code, or "UNKNOWN" if undefined
+std::string announce_error_code_name(uint64_t code);
+
+// Status codes carried in TRACK_STATUS
+enum TrackStatusCode : uint64_t {
+    TRACK_STATUS_IN_PROGRESS = 0x0,
+    TRACK_STATUS_DOES_NOT_EXIST = 0x1,
+    TRACK_STATUS_NOT_YET_BEGUN = 0x2,
+    TRACK_STATUS_FINISHED = 0x3,
+    TRACK_STATUS_RELAY_UNAVAILABLE = 0x4
+};
+
+// Returns the name of a TRACK_STATUS code, or "UNKNOWN" if undefined
+std::string track_status_code_name(uint64_t code);
+
+// Error codes carried in SUBSCRIBE_ANNOUNCES_ERROR
+enum SubscribeAnnouncesErrorCode : uint64_t {
+    SUBSCRIBE_ANNOUNCES_INTERNAL_ERROR = 0x0,
+    SUBSCRIBE_ANNOUNCES_UNAUTHORIZED = 0x1,
+    SUBSCRIBE_ANNOUNCES_TIMEOUT = 0x2,
+    SUBSCRIBE_ANNOUNCES_NOT_SUPPORTED = 0x3,
+    SUBSCRIBE_ANNOUNCES_NAMESPACE_PREFIX_UNKNOWN = 0x4,
+    SUBSCRIBE_ANNOUNCES_NAMESPACE_PREFIX_OVERLAP = 0x5,
+    SUBSCRIBE_ANNOUNCES_MALFORMED_AUTH_TOKEN = 0x10,
+    SUBSCRIBE_ANNOUNCES_UNKNOWN_AUTH_TOKEN_ALIAS = 0x11,
+    SUBSCRIBE_ANNOUNCES_EXPIRED_AUTH_TOKEN = 0x12
+};
+
+// Returns the name of a SUBSCRIBE_ANNOUNCES_ERROR code, or "UNKNOWN" if undefined
+std::string subscribe_announces_error_code_name(uint64_t code);
+
+// Fetch types carried in FETCH. A joining fetch's Joining Start counts
+// groups back from the largest group of the subscription it joins, or
+// for an absolute joining fetch names the group.
+enum FetchType : uint64_t {
+    FETCH_STANDALONE = 0x1,
+    FETCH_RELATIVE_JOINING = 0x2,
+    FETCH_ABSOLUTE_JOINING = 0x3
+};
+
+// Returns the name of a FETCH type, or "UNKNOWN" if undefined
+std::string fetch_type_name(uint64_t type);
+
+// Error codes carried in FETCH_ERROR
+enum FetchErrorCode : uint64_t {
+    FETCH_INTERNAL_ERROR = 0x0,
+    FETCH_UNAUTHORIZED = 0x1,
+    FETCH_TIMEOUT = 0x2,
+    FETCH_NOT_SUPPORTED = 0x3,
+    FETCH_TRACK_DOES_NOT_EXIST = 0x4,
+    FETCH_INVALID_RANGE = 0x5,
+    FETCH_NO_OBJECTS = 0x6,
+    FETCH_MALFORMED_AUTH_TOKEN = 0x10,
+    FETCH_UNKNOWN_AUTH_TOKEN_ALIAS = 0x11,
+    FETCH_EXPIRED_AUTH_TOKEN = 0x12
+};
+
+// Returns the name of a FETCH_ERROR code, or "UNKNOWN" if undefined
+std::string fetch_error_code_name(uint64_t code);
+
+// Error codes carried in SUBSCRIBE_ERROR
+enum SubscribeErrorCode : uint64_t {
+    SUBSCRIBE_INTERNAL_ERROR = 0x0,
+    SUBSCRIBE_UNAUTHORIZED = 0x1,
+    SUBSCRIBE_TIMEOUT = 0x2,
+    SUBSCRIBE_NOT_SUPPORTED = 0x3,
+    SUBSCRIBE_TRACK_DOES_NOT_EXIST = 0x4,
+    SUBSCRIBE_INVALID_RANGE = 0x5,
+    SUBSCRIBE_RETRY_TRACK_ALIAS = 0x6,
+    SUBSCRIBE_MALFORMED_AUTH_TOKEN = 0x10,
+    SUBSCRIBE_UNKNOWN_AUTH_TOKEN_ALIAS = 0x11,
+    SUBSCRIBE_EXPIRED_AUTH_TOKEN = 0x12
+};
+
+// Returns the name of a SUBSCRIBE_ERROR code, or "UNKNOWN" if undefined
+std::string subscribe_error_code_name(uint64_t code);
+
+// Status codes carried in SUBSCRIBE_DONE
+enum SubscribeDoneCode : uint64_t {
+    SUBSCRIBE_DONE_INTERNAL_ERROR = 0x0,
+    SUBSCRIBE_DONE_UNAUTHORIZED = 0x1,
+    SUBSCRIBE_DONE_TRACK_ENDED = 0x2,
+    SUBSCRIBE_DONE_SUBSCRIPTION_ENDED = 0x3,
+    SUBSCRIBE_DONE_GOING_AWAY = 0x4,
+    SUBSCRIBE_DONE_EXPIRED = 0x5,
+    SUBSCRIBE_DONE_TOO_FAR_BEHIND = 0x6
+};
+
+// Returns the name of a SUBSCRIBE_DONE status code, or "UNKNOWN" if undefined
+std::string subscribe_done_code_name(uint64_t code);
+
+// Parameter types carried by CLIENT_SETUP and SERVER_SETUP
+enum SetupParameterType : uint64_t {
+    SETUP_PARAM_PATH = 0x01,
+    SETUP_PARAM_MAX_REQUEST_ID = 0x02,
+    SETUP_PARAM_AUTHORIZATION_TOKEN = 0x03,
+    SETUP_PARAM_MAX_AUTH_TOKEN_CACHE_SIZE = 0x04
+};
+
+// ROLE, carried only by legacy SETUP messages: 1 publisher, 2
+// subscriber, 3 both
+const uint64_t LEGACY_SETUP_PARAM_ROLE = 0x00;
+
+// Returns the name of a setup parameter type, or "UNKNOWN" if undefined
+std::string setup_parameter_name(uint64_t type);
+
+// Version-specific parameter types carried by requests
+enum ParameterType : uint64_t {
+    PARAM_AUTHORIZATION_TOKEN = 0x01,
+    PARAM_DELIVERY_TIMEOUT = 0x02,
+    PARAM_MAX_CACHE_DURATION = 0x04
+};
+
+// Returns the name of a version-specific parameter type, or "UNKNOWN" if
+// undefined
+std::string parameter_name(uint64_t type);
+
+// Alias types leading an AUTHORIZATION_TOKEN value
+enum AuthTokenAliasType : uint64_t {
+    AUTH_TOKEN_DELETE = 0x0,
+    AUTH_TOKEN_REGISTER = 0x1,
+    AUTH_TOKEN_USE_ALIAS = 0x2,
+    AUTH_TOKEN_USE_VALUE = 0x3
+};
+
+// Returns the name of an auth token alias type, or "UNKNOWN" if undefined
+std::string auth_token_alias_type_name(uint64_t type);
+
 } // namespace moqt
 
 #endif // MOQT_CONTROL_PARSER_HPP
@@ -0,0 +1,69 @@
+// data_parser.hpp
+// Declarations for MoQT data stream and datagram parsing
+
+#ifndef MOQT_DATA_PARSER_HPP
+#define MOQT_DATA_PARSER_HPP
+
+#include <moqt/options.hpp>
+#include <moqt/session.hpp>
+#include <cstdint>
+#include <functional>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// Parses a subgroup stream (header followed by objects) and returns a descriptive string.
+// The input is exactly one stream: every byte after the header belongs to
+// an object of that header's subgroup. When session is given, the track
+// alias must belong to one of its active subscriptions.
+std::string parse_subgroup_stream(const std::vector<uint8_t>& data, const ValidationOptions& options,
+                                  const SessionState* session = nullptr);
+
+// Parses a fetch stream (header followed by objects) and returns a descriptive string
+std::string parse_fetch_stream(const std::vector<uint8_t>& data, const ValidationOptions& options);
+
+// Parses an object datagram and returns a descriptive string. The track
+// alias is checked against session as for subgroup streams.
+std::string parse_object_datagram(const std::vector<uint8_t>& data, const ValidationOptions& options,
+                                  const SessionState* session = nullptr);
+
+// Walks the framing of a subgroup or fetch stream without reporting
+// individual objects. Returns the object count, distinct groups, group
+// range and byte totals, or a parse error naming how far it got.
+std::string count_stream_objects(const std::vector<uint8_t>& data);
+
+// Stream and datagram types that open a data message
+enum MoqtDataType : uint8_t {
+    OBJECT_DATAGRAM = 0x00,
+    OBJECT_DATAGRAM_EXT = 0x01,
+    OBJECT_DATAGRAM_STATUS = 0x02,
+    OBJECT_DATAGRAM_STATUS_EXT = 0x03,
+    FETCH_HEADER = 0x05,
+    SUBGROUP_HEADER_MIN = 0x08,
+    SUBGROUP_HEADER_MAX = 0x0D
+};
+
+// Extension header types with a meaning the validator checks
+enum ExtensionHeaderType : uint64_t {
+    // Groups missing before the group of a subgroup's first object
+    EXTENSION_PRIOR_GROUP_ID_GAP = 0x40
+};
+
+// Turns the value of an extension header into the description reports
+// show for it. An odd type's value is its bytes without the length
+// prefix; an even type's is its varint as encoded, for read_varint to
+// decode. Throws std::exception if the value is malformed.
+using ExtensionHeaderDecoder = std::function<std::string(const std::vector<uint8_t>& value)>;
+
+// Registers a decoder for an application-defined extension header type,
+// replacing any registered before for that type. Objects and datagrams
+// carrying the header then show "name=description" in their reports;
+// headers of unregistered types are only checked for their framing. A
+// value the decoder rejects makes the message a parse error. Not safe to
+// call while other threads validate.
+void register_extension_header(uint64_t type, const std::string& name, ExtensionHeaderDecoder decoder);
+
+} // namespace moqt
+
+#endif // MOQT_DATA_PARSER_HPP
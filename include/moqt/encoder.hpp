@@ -0,0 +1,323 @@
+// encoder.hpp
+// Building MoQT messages from their fields
+
+#ifndef MOQT_ENCODER_HPP
+#define MOQT_ENCODER_HPP
+
+#include <moqt/common.hpp>
+#include <cstdint>
+#include <string>
+#include <variant>
+#include <vector>
+
+namespace moqt {
+
+// Control messages are encoded as the single-message form the validator
+// takes, the type followed by the payload. frame_control_message turns
+// one into the control stream form. Every varint is written minimally,
+// and encoders throw std::invalid_argument for fields the wire format
+// cannot carry.
+
+// A setup or version-specific parameter. Even types carry value as a
+// varint, odd types carry bytes with a length prefix.
+struct Parameter {
+    uint64_t type = 0;
+    uint64_t value = 0;
+    std::string bytes;
+};
+
+struct ClientSetupMessage {
+    std::vector<uint64_t> versions;
+    std::vector<Parameter> params;
+};
+
+struct ServerSetupMessage {
+    uint64_t version = 0;
+    std::vector<Parameter> params;
+};
+
+// start is written only for ABSOLUTE_START and ABSOLUTE_RANGE, and
+// end_group only for ABSOLUTE_RANGE, followed by end_object if
+// has_end_object, as drafts before 8 wrote it
+struct SubscribeMessage {
+    uint64_t request_id = 0;
+    uint64_t track_alias = 0;
+    std::vector<std::string> track_namespace;
+    std::string track_name;
+    uint8_t subscriber_priority = 0x80;
+    uint8_t group_order = 0;
+    uint8_t forward = 1;
+    uint64_t filter_type = 0;
+    Location start{};
+    uint64_t end_group = 0;
+    bool has_end_object = false;
+    uint64_t end_object = 0;
+    std::vector<Parameter> params;
+};
+
+// end_group is written as the last group plus one, or 0 if open_ended
+struct SubscribeUpdateMessage {
+    uint64_t request_id = 0;
+    Location start{};
+    uint64_t end_group = 0;
+    bool open_ended = true;
+    uint8_t subscriber_priority = 0x80;
+    uint8_t forward = 1;
+    std::vector<Parameter> params;
+};
+
+// largest is written only if content_exists is 1
+struct SubscribeOkMessage {
+    uint64_t request_id = 0;
+    uint64_t expires = 0;
+    uint8_t group_order = 1;
+    uint8_t content_exists = 0;
+    Location largest{};
+    std::vector<Parameter> params;
+};
+
+struct SubscribeErrorMessage {
+    uint64_t request_id = 0;
+    uint64_t error_code = 0;
+    std::string reason;
+    uint64_t track_alias = 0;
+};
+
+struct SubscribeDoneMessage {
+    uint64_t request_id = 0;
+    uint64_t status_code = 0;
+    uint64_t stream_count = 0;
+    std::string reason;
+};
+
+// The fields shared by ANNOUNCE_ERROR, SUBSCRIBE_ANNOUNCES_ERROR and
+// FETCH_ERROR
+struct RequestErrorMessage {
+    uint64_t request_id = 0;
+    uint64_t error_code = 0;
+    std::string reason;
+};
+
+// ANNOUNCE, or SUBSCRIBE_ANNOUNCES when track_namespace is a prefix
+struct AnnounceMessage {
+    uint64_t request_id = 0;
+    std::vector<std::string> track_namespace;
+    std::vector<Parameter> params;
+};
+
+// UNANNOUNCE, or UNSUBSCRIBE_ANNOUNCES when track_namespace is a prefix
+struct NamespaceMessage {
+    std::vector<std::string> track_namespace;
+};
+
+// The messages that carry a single Request ID: UNSUBSCRIBE, ANNOUNCE_OK,
+// SUBSCRIBE_ANNOUNCES_OK and FETCH_CANCEL name the request they answer,
+// MAX_REQUEST_ID and REQUESTS_BLOCKED the maximum
+struct RequestIdMessage {
+    uint64_t request_id = 0;
+};
+
+struct GoawayMessage {
+    std::string new_session_uri;
+};
+
+struct AnnounceCancelMessage {
+    std::vector<std::string> track_namespace;
+    uint64_t error_code = 0;
+    std::string reason;
+};
+
+struct TrackStatusRequestMessage {
+    uint64_t request_id = 0;
+    std::vector<std::string> track_namespace;
+    std::string track_name;
+    std::vector<Parameter> params;
+};
+
+struct TrackStatusMessage {
+    uint64_t request_id = 0;
+    uint64_t status_code = 0;
+    Location largest{};
+    std::vector<Parameter> params;
+};
+
+// A standalone fetch writes the track and range fields, a joining fetch
+// the joining fields
+struct FetchMessage {
+    uint64_t request_id = 0;
+    uint8_t subscriber_priority = 0x80;
+    uint8_t group_order = 0;
+    uint64_t fetch_type = 0;
+    std::vector<std::string> track_namespace;
+    std::string track_name;
+    Location start{};
+    Location end{};
+    uint64_t joining_request_id = 0;
+    uint64_t joining_start = 0;
+    std::vector<Parameter> params;
+};
+
+struct FetchOkMessage {
+    uint64_t request_id = 0;
+    uint8_t group_order = 1;
+    uint8_t end_of_track = 0;
+    Location end_location{};
+    std::vector<Parameter> params;
+};
+
+std::vector<uint8_t> encode_client_setup(const ClientSetupMessage& message);
+std::vector<uint8_t> encode_server_setup(const ServerSetupMessage& message);
+std::vector<uint8_t> encode_subscribe(const SubscribeMessage& message);
+std::vector<uint8_t> encode_subscribe_update(const SubscribeUpdateMessage& message);
+std::vector<uint8_t> encode_subscribe_ok(const SubscribeOkMessage& message);
+std::vector<uint8_t> encode_subscribe_error(const SubscribeErrorMessage& message);
+std::vector<uint8_t> encode_subscribe_done(const SubscribeDoneMessage& message);
+std::vector<uint8_t> encode_unsubscribe(uint64_t request_id);
+std::vector<uint8_t> encode_announce(const AnnounceMessage& message);
+std::vector<uint8_t> encode_announce_ok(uint64_t request_id);
+std::vector<uint8_t> encode_announce_error(const RequestErrorMessage& message);
+std::vector<uint8_t> encode_unannounce(const std::vector<std::string>& track_namespace);
+std::vector<uint8_t> encode_announce_cancel(const AnnounceCancelMessage& message);
+std::vector<uint8_t> encode_track_status_request(const TrackStatusRequestMessage& message);
+std::vector<uint8_t> encode_track_status(const TrackStatusMessage& message);
+std::vector<uint8_t> encode_goaway(const std::string& new_session_uri);
+std::vector<uint8_t> encode_subscribe_announces(const AnnounceMessage& message);
+std::vector<uint8_t> encode_subscribe_announces_ok(uint64_t request_id);
+std::vector<uint8_t> encode_subscribe_announces_error(const RequestErrorMessage& message);
+std::vector<uint8_t> encode_unsubscribe_announces(const std::vector<std::string>& prefix);
+std::vector<uint8_t> encode_max_request_id(uint64_t max_request_id);
+std::vector<uint8_t> encode_requests_blocked(uint64_t max_request_id);
+std::vector<uint8_t> encode_fetch(const FetchMessage& message);
+std::vector<uint8_t> encode_fetch_ok(const FetchOkMessage& message);
+std::vector<uint8_t> encode_fetch_error(const RequestErrorMessage& message);
+std::vector<uint8_t> encode_fetch_cancel(uint64_t request_id);
+
+// Converts a single control message into the control stream form: the
+// type, then the payload length as 16 bits big-endian, then the payload.
+// Throws std::invalid_argument if the payload is longer than 65535 bytes.
+// The legacy CLIENT_SETUP and SERVER_SETUP, and every message with
+// legacy_framing, get the varint length of drafts 07 to 10 instead.
+std::vector<uint8_t> frame_control_message(const std::vector<uint8_t>& message, bool legacy_framing = false);
+
+// One object of a subgroup or fetch stream. An object with an empty
+// payload is written with its status instead.
+struct ObjectFields {
+    uint64_t object_id = 0;
+    std::vector<uint8_t> extensions;
+    std::vector<uint8_t> payload;
+    uint64_t status = 0;
+};
+
+// subgroup_id is written only for types 0x0C and 0x0D; the other types
+// imply it, and it must match: 0 for 0x08 and 0x09, the first object's ID
+// for 0x0A and 0x0B. Extensions are written only for odd types.
+struct SubgroupStreamMessage {
+    uint64_t type = 0x08;
+    uint64_t track_alias = 0;
+    uint64_t group_id = 0;
+    uint64_t subgroup_id = 0;
+    uint8_t publisher_priority = 0x80;
+    std::vector<ObjectFields> objects;
+};
+
+// A fetch stream object names its full location and priority
+struct FetchObjectFields {
+    uint64_t group_id = 0;
+    uint64_t subgroup_id = 0;
+    uint8_t publisher_priority = 0x80;
+    ObjectFields object;
+};
+
+struct FetchStreamMessage {
+    uint64_t request_id = 0;
+    std::vector<FetchObjectFields> objects;
+};
+
+// The type decides between a payload and a status and whether
+// extensions are written
+struct ObjectDatagramMessage {
+    uint64_t type = 0x00;
+    uint64_t track_alias = 0;
+    uint64_t group_id = 0;
+    uint8_t publisher_priority = 0x80;
+    ObjectFields object;
+};
+
+std::vector<uint8_t> encode_subgroup_stream(const SubgroupStreamMessage& message);
+std::vector<uint8_t> encode_fetch_stream(const FetchStreamMessage& message);
+std::vector<uint8_t> encode_object_datagram(const ObjectDatagramMessage& message);
+
+// A message as a validator read it: its type, and the struct its encoder
+// takes once every field has been read. Data streams and datagrams hold
+// their stream or datagram type. fields stays empty for a message that
+// ended early, and for legacy SETUP messages, whose parameters these
+// structs have no encoding for.
+struct DecodedMessage {
+    uint64_t type = 0;
+    std::variant<std::monostate, ClientSetupMessage, ServerSetupMessage, SubscribeMessage, SubscribeUpdateMessage,
+                 SubscribeOkMessage, SubscribeErrorMessage, SubscribeDoneMessage, RequestErrorMessage,
+                 AnnounceMessage, NamespaceMessage, RequestIdMessage, GoawayMessage, AnnounceCancelMessage,
+                 TrackStatusRequestMessage, TrackStatusMessage, FetchMessage, FetchOkMessage, SubgroupStreamMessage,
+                 FetchStreamMessage, ObjectDatagramMessage>
+        fields;
+
+    bool decoded() const { return fields.index() != 0; }
+};
+
+// Encodes the fields of message with the encoder for its type. Throws
+// like that encoder, and std::invalid_argument for an empty message or
+// fields of another type.
+std::vector<uint8_t> encode_message(const DecodedMessage& message);
+
+// Stores the message each parser decodes on this thread in message while
+// the guard is alive, so results can carry fields and not just reports.
+// A null message suspends recording.
+class ScopedMessageRecorder {
+public:
+    explicit ScopedMessageRecorder(DecodedMessage* message);
+    ~ScopedMessageRecorder();
+    ScopedMessageRecorder(const ScopedMessageRecorder&) = delete;
+    ScopedMessageRecorder& operator=(const ScopedMessageRecorder&) = delete;
+
+private:
+    DecodedMessage* previous_;
+};
+
+// Called by a parser once it has read every field of a message, before
+// it checks them against the session
+void record_message(DecodedMessage message);
+
+// Receives the fields of a decoded message from visit_fields, in wire
+// order and through the method for their encoding, so that every output
+// names a field the same way
+class FieldVisitor {
+public:
+    virtual ~FieldVisitor() = default;
+    virtual void varint(const char* name, uint64_t value) = 0;
+    virtual void byte(const char* name, uint8_t value) = 0;
+    // A length-prefixed string
+    virtual void text(const char* name, const std::string& value) = 0;
+    virtual void tuple(const char* name, const std::vector<std::string>& value) = 0;
+    // A count, then that many varints
+    virtual void varints(const char* name, const std::vector<uint64_t>& value) = 0;
+    virtual void location(const char* name, const Location& value) = 0;
+    virtual void parameters(const char* name, const std::vector<Parameter>& value) = 0;
+    // An object's extension header block and payload, without the length
+    // written before each
+    virtual void extensions(const char* name, const std::vector<uint8_t>& block) = 0;
+    virtual void payload(const char* name, const std::vector<uint8_t>& value) = 0;
+    // Called around the fields of each object of a subgroup or fetch
+    // stream; a datagram's object fields are the datagram's own
+    virtual void begin_object() {}
+    virtual void end_object() {}
+};
+
+// Visits the fields of message as its encoder writes them, skipping the
+// type. A subgroup stream's subgroup_id is visited even where the stream
+// type implies it, and SUBSCRIBE_UPDATE's end_group holds the value on
+// the wire, the last group plus one. Does nothing for an empty message.
+void visit_fields(const DecodedMessage& message, FieldVisitor& visitor);
+
+} // namespace moqt
+
+#endif // MOQT_ENCODER_HPP
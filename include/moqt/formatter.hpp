@@ -0,0 +1,86 @@
+// formatter.hpp
+// Output formatters for validation results
+
+#ifndef MOQT_FORMATTER_HPP
+#define MOQT_FORMATTER_HPP
+
+#include <moqt/common.hpp>
+#include <moqt/encoder.hpp>
+#include <cstdint>
+#include <map>
+#include <memory>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// Outcome of validating one message
+struct ValidationResult {
+    std::string input;   // Hex dump of the validated bytes
+    std::string report;  // Descriptive string returned by the validator
+    bool valid;
+    // Code to terminate the session with: NO_ERROR when valid, otherwise
+    // the code of the protocol violation that ended validation, or
+    // PROTOCOL_VIOLATION
+    uint64_t termination_code = 0;
+    // Where validation of an invalid message stopped, when known: the
+    // byte offset into input, as in parse error reports, and the field
+    bool located = false;
+    size_t byte_offset = 0;
+    std::string field{};
+    // Where a message read from a capture was found, e.g. "stream=0,
+    // frame=12, packet_number=3"; empty for other inputs
+    std::string origin{};
+    // When the capture recorded the frame that completed the message, in
+    // nanoseconds since the Unix epoch; 0 for results not from a capture
+    uint64_t capture_time_ns = 0;
+    // The fields the validator read, when the result was made with them
+    DecodedMessage message{};
+};
+
+// Builds a result from a validator report
+// Reports of the form "NAME: ..." are valid; parse errors, protocol
+// violations and unsupported types are not. A report alone does not say
+// which termination code its violation carries, so an invalid result
+// gets PROTOCOL_VIOLATION.
+ValidationResult make_result(const std::vector<uint8_t>& input, const std::string& report);
+
+// As above, and locates an invalid result at the FATAL issue a collector
+// recorded while the report was built, if there is one, taking its
+// termination code from it. message is what a ScopedMessageRecorder
+// recorded alongside.
+ValidationResult make_result(const std::vector<uint8_t>& input, const std::string& report,
+                             const std::vector<ValidationIssue>& issues, const DecodedMessage& message = {});
+
+// Version of the result objects the json, ndjson and yaml formatters
+// write. It changes whenever a key is renamed, removed or changes type.
+const int RESULT_SCHEMA_VERSION = 1;
+
+// The message type a report is about, e.g. "SUBSCRIBE" for "SUBSCRIBE:
+// ..." and "SUBSCRIBE parse error: ...", or an empty string for reports
+// that name none, such as for an empty message
+std::string result_message_type(const std::string& report);
+
+// A JSON Schema for the result objects of the json and ndjson formatters
+std::string result_json_schema();
+
+// Turns a validation result into bytes ready to be written out
+class OutputFormatter {
+public:
+    virtual ~OutputFormatter() = default;
+    virtual std::string format(const ValidationResult& result) const = 0;
+};
+
+// Registers a formatter under the name used by the -format flag,
+// replacing any formatter previously registered under that name
+void register_formatter(const std::string& name, std::unique_ptr<OutputFormatter> formatter);
+
+// Returns the formatter registered under name, or nullptr if there is none
+const OutputFormatter* find_formatter(const std::string& name);
+
+// Returns the names of all registered formatters in sorted order
+std::vector<std::string> formatter_names();
+
+} // namespace moqt
+
+#endif // MOQT_FORMATTER_HPP
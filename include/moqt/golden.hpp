@@ -0,0 +1,30 @@
+// golden.hpp
+// Comparing validation results against a stored golden file
+
+#ifndef MOQT_GOLDEN_HPP
+#define MOQT_GOLDEN_HPP
+
+#include <moqt/formatter.hpp>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// Serializes results as a golden file: a JSON array with one object per
+// line and keys in a fixed order (input, valid, report), so a change to
+// one message shows up as a change to one line
+std::string golden_json(const std::vector<ValidationResult>& results);
+
+// Reads results back from the text of a golden file. Whitespace and key
+// order do not matter. Throws std::runtime_error unless the document is
+// an array of objects with string input and report and boolean valid.
+std::vector<ValidationResult> read_golden(const std::string& json_text);
+
+// Line-by-line diff of two golden_json documents, empty when they match.
+// Each changed run starts with "@@ line N" (N counts lines of expected)
+// followed by "-" lines only in expected and "+" lines only in actual.
+std::string golden_diff(const std::string& expected, const std::string& actual);
+
+} // namespace moqt
+
+#endif // MOQT_GOLDEN_HPP
@@ -0,0 +1,38 @@
+// json.hpp
+// Minimal JSON reader for tool inputs such as qlog files, and string escaping
+
+#ifndef MOQT_JSON_HPP
+#define MOQT_JSON_HPP
+
+#include <string>
+#include <utility>
+#include <vector>
+
+namespace moqt {
+
+struct JsonValue {
+    enum Type { Null, Bool, Number, String, Array, Object };
+
+    Type type = Null;
+    bool boolean = false;
+    double number = 0;
+    std::string string;
+    std::vector<JsonValue> array;
+    // Object members in document order
+    std::vector<std::pair<std::string, JsonValue>> object;
+
+    // Returns the member named key, or nullptr if this is not an object
+    // or has no such member
+    const JsonValue* get(const std::string& key) const;
+};
+
+// Parses a complete JSON document
+// Throws std::runtime_error describing the first syntax error
+JsonValue parse_json(const std::string& text);
+
+// Escapes s for use inside a double-quoted JSON string
+std::string json_escape(const std::string& s);
+
+} // namespace moqt
+
+#endif // MOQT_JSON_HPP
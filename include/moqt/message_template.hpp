@@ -0,0 +1,28 @@
+// message_template.hpp
+// Annotated sample messages for authoring control messages by hand
+
+#ifndef MOQT_MESSAGE_TEMPLATE_HPP
+#define MOQT_MESSAGE_TEMPLATE_HPP
+
+#include <moqt/control_parser.hpp>
+#include <cstdint>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// Returns a sample control message as commented hex, one field per line
+// with its bytes and the name and encoding visit_fields gives it. The
+// lines are the sample's encoding, so they validate once the messages of
+// the session they answer have been sent. message is the lowercase
+// message name, e.g. "subscribe". For SUBSCRIBE, filter_type selects the
+// filter and with it the filter fields the encoder writes.
+// Throws std::invalid_argument for unknown messages or filter types.
+std::string message_template(const std::string& message, uint64_t filter_type = FILTER_LATEST_OBJECT);
+
+// Returns the message names message_template accepts
+std::vector<std::string> template_names();
+
+} // namespace moqt
+
+#endif // MOQT_MESSAGE_TEMPLATE_HPP
@@ -0,0 +1,80 @@
+// options.hpp
+// Optional, off-by-default checks that go beyond the MoQT wire format
+
+#ifndef MOQT_OPTIONS_HPP
+#define MOQT_OPTIONS_HPP
+
+#include <cstdint>
+
+namespace moqt {
+
+// Transport a session runs over, which decides where PATH may appear
+enum class Transport { UNSPECIFIED, QUIC, WEBTRANSPORT };
+
+struct ValidationOptions {
+    // Largest object payload allowed by the application profile, in bytes.
+    // Larger objects are reported as warnings. 0 disables the check.
+    uint64_t max_object_payload = 0;
+
+    // Largest Length a control stream message may declare, in bytes. A
+    // larger one is a protocol violation reported before the payload is
+    // read, so a live stream cannot make the validator wait on or buffer
+    // a message of up to 2^62 bytes. 0 disables the check.
+    uint64_t max_message_bytes = 16 * 1024 * 1024;
+
+    // Reject standalone FETCH ranges that do not start on a group
+    // boundary (Start Object != 0). The wire format allows them, but
+    // profiles that only serve whole groups use this to catch fetches
+    // built from a mid-group location; violations are errors. The rule
+    // applies to the FETCH of drafts 07 to 11, whose Start Location
+    // carries a Start Object. Sessions that negotiated an earlier draft,
+    // which had no FETCH, are not checked; before a version is
+    // negotiated draft 11 is assumed.
+    bool require_group_aligned_fetch = false;
+
+    // Reject varints encoded in more bytes than their value needs. QUIC
+    // allows such encodings, so this is for conformance runs that want to
+    // catch wasteful or adversarial encoders; violations are errors.
+    bool canonical_varints = false;
+
+    // Accept bytes left over after the last field of a control message.
+    // By default they are a protocol violation; some drafts reserve
+    // trailing space, and captures from those need this.
+    bool allow_trailing_bytes = false;
+
+    // Reject subgroup streams whose header type signals extensions when
+    // no object carries any. Zero-length extensions are legal per object,
+    // so by default a whole stream of them is only a warning that the
+    // wrong header type was chosen.
+    bool require_subgroup_extensions = false;
+
+    // Name concatenated subgroup streams. A subgroup stream carries one
+    // header, so a batch of streams joined back to back only fails as a
+    // malformed object. With this set, a stream that fails to parse is
+    // checked for a second header and its objects starting where an
+    // object should, and that is reported instead. It is a guess about
+    // the cause, so it is opt-in.
+    bool reject_concatenated_subgroups = false;
+
+    // Reject subgroup streams and datagrams whose track alias no active
+    // subscription uses, when data messages are validated against a
+    // session. By default they are warnings, since a capture may start
+    // after the SUBSCRIBE was sent.
+    bool require_active_track_alias = false;
+
+    // Accept the SETUP message types of drafts before 11 (0x01, 0x40 and
+    // 0x41), whose parameters all carry a length, so captures from older
+    // peers can be validated. Their reports say the legacy type was used.
+    // A control stream opening with 0x40 or 0x41 is read with the varint
+    // message lengths of drafts 07 to 10.
+    bool accept_legacy_setup = false;
+
+    // Transport the messages were captured from. Raw QUIC requires the
+    // PATH setup parameter in CLIENT_SETUP and WebTransport forbids it;
+    // UNSPECIFIED checks neither. SERVER_SETUP never carries PATH.
+    Transport transport = Transport::UNSPECIFIED;
+};
+
+} // namespace moqt
+
+#endif // MOQT_OPTIONS_HPP
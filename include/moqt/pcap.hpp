@@ -0,0 +1,82 @@
+// pcap.hpp
+// Validating MoQT over raw QUIC from pcap and pcapng captures
+
+#ifndef MOQT_PCAP_HPP
+#define MOQT_PCAP_HPP
+
+#include <moqt/formatter.hpp>
+#include <moqt/options.hpp>
+#include <cstdint>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// A UDP datagram read from a capture
+struct CapturedDatagram {
+    size_t frame;             // 1-based index of the capture record, as Wireshark numbers them
+    uint64_t time_ns = 0;     // When the record was captured, in nanoseconds since the Unix epoch
+    std::string source;       // "address:port"
+    std::string destination;  // "address:port"
+    std::vector<uint8_t> payload;
+};
+
+// Extracts the UDP datagrams over IPv4 or IPv6 from a pcap or pcapng
+// file. Ethernet, raw IP, loopback and Linux cooked link types are read;
+// records of other link types, other protocols and IP fragments are
+// skipped. Throws std::runtime_error on a malformed or truncated file.
+std::vector<CapturedDatagram> read_capture(const std::vector<uint8_t>& file);
+
+// 1-RTT traffic secrets from an SSLKEYLOGFILE
+struct TrafficSecrets {
+    std::vector<std::vector<uint8_t>> client;  // CLIENT_TRAFFIC_SECRET_0 lines
+    std::vector<std::vector<uint8_t>> server;  // SERVER_TRAFFIC_SECRET_0 lines
+};
+
+// Reads the 1-RTT secrets from the text of a key log, ignoring other
+// labels and '#' comments. Throws std::runtime_error naming the line for
+// a malformed secret.
+TrafficSecrets read_keylog(const std::string& text);
+
+// Whether this build can decrypt QUIC packets, which needs OpenSSL
+bool capture_decryption_available();
+
+// Outcome of validating the MoQT sessions in a capture
+struct CaptureValidation {
+    // One result per control message, data stream and object datagram,
+    // in the order they completed. Each result's origin names the QUIC
+    // stream, the capture frame and the QUIC packet number its first byte
+    // arrived in.
+    std::vector<ValidationResult> results;
+    // Packets that no secret opens, frames that do not parse, streams
+    // with missing bytes and other things left unvalidated
+    std::vector<std::string> notes;
+};
+
+// Decrypts the 1-RTT packets of every QUIC connection in datagrams with
+// secrets, reassembles each stream in offset order and validates it. The
+// first client bidirectional stream is the control stream, with each
+// direction validated against one session per connection; unidirectional
+// streams and DATAGRAM frames carry data. A control stream whose bytes
+// go on as a subgroup or fetch stream, or a unidirectional stream of
+// control messages, is a protocol violation located at the switch. Long
+// header packets are skipped, as they only carry the handshake. Throws
+// std::runtime_error if decryption is unavailable in this build.
+CaptureValidation validate_capture(const std::vector<CapturedDatagram>& datagrams, const TrafficSecrets& secrets,
+                                   const ValidationOptions& options = {});
+
+enum class QuicCipher { AES_128_GCM, AES_256_GCM, CHACHA20_POLY1305 };
+
+// Builds a protected 1-RTT packet carrying payload as its frames, the
+// inverse of what validate_capture decrypts, e.g. to write test captures.
+// packet_number is written in pn_length (1-4) bytes. Throws
+// std::invalid_argument for a secret of the wrong size or a payload too
+// short to sample, and std::runtime_error if decryption is unavailable.
+std::vector<uint8_t> protect_short_header_packet(QuicCipher cipher, const std::vector<uint8_t>& secret,
+                                                 const std::vector<uint8_t>& dcid, uint64_t packet_number,
+                                                 size_t pn_length, const std::vector<uint8_t>& payload,
+                                                 bool key_phase = false);
+
+} // namespace moqt
+
+#endif // MOQT_PCAP_HPP
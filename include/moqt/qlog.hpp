@@ -0,0 +1,73 @@
+// qlog.hpp
+// Validating the raw bytes recorded in qlog files from other implementations
+
+#ifndef MOQT_QLOG_HPP
+#define MOQT_QLOG_HPP
+
+#include <moqt/formatter.hpp>
+#include <moqt/options.hpp>
+#include <cstdint>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// A qlog event that recorded the raw bytes of a MoQT message
+struct QlogEvent {
+    size_t index;                 // Position in the qlog's event list
+    std::string name;             // e.g. "moqt:control_message_parsed"
+    bool data_message;            // Stream header or datagram rather than control message
+    std::string message_type;     // Recorded message type, empty if absent
+    // Numeric fields recorded alongside the message, e.g. request_id
+    std::vector<std::pair<std::string, uint64_t>> fields;
+    std::vector<uint8_t> raw;
+    // Every field of the message, for events to_qlog builds; empty for
+    // events read from a qlog
+    DecodedMessage message{};
+};
+
+// Outcome of validating one qlog event
+struct QlogVerdict {
+    QlogEvent event;
+    std::string report;                   // Validator report for the raw bytes
+    std::vector<std::string> mismatches;  // Recorded fields that disagree with the decode
+    // Where validation stopped, for make_result to locate the report
+    std::vector<ValidationIssue> issues;
+    // The fields the validator read from the raw bytes
+    DecodedMessage message{};
+};
+
+// Extracts events carrying raw bytes (data.raw.data as hex) from a qlog
+// JSON document. Both a top-level "events" array and "traces[].events"
+// are accepted. Throws std::runtime_error on malformed input.
+std::vector<QlogEvent> read_qlog_events(const std::string& json_text);
+
+// Validates every event's raw bytes in order against one session and
+// cross-checks the recorded message type against the validator's report
+// and the recorded numeric fields against the fields it decoded
+std::vector<QlogVerdict> validate_qlog(const std::string& json_text, const ValidationOptions& options = {});
+
+// Renders a result as qlog "moqt" events, one JSON object per line: a
+// *_parsed event for the message with the fields in result.message and
+// the raw bytes, followed for data streams by one event per object.
+// Parameters and extension headers are nested as arrays of
+// {"type", "value"} objects. Only the type is written for a result with
+// no decoded fields. Each event's time is the capture time in
+// milliseconds, or 0. validate_qlog reads the events back.
+std::string qlog_events(const ValidationResult& result);
+
+// The fields of message as one JSON object, named and written as in the
+// events qlog_events writes, but with the objects of a subgroup or fetch
+// stream nested in an "objects" array instead of events of their own.
+// "{}" for a message with no decoded fields.
+std::string message_json(const DecodedMessage& message);
+
+// The message-level event qlog_events writes first for result: its name,
+// the message type, the numeric fields at the top level of its message as
+// read_qlog_events would read them back, and the raw bytes, along with
+// result.message
+QlogEvent to_qlog(const ValidationResult& result);
+
+} // namespace moqt
+
+#endif // MOQT_QLOG_HPP
@@ -0,0 +1,159 @@
+// session.hpp
+// Session state shared across control messages of one MoQT session
+
+#ifndef MOQT_SESSION_HPP
+#define MOQT_SESSION_HPP
+
+#include <moqt/common.hpp>
+#include <cstdint>
+#include <map>
+#include <set>
+#include <string>
+#include <utility>
+#include <vector>
+
+namespace moqt {
+
+// Which peer sent a message. DIRECTION_UNKNOWN treats the session as one
+// stream of messages, as when replaying a capture of a single peer.
+enum Direction : uint8_t {
+    DIRECTION_UNKNOWN = 0,
+    CLIENT_TO_SERVER = 1,
+    SERVER_TO_CLIENT = 2
+};
+
+// Returns the direction a reply to a message sent in direction travels in
+inline Direction reverse(Direction direction) {
+    if (direction == CLIENT_TO_SERVER) return SERVER_TO_CLIENT;
+    if (direction == SERVER_TO_CLIENT) return CLIENT_TO_SERVER;
+    return DIRECTION_UNKNOWN;
+}
+
+// Returns a printable name for a direction
+inline const char* direction_name(Direction direction) {
+    if (direction == CLIENT_TO_SERVER) return "client_to_server";
+    if (direction == SERVER_TO_CLIENT) return "server_to_client";
+    return "unknown";
+}
+
+// A subscription established by a SUBSCRIBE message
+struct Subscription {
+    uint64_t request_id;
+    uint64_t track_alias;
+    std::vector<std::string> track_namespace;
+    std::string track_name;
+    uint64_t filter_type;
+    // Earliest location the subscription may deliver; {0, 0} when the
+    // filter starts at the publisher's latest object
+    Location start;
+    // Last group delivered (inclusive), meaningful only if !open_ended
+    uint64_t end_group;
+    // End Object of drafts before 8: the last object plus one, 0 for the
+    // whole end group. Always 0 in later drafts, which end on a group.
+    uint64_t end_object;
+    bool open_ended;
+};
+
+// A fetch requested by a FETCH message
+struct Fetch {
+    uint64_t request_id;
+    uint64_t fetch_type;
+    // Standalone fetches name the track and range directly
+    std::vector<std::string> track_namespace;
+    std::string track_name;
+    Location start;
+    // End Object of 0 requests the whole end group
+    Location end;
+    // Joining fetches reference an existing subscription
+    uint64_t joining_request_id;
+    uint64_t joining_start;
+    // Set once FETCH_OK arrives: the last location the publisher will deliver
+    bool accepted;
+    Location end_location;
+};
+
+// The locations a subscription may deliver. An open-ended one runs to
+// the end of the track, and an End Group of later drafts includes the
+// whole group.
+inline LocationRange subscription_range(const Subscription& sub) {
+    if (sub.open_ended) return {sub.start, {UINT64_MAX, UINT64_MAX}};
+    if (sub.end_object == 0) return {sub.start, {sub.end_group, UINT64_MAX}};
+    return {sub.start, {sub.end_group, sub.end_object - 1}};
+}
+
+// The locations a standalone fetch requests, with End Object read as the
+// last object plus one and 0 as the whole end group
+inline LocationRange fetch_range(const Fetch& fetch) {
+    if (fetch.end.object == 0) return {fetch.start, {fetch.end.group, UINT64_MAX}};
+    return {fetch.start, {fetch.end.group, fetch.end.object - 1}};
+}
+
+// The auth tokens one endpoint holds for its peer
+struct AuthTokenCache {
+    // Size the endpoint advertised by MAX_AUTH_TOKEN_CACHE_SIZE in its
+    // SETUP. Without it only tokens with an empty value can be registered.
+    uint64_t max_size = 0;
+    // Registered tokens keyed by alias, with the bytes each one counts
+    // against the cache, and their total. A token counts the length of
+    // its Token Value only; the alias and token type are not charged, so
+    // a token with an empty value takes no space.
+    std::map<uint64_t, uint64_t> tokens;
+    uint64_t bytes = 0;
+};
+
+// Tracks what the peers have set up so far so that later messages
+// can be checked against it
+struct SessionState {
+    // Set once CLIENT_SETUP is seen, with the versions it offered
+    bool client_setup_seen = false;
+    std::vector<uint64_t> offered_versions;
+    // Set once SERVER_SETUP is accepted, with the version it selected
+    bool server_setup_seen = false;
+    uint64_t current_version = 0;
+    // Set once a legacy CLIENT_SETUP or SERVER_SETUP is accepted: the
+    // control stream is then framed as drafts 07 to 10 framed it
+    bool legacy_framing = false;
+    // Latest Maximum Request ID granted by MAX_REQUEST_ID, keyed by the
+    // direction it was sent in; requests travelling the other way must use
+    // IDs below it. A session starts with no requests allowed.
+    std::map<Direction, uint64_t> max_request_ids;
+    // Subscriptions keyed by the Request ID of their SUBSCRIBE
+    std::map<uint64_t, Subscription> active_subscriptions;
+    // Track aliases referenced by at least one active subscription
+    std::set<uint64_t> active_tracks;
+    // Fetches keyed by the Request ID of their FETCH
+    std::map<uint64_t, Fetch> active_fetches;
+    // ANNOUNCE namespaces awaiting OK or ERROR, keyed by Request ID
+    std::map<uint64_t, std::vector<std::string>> pending_announces;
+    // Namespaces whose ANNOUNCE was accepted
+    std::set<std::vector<std::string>> announced_namespaces;
+    // SUBSCRIBE_ANNOUNCES namespace prefixes awaiting OK or ERROR,
+    // keyed by Request ID
+    std::map<uint64_t, std::vector<std::string>> pending_namespace_prefixes;
+    // Namespace prefixes whose SUBSCRIBE_ANNOUNCES was accepted
+    std::set<std::vector<std::string>> subscribed_namespace_prefixes;
+    // Auth token caches keyed by the direction the tokens in them were
+    // sent in: CLIENT_SETUP sizes the client's cache, which holds tokens
+    // sent by the server, and SERVER_SETUP the server's
+    std::map<Direction, AuthTokenCache> auth_token_caches;
+
+    // Returns the cache holding auth tokens sent in direction. Tokens in
+    // messages of unknown direction are taken to be sent by the client,
+    // as their Request IDs are.
+    AuthTokenCache& auth_tokens(Direction direction) {
+        return auth_token_caches[direction == SERVER_TO_CLIENT ? SERVER_TO_CLIENT : CLIENT_TO_SERVER];
+    }
+
+    // Returns the state to that of a session that has not started, for
+    // reuse with the next session. The version list keeps its storage.
+    void reset() {
+        std::vector<uint64_t> versions = std::move(offered_versions);
+        versions.clear();
+        *this = SessionState{};
+        offered_versions = std::move(versions);
+    }
+};
+
+} // namespace moqt
+
+#endif // MOQT_SESSION_HPP
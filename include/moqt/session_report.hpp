@@ -0,0 +1,29 @@
+// session_report.hpp
+// Summaries of session state after a run of control messages
+
+#ifndef MOQT_SESSION_REPORT_HPP
+#define MOQT_SESSION_REPORT_HPP
+
+#include <moqt/session.hpp>
+#include <string>
+#include <vector>
+
+namespace moqt {
+
+// Renders a namespace tuple with fields joined by '/'. Fields that are
+// not printable UTF-8, or that contain '/', are shown as 0x-prefixed hex.
+std::string namespace_display(const std::vector<std::string>& fields);
+
+// Lists the announced namespaces and subscribed namespace prefixes of a
+// session, and which prefixes route which announcements: one header line
+// followed by an indented line per namespace and per prefix
+std::string announce_routing_report(const SessionState& state);
+
+// Counts the requests still outstanding in a session (open subscriptions
+// and fetches, unanswered ANNOUNCE and SUBSCRIBE_ANNOUNCES) next to the
+// maximum Request ID granted in each direction
+std::string request_limit_report(const SessionState& state);
+
+} // namespace moqt
+
+#endif // MOQT_SESSION_REPORT_HPP
@@ -4,7 +4,15 @@
 #ifndef MOQT_VALIDATOR_HPP
 #define MOQT_VALIDATOR_HPP
 
+#include <moqt/common.hpp>
+#include <moqt/formatter.hpp>
+#include <moqt/options.hpp>
+#include <moqt/session.hpp>
+#include <atomic>
 #include <cstdint>
+#include <functional>
+#include <istream>
+#include <shared_mutex>
 #include <string>
 #include <vector>
 
@@ -14,6 +22,134 @@ namespace moqt {
 // Returns a diagnostic string or parse error
 std::string validate_control_message(const std::vector<uint8_t>& data);
 
+// Validates a control message against the state of an ongoing session
+// and updates that state with what the message establishes
+std::string validate_control_message(const std::vector<uint8_t>& data, SessionState& state,
+                                     const ValidationOptions& options = {});
+
+// As above, for a message known to travel in the given direction; limits
+// such as MAX_REQUEST_ID are then tracked per peer
+std::string validate_control_message(const std::vector<uint8_t>& data, SessionState& state, Direction direction,
+                                     const ValidationOptions& options = {});
+
+// Outcome of validating a control stream: a sequence of messages, each a
+// type varint, a 16-bit big-endian length and that many payload bytes
+struct ControlStreamResult {
+    // One result per complete message, in stream order
+    std::vector<ValidationResult> messages;
+    // Byte offset in the stream at which each of those messages starts
+    std::vector<size_t> offsets;
+    // Empty when every message is valid and the stream ends on a message
+    // boundary; otherwise names the first invalid message by index and
+    // offset, or the incomplete message the stream ends in
+    std::string error;
+    // Set when the stream ends partway through a message
+    bool truncated = false;
+};
+
+// Validates every message of a control stream in order against one session.
+// Unlike validate_control_message, the stream must open with CLIENT_SETUP
+// and SERVER_SETUP, and neither may be sent again.
+ControlStreamResult validate_control_stream(const std::vector<uint8_t>& stream, SessionState& state,
+                                            Direction direction = DIRECTION_UNKNOWN,
+                                            const ValidationOptions& options = {});
+
+// Validates a control stream as its bytes arrive, such as from a QUIC
+// stream being received, against one session as validate_control_stream
+// does. Each message is read in full, however many reads that takes, and
+// its result passed to on_result before the next is read. Returns an
+// empty string at the end of the stream between messages or once stop is
+// set; otherwise names the incomplete or malformed message the stream
+// ended in. stop is only checked before each message, and reads from in
+// block until bytes arrive, so a peer that goes quiet holds the call
+// until in reaches its end or fails: to stop it promptly, also close or
+// fail the source in feeds from.
+std::string validate_control_stream_live(std::istream& in, SessionState& state,
+                                         const std::function<void(const ValidationResult&)>& on_result,
+                                         Direction direction = DIRECTION_UNKNOWN,
+                                         const ValidationOptions& options = {},
+                                         const std::atomic<bool>* stop = nullptr);
+
+// Validates a data stream (subgroup or fetch) or an object datagram
+// The stream or datagram type is read from the first varint
+std::string validate_data_message(const std::vector<uint8_t>& data, const ValidationOptions& options = {});
+
+// As above, and checks that subgroup streams and datagrams carry the
+// track alias of one of the session's active subscriptions. An unknown
+// alias is a warning unless options.require_active_track_alias is set.
+std::string validate_data_message(const std::vector<uint8_t>& data, const SessionState& state,
+                                  const ValidationOptions& options = {});
+
+// Validates a message, then encodes the fields the validator decoded
+// again and compares the bytes, to catch fields validation drops or
+// misreads. is_control selects between a single control message and a
+// data stream or datagram. Returns an empty string when the message is
+// valid and the bytes match. Otherwise returns the validation report, or
+// names the first byte offset where the encoding diverges with the bytes
+// from there on in both. The encoders write minimal varints, so the
+// message is compared with its longer varints shortened, and offsets
+// count from the shortened form.
+std::string validate_round_trip(const std::vector<uint8_t>& data, bool is_control, SessionState& state,
+                                const ValidationOptions& options = {});
+
+// As above, against a fresh session
+std::string validate_round_trip(const std::vector<uint8_t>& data, bool is_control);
+
+// Outcome of validating a message in collect-all mode
+struct CollectedValidation {
+    // The report parsing ended with. When it went past an issue this is
+    // the rest of the message as decoded, but valid is still false.
+    ValidationResult result;
+    // Every issue found, in the order found; the last is FATAL if the
+    // message could not be read to its end
+    std::vector<ValidationIssue> issues;
+};
+
+// Validates a message like validate_round_trip does, but instead of
+// stopping at the first problem steps past those it can and goes on. A
+// duplicate or rejected parameter is skipped and the rest of the list
+// still read, an extension header its registered decoder rejects is
+// skipped, and trailing bytes are noted after the last field. The
+// session state takes what the message establishes even if it has issues.
+CollectedValidation validate_all(const std::vector<uint8_t>& data, bool is_control, SessionState& state,
+                                 const ValidationOptions& options = {});
+
+// As above, against a fresh session
+CollectedValidation validate_all(const std::vector<uint8_t>& data, bool is_control);
+
+// A session several threads validate against, such as a server handling
+// each stream of a connection on its own thread. The functions above
+// take no lock; a SharedSession guards its state with one, so a single
+// instance may be shared. Control messages change the state and hold
+// the lock exclusively, while data messages only read it and validate
+// in parallel. Extension header decoders are not guarded, so register
+// them before validating starts.
+class SharedSession {
+public:
+    SharedSession() = default;
+    explicit SharedSession(SessionState state);
+    SharedSession(const SharedSession&) = delete;
+    SharedSession& operator=(const SharedSession&) = delete;
+
+    std::string validate_control_message(const std::vector<uint8_t>& data, Direction direction = DIRECTION_UNKNOWN,
+                                         const ValidationOptions& options = {});
+    ControlStreamResult validate_control_stream(const std::vector<uint8_t>& stream,
+                                                Direction direction = DIRECTION_UNKNOWN,
+                                                const ValidationOptions& options = {});
+    std::string validate_data_message(const std::vector<uint8_t>& data, const ValidationOptions& options = {}) const;
+
+    // A copy of the state as of the last completed control message
+    SessionState snapshot() const;
+
+    // Starts over with a session that has not started, as
+    // SessionState::reset does
+    void reset();
+
+private:
+    mutable std::shared_mutex mutex_;
+    SessionState state_;
+};
+
 } // namespace moqt
 
 #endif // MOQT_VALIDATOR_HPP
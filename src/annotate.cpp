@@ -0,0 +1,190 @@
+// annotate.cpp
+// Records field spans during validation and prints them as a hex dump
+
+#include <moqt/annotate.hpp>
+#include <moqt/control_parser.hpp>
+#include <moqt/validator.hpp>
+#include <algorithm>
+#include <cstdio>
+#include <sstream>
+
+namespace moqt {
+
+namespace {
+
+// Moves spans read from a payload to their place in the whole message,
+// merges the reads a parameter is made of and puts a grouping span
+// before the fields in it
+std::vector<FieldSpan> arrange_spans(std::vector<FieldSpan> header, const std::vector<FieldSpan>& read,
+                                     size_t shift) {
+    std::vector<FieldSpan> spans = std::move(header);
+    for (const FieldSpan& span : read) {
+        if (span.end == span.start) continue;
+        if (!spans.empty() && spans.back().field == span.field && spans.back().end == span.start + shift) {
+            spans.back().end = span.end + shift;
+            continue;
+        }
+        spans.push_back(FieldSpan{span.field, span.start + shift, span.end + shift});
+    }
+    std::stable_sort(spans.begin(), spans.end(), [](const FieldSpan& a, const FieldSpan& b) {
+        return a.start < b.start || (a.start == b.start && a.end > b.end);
+    });
+    return spans;
+}
+
+std::string offset_range(size_t start, size_t end) {
+    char text[32];
+    if (end - start <= 1) {
+        std::snprintf(text, sizeof(text), "%04zx", start);
+    } else {
+        std::snprintf(text, sizeof(text), "%04zx-%04zx", start, end - 1);
+    }
+    return text;
+}
+
+// The bracketed bytes of a field, the first 8 of a longer one
+std::string bracketed_bytes(const std::vector<uint8_t>& data, size_t start, size_t end) {
+    size_t shown = std::min(end, start + 8);
+    std::string hex = to_hex(std::vector<uint8_t>(data.begin() + start, data.begin() + shown));
+    return "[" + hex + (shown < end ? " .." : "") + "]";
+}
+
+std::string pad(std::string text, size_t width) {
+    if (text.size() < width) text.append(width - text.size(), ' ');
+    return text + " ";
+}
+
+const char* const COLORS[] = {"\033[31m", "\033[32m", "\033[33m", "\033[34m", "\033[35m", "\033[36m"};
+const char* const RESET = "\033[0m";
+
+} // namespace
+
+AnnotatedMessage annotate_control_message(const std::vector<uint8_t>& data, SessionState& state, Direction direction,
+                                          const ValidationOptions& options) {
+    std::vector<FieldSpan> read;
+    std::vector<ValidationIssue> issues;
+    DecodedMessage decoded;
+    std::string report;
+    {
+        ScopedFieldRecorder recorder(&read);
+        ScopedIssueCollector locator(&issues, false);
+        ScopedMessageRecorder fields(&decoded);
+        report = validate_control_message(data, state, direction, options);
+    }
+    AnnotatedMessage annotated;
+    annotated.result = make_result(data, report, issues, decoded);
+    std::vector<FieldSpan> header;
+    if (!data.empty()) header.push_back(FieldSpan{"type", 0, 1});
+    annotated.spans = arrange_spans(header, read, 1);
+    return annotated;
+}
+
+std::vector<AnnotatedMessage> annotate_control_stream(const std::vector<uint8_t>& stream, SessionState& state,
+                                                      Direction direction, const ValidationOptions& options) {
+    std::vector<AnnotatedMessage> messages;
+    size_t offset = 0;
+    while (offset < stream.size()) {
+        size_t start = offset;
+        size_t length_start = 0;
+        size_t end = 0;
+        try {
+            uint64_t type = read_varint(stream, offset);
+            length_start = offset;
+            uint64_t length = read_control_length(stream, offset,
+                                                  has_varint_length(type, state.legacy_framing, options), options);
+            check_remaining(stream, offset, length, "Incomplete control message");
+            end = offset + length;
+        } catch (const std::out_of_range&) {
+            std::vector<uint8_t> rest(stream.begin() + start, stream.end());
+            AnnotatedMessage annotated;
+            annotated.result = make_result(rest, "Incomplete control message: " + std::to_string(rest.size())
+                                                     + " trailing bytes at offset " + std::to_string(start));
+            messages.push_back(annotated);
+            break;
+        } catch (const ProtocolViolation& e) {
+            std::vector<uint8_t> rest(stream.begin() + start, stream.end());
+            AnnotatedMessage annotated;
+            annotated.result = make_result(rest, "Malformed control message header at offset " + std::to_string(start)
+                                                     + ": " + e.what());
+            messages.push_back(annotated);
+            break;
+        }
+        std::vector<uint8_t> message(stream.begin() + start, stream.begin() + end);
+        std::vector<FieldSpan> read;
+        ControlStreamResult result;
+        {
+            ScopedFieldRecorder recorder(&read);
+            result = validate_control_stream(message, state, direction, options);
+        }
+        AnnotatedMessage annotated;
+        annotated.result = result.messages.empty() ? make_result(message, result.error) : result.messages.front();
+        size_t header = offset - start;
+        annotated.spans = arrange_spans({FieldSpan{"type", 0, length_start - start},
+                                         FieldSpan{"length", length_start - start, header}},
+                                        read, header);
+        messages.push_back(annotated);
+        offset = end;
+    }
+    return messages;
+}
+
+AnnotatedMessage annotate_data_message(const std::vector<uint8_t>& data, const SessionState& state,
+                                       const ValidationOptions& options) {
+    std::vector<FieldSpan> read;
+    std::vector<ValidationIssue> issues;
+    DecodedMessage decoded;
+    std::string report;
+    {
+        ScopedFieldRecorder recorder(&read);
+        ScopedIssueCollector locator(&issues, false);
+        ScopedMessageRecorder fields(&decoded);
+        report = validate_data_message(data, state, options);
+    }
+    AnnotatedMessage annotated;
+    annotated.result = make_result(data, report, issues, decoded);
+    annotated.spans = arrange_spans({}, read, 0);
+    return annotated;
+}
+
+std::string format_annotated(const AnnotatedMessage& message, bool color) {
+    std::vector<uint8_t> data = from_hex(message.result.input);
+    std::ostringstream out;
+    out << message.result.report << "\n";
+    // Ends of the grouping spans the current line is inside
+    std::vector<size_t> open;
+    size_t covered = 0;
+    size_t top_level = 0;
+    const char* tint = "";
+    auto line = [&](size_t start, size_t end, const std::string& bytes, const std::string& label) {
+        out << "  " << pad(offset_range(start, end), 9) << tint << pad(bytes, 36) << std::string(2 * open.size(), ' ')
+            << label << (color ? RESET : "") << "\n";
+    };
+    auto gap = [&](size_t start, size_t end) {
+        const char* saved = tint;
+        tint = "";
+        line(start, end, bracketed_bytes(data, start, end), end == data.size() ? "(not decoded)" : "(skipped)");
+        tint = saved;
+    };
+    for (size_t i = 0; i < message.spans.size(); ++i) {
+        const FieldSpan& span = message.spans[i];
+        if (span.end > data.size() || span.start < covered) continue;
+        while (!open.empty() && span.start >= open.back()) open.pop_back();
+        if (span.start > covered) gap(covered, span.start);
+        if (open.empty() && color) tint = COLORS[top_level++ % (sizeof(COLORS) / sizeof(COLORS[0]))];
+        bool groups = i + 1 < message.spans.size() && message.spans[i + 1].end <= span.end
+                      && message.spans[i + 1].start >= span.start;
+        if (groups) {
+            line(span.start, span.end, "", span.field);
+            open.push_back(span.end);
+            covered = span.start;
+        } else {
+            line(span.start, span.end, bracketed_bytes(data, span.start, span.end), span.field);
+            covered = span.end;
+        }
+    }
+    open.clear();
+    if (covered < data.size()) gap(covered, data.size());
+    return out.str();
+}
+
+} // namespace moqt
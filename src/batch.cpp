@@ -0,0 +1,109 @@
+// batch.cpp
+// Reads batch files of hex messages and validates each line
+
+#include <moqt/batch.hpp>
+#include <moqt/common.hpp>
+#include <moqt/data_parser.hpp>
+#include <moqt/session.hpp>
+#include <moqt/validator.hpp>
+#include <cctype>
+#include <sstream>
+#include <stdexcept>
+
+namespace moqt {
+
+namespace {
+
+std::string trim(const std::string& text) {
+    size_t start = 0;
+    size_t end = text.size();
+    while (start < end && std::isspace(static_cast<unsigned char>(text[start]))) ++start;
+    while (end > start && std::isspace(static_cast<unsigned char>(text[end - 1]))) --end;
+    return text.substr(start, end - start);
+}
+
+// Reports a data message on a line of the other kind, or returns an
+// empty string if the type byte matches it
+std::string check_data_kind(const BatchEntry& entry) {
+    if (entry.bytes.empty()) return "";
+    uint8_t type = entry.bytes[0];
+    bool datagram = type <= OBJECT_DATAGRAM_STATUS_EXT;
+    if (entry.kind == BatchKind::STREAM && datagram) {
+        return "Not a data stream: type " + std::to_string(type) + " is an object datagram";
+    }
+    if (entry.kind == BatchKind::DATAGRAM && !datagram) {
+        return "Not an object datagram: type " + std::to_string(type) + " is not a datagram type";
+    }
+    return "";
+}
+
+} // namespace
+
+BatchKind parse_batch_kind(const std::string& name) {
+    if (name == "control") return BatchKind::CONTROL;
+    if (name == "stream") return BatchKind::STREAM;
+    if (name == "datagram") return BatchKind::DATAGRAM;
+    throw std::invalid_argument("unknown message kind: " + name);
+}
+
+std::vector<BatchEntry> read_batch(const std::string& text, BatchKind default_kind) {
+    std::vector<BatchEntry> entries;
+    std::istringstream lines(text);
+    std::string line;
+    for (size_t number = 1; std::getline(lines, line); ++number) {
+        std::string content = trim(line.substr(0, line.find('#')));
+        if (content.empty()) continue;
+        BatchEntry entry{number, default_kind, {}};
+        size_t colon = content.find(':');
+        try {
+            if (colon != std::string::npos) {
+                entry.kind = parse_batch_kind(trim(content.substr(0, colon)));
+                content = content.substr(colon + 1);
+            }
+            entry.bytes = from_hex(content);
+        } catch (const std::exception& e) {
+            throw std::runtime_error("line " + std::to_string(number) + ": " + e.what());
+        }
+        entries.push_back(entry);
+    }
+    return entries;
+}
+
+std::vector<ValidationResult> validate_batch(const std::vector<BatchEntry>& entries,
+                                             const ValidationOptions& options) {
+    std::vector<ValidationResult> results;
+    SessionState state;
+    for (const auto& entry : entries) {
+        std::vector<ValidationIssue> issues;
+        DecodedMessage decoded;
+        std::string report = entry.kind == BatchKind::CONTROL ? "" : check_data_kind(entry);
+        if (report.empty()) {
+            ScopedIssueCollector locator(&issues, false);
+            ScopedMessageRecorder fields(&decoded);
+            report = entry.kind == BatchKind::CONTROL ? validate_control_message(entry.bytes, state, options)
+                                                      : validate_data_message(entry.bytes, options);
+        }
+        results.push_back(make_result(entry.bytes, report, issues, decoded));
+    }
+    return results;
+}
+
+std::string batch_summary(const std::vector<BatchEntry>& entries, const std::vector<ValidationResult>& results) {
+    size_t passed = 0;
+    std::string failed_lines;
+    for (size_t i = 0; i < results.size(); ++i) {
+        if (results[i].valid) {
+            ++passed;
+            continue;
+        }
+        if (!failed_lines.empty()) failed_lines += ", ";
+        failed_lines += std::to_string(i < entries.size() ? entries[i].line : i + 1);
+    }
+    size_t failed = results.size() - passed;
+    std::string summary = std::to_string(results.size()) + (results.size() == 1 ? " message: " : " messages: ")
+                          + std::to_string(passed) + " passed, " + std::to_string(failed) + " failed";
+    if (failed > 0) summary += (failed == 1 ? " (line " : " (lines ") + failed_lines + ")";
+    return summary;
+}
+
+} // namespace moqt
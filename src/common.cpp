@@ -2,27 +2,413 @@
 // Utility functions for MoQT parsing: varint and length-prefixed strings
 
 #include <moqt/common.hpp>
+#include <cctype>
+#include <cstdio>
 #include <stdexcept>
 #include <string>
 #include <vector>
 
-uint64_t moqt::read_varint(const std::vector<uint8_t>& data, size_t& offset) {
+namespace {
+
+thread_local moqt::VarintMode varint_mode = moqt::VarintMode::LENIENT;
+
+// The active issue collector; issues is null outside collect-all mode
+thread_local moqt::ScopedIssueCollector::State issue_collector;
+
+// The active field recorder; null while none is recording
+thread_local std::vector<moqt::FieldSpan>* field_recorder = nullptr;
+
+// Where the parser's first byte sits in the message being reported on
+thread_local size_t byte_offset_base = 0;
+
+// The active varint log; null while none is logging
+thread_local std::vector<moqt::NonMinimalVarint>* varint_log = nullptr;
+
+// Appends an issue to the active collector, if there is one
+bool collect_issue(const std::exception& e, size_t byte_offset, const std::string& field,
+                   moqt::IssueSeverity severity) {
+    if (!issue_collector.issues) return false;
+    moqt::ValidationIssue issue;
+    issue.byte_offset = byte_offset_base + byte_offset;
+    issue.field = field;
+    issue.severity = severity;
+    issue.message = e.what();
+    if (const auto* violation = dynamic_cast<const moqt::ProtocolViolation*>(&e)) {
+        issue.code = violation->code();
+        if (violation->located()) {
+            issue.byte_offset = byte_offset_base + violation->byte_offset();
+            issue.field = violation->field();
+        }
+    }
+    issue_collector.issues->push_back(issue);
+    issue_collector.failed_field.clear();
+    return true;
+}
+
+// Runs read, which advances offset, noting field as the one that failed
+// if it throws and recording its span if it does not
+template <typename Read>
+auto named_read(const std::string& field, size_t& offset, Read read) -> decltype(read()) {
+    size_t start = offset;
+    try {
+        auto value = read();
+        moqt::note_field_span(field, start, offset);
+        return value;
+    } catch (const std::exception&) {
+        moqt::note_failed_field(field);
+        throw;
+    }
+}
+
+// The field a report's issue is in: the one a named read failed in or
+// recovery was refused for, else the message as a whole
+std::string failed_field_or(const std::string& name) {
+    return issue_collector.failed_field.empty() ? name : issue_collector.failed_field;
+}
+
+// Decodes the varint at offset without advancing it; sets length to the
+// number of bytes it occupies. A truncated varint leaves offset untouched
+// and reports how many of its bytes the buffer holds.
+uint64_t decode_varint(const std::vector<uint8_t>& data, size_t offset, size_t& length) {
     if (offset >= data.size()) throw std::out_of_range("Unexpected end of buffer");
-    uint8_t first = data[offset];
-    if ((first & 0x80) == 0) return data[offset++];
-    if ((first & 0xC0) == 0x80) {
-        if (offset + 1 >= data.size()) throw std::out_of_range("Incomplete varint");
-        uint64_t val = ((first & 0x3F) << 8) | data[offset + 1];
-        offset += 2;
-        return val;
+    length = size_t{1} << (data[offset] >> 6);
+    if (data.size() - offset < length) {
+        throw std::out_of_range("Incomplete varint at offset " + std::to_string(offset) + ": "
+                                + std::to_string(data.size() - offset) + " of " + std::to_string(length)
+                                + " bytes");
+    }
+    uint64_t value = data[offset] & 0x3F;
+    for (size_t i = 1; i < length; ++i) value = (value << 8) | data[offset + i];
+    return value;
+}
+
+// Smallest value that needs a varint of the given length: 2^6, 2^14, 2^30
+uint64_t minimal_value(size_t length) {
+    return length == 1 ? 0 : uint64_t{1} << (8 * (length / 2) - 2);
+}
+
+} // namespace
+
+uint64_t moqt::read_varint(const std::vector<uint8_t>& data, size_t& offset) {
+    if (varint_mode == VarintMode::CANONICAL) return read_varint_canonical(data, offset);
+    size_t length = 0;
+    uint64_t value = decode_varint(data, offset, length);
+    if (varint_log && value < minimal_value(length)) {
+        varint_log->push_back(NonMinimalVarint{byte_offset_base + offset, length, value});
+    }
+    offset += length;
+    return value;
+}
+
+uint64_t moqt::read_varint_canonical(const std::vector<uint8_t>& data, size_t& offset) {
+    size_t length = 0;
+    uint64_t value = decode_varint(data, offset, length);
+    if (value < minimal_value(length)) {
+        throw ProtocolViolation("non-minimal varint at offset " + std::to_string(offset) + ": value "
+                                + std::to_string(value) + " encoded in " + std::to_string(length) + " bytes");
+    }
+    offset += length;
+    return value;
+}
+
+uint64_t moqt::read_varint(std::istream& in) {
+    int first = in.peek();
+    if (first == std::char_traits<char>::eof()) throw std::out_of_range("Unexpected end of stream");
+    size_t length = size_t{1} << (static_cast<uint8_t>(first) >> 6);
+    char bytes[8];
+    in.read(bytes, static_cast<std::streamsize>(length));
+    if (static_cast<size_t>(in.gcount()) < length) {
+        throw std::out_of_range("Incomplete varint: " + std::to_string(in.gcount()) + " of " + std::to_string(length)
+                                + " bytes");
+    }
+    uint64_t value = static_cast<uint8_t>(bytes[0]) & 0x3F;
+    for (size_t i = 1; i < length; ++i) value = (value << 8) | static_cast<uint8_t>(bytes[i]);
+    if (varint_mode == VarintMode::CANONICAL && value < minimal_value(length)) {
+        throw ProtocolViolation("non-minimal varint: value " + std::to_string(value) + " encoded in "
+                                + std::to_string(length) + " bytes");
     }
-    throw std::runtime_error("Unsupported varint format");
+    return value;
+}
+
+void moqt::write_varint(std::vector<uint8_t>& out, uint64_t value) {
+    if (value >= uint64_t{1} << 62) {
+        throw std::invalid_argument("varint value " + std::to_string(value) + " exceeds 2^62-1");
+    }
+    // The two-bit prefix is log2 of the length
+    size_t length = 8;
+    uint8_t prefix = 3;
+    while (length > 1 && value < minimal_value(length)) {
+        length /= 2;
+        --prefix;
+    }
+    for (size_t i = 0; i < length; ++i) {
+        uint8_t byte = static_cast<uint8_t>(value >> (8 * (length - 1 - i)));
+        out.push_back(i == 0 ? static_cast<uint8_t>(byte | prefix << 6) : byte);
+    }
+}
+
+moqt::ScopedVarintMode::ScopedVarintMode(VarintMode mode) : previous_(varint_mode) {
+    varint_mode = mode;
+}
+
+moqt::ScopedVarintMode::~ScopedVarintMode() {
+    varint_mode = previous_;
+}
+
+moqt::ScopedVarintLog::ScopedVarintLog(std::vector<NonMinimalVarint>* varints) : previous_(varint_log) {
+    varint_log = varints;
+}
+
+moqt::ScopedVarintLog::~ScopedVarintLog() {
+    varint_log = previous_;
+}
+
+moqt::ScopedIssueCollector::ScopedIssueCollector(std::vector<ValidationIssue>* issues, bool recover)
+    : previous_(issue_collector) {
+    issue_collector = State{issues, recover, ""};
+}
+
+moqt::ScopedIssueCollector::~ScopedIssueCollector() {
+    issue_collector = previous_;
+}
+
+moqt::ScopedByteOffsetBase::ScopedByteOffsetBase(size_t base) : previous_(byte_offset_base) {
+    byte_offset_base = base;
+}
+
+moqt::ScopedByteOffsetBase::~ScopedByteOffsetBase() {
+    byte_offset_base = previous_;
+}
+
+bool moqt::recover_from(const std::exception& e, size_t byte_offset, const std::string& field) {
+    if (issue_collector.issues && !issue_collector.recover) {
+        // The parser stops here, so the report it ends on is in field
+        note_failed_field(field);
+        return false;
+    }
+    return collect_issue(e, byte_offset, field, IssueSeverity::ERROR);
+}
+
+void moqt::note_failed_field(const std::string& field) {
+    if (issue_collector.issues) issue_collector.failed_field = field;
+}
+
+moqt::ScopedFieldRecorder::ScopedFieldRecorder(std::vector<FieldSpan>* spans) : previous_(field_recorder) {
+    field_recorder = spans;
+}
+
+moqt::ScopedFieldRecorder::~ScopedFieldRecorder() {
+    field_recorder = previous_;
+}
+
+void moqt::note_field_span(const std::string& field, size_t start, size_t end) {
+    if (field_recorder) field_recorder->push_back(FieldSpan{field, start, end});
+}
+
+
+uint8_t moqt::read_u8(const std::vector<uint8_t>& data, size_t& offset) {
+    if (offset >= data.size()) throw std::out_of_range("Unexpected end of buffer");
+    return data[offset++];
+}
+
+uint16_t moqt::read_u16(const std::vector<uint8_t>& data, size_t& offset) {
+    if (offset > data.size() || data.size() - offset < 2) throw std::out_of_range("Unexpected end of buffer");
+    uint16_t value = static_cast<uint16_t>(data[offset] << 8 | data[offset + 1]);
+    offset += 2;
+    return value;
+}
+
+void moqt::check_remaining(const std::vector<uint8_t>& data, size_t offset, uint64_t length,
+                           const std::string& message) {
+    if (offset > data.size() || length > data.size() - offset) throw std::out_of_range(message);
 }
 
 std::string moqt::read_lp_string(const std::vector<uint8_t>& data, size_t& offset) {
-    uint64_t len = read_varint(data, offset);
-    if (offset + len > data.size()) throw std::out_of_range("String length exceeds buffer");
+    uint64_t len = read_varint_canonical(data, offset);
+    check_remaining(data, offset, len, "String length exceeds buffer");
     std::string result(data.begin() + offset, data.begin() + offset + len);
     offset += len;
     return result;
 }
+
+std::vector<std::string> moqt::read_tuple(const std::vector<uint8_t>& data, size_t& offset, size_t min_fields) {
+    uint64_t count = read_varint(data, offset);
+    if (count < min_fields || count > 32) {
+        throw ProtocolViolation("track namespace has " + std::to_string(count) + " fields, expected "
+                                + std::to_string(min_fields) + "-32");
+    }
+    std::vector<std::string> fields;
+    for (uint64_t i = 0; i < count; ++i) {
+        fields.push_back(read_lp_string(data, offset));
+    }
+    return fields;
+}
+
+moqt::Location moqt::read_location(const std::vector<uint8_t>& data, size_t& offset) {
+    uint64_t group = read_varint(data, offset);
+    uint64_t object = read_varint(data, offset);
+    return Location{group, object};
+}
+
+uint64_t moqt::read_varint(const std::vector<uint8_t>& data, size_t& offset, const std::string& field) {
+    return named_read(field, offset, [&] { return read_varint(data, offset); });
+}
+
+uint64_t moqt::read_varint_canonical(const std::vector<uint8_t>& data, size_t& offset, const std::string& field) {
+    return named_read(field, offset, [&] { return read_varint_canonical(data, offset); });
+}
+
+uint8_t moqt::read_u8(const std::vector<uint8_t>& data, size_t& offset, const std::string& field) {
+    return named_read(field, offset, [&] { return read_u8(data, offset); });
+}
+
+std::string moqt::read_lp_string(const std::vector<uint8_t>& data, size_t& offset, const std::string& field) {
+    return named_read(field, offset, [&] { return read_lp_string(data, offset); });
+}
+
+std::vector<std::string> moqt::read_tuple(const std::vector<uint8_t>& data, size_t& offset, size_t min_fields,
+                                          const std::string& field) {
+    return named_read(field, offset, [&] { return read_tuple(data, offset, min_fields); });
+}
+
+moqt::Location moqt::read_location(const std::vector<uint8_t>& data, size_t& offset, const std::string& field) {
+    return named_read(field, offset, [&] { return read_location(data, offset); });
+}
+
+std::string moqt::to_string(const Location& location) {
+    return std::to_string(location.group) + ":" + std::to_string(location.object);
+}
+
+bool moqt::is_valid_utf8(const std::string& s) {
+    size_t i = 0;
+    while (i < s.size()) {
+        uint8_t c = static_cast<uint8_t>(s[i]);
+        size_t len;
+        uint32_t cp;
+        if (c < 0x80) {
+            ++i;
+            continue;
+        } else if ((c & 0xE0) == 0xC0) {
+            len = 2;
+            cp = c & 0x1F;
+        } else if ((c & 0xF0) == 0xE0) {
+            len = 3;
+            cp = c & 0x0F;
+        } else if ((c & 0xF8) == 0xF0) {
+            len = 4;
+            cp = c & 0x07;
+        } else {
+            return false;
+        }
+        if (i + len > s.size()) return false;
+        for (size_t k = 1; k < len; ++k) {
+            uint8_t cont = static_cast<uint8_t>(s[i + k]);
+            if ((cont & 0xC0) != 0x80) return false;
+            cp = (cp << 6) | (cont & 0x3F);
+        }
+        static const uint32_t min_for_len[] = {0, 0, 0x80, 0x800, 0x10000};
+        if (cp < min_for_len[len] || cp > 0x10FFFF || (cp >= 0xD800 && cp <= 0xDFFF)) return false;
+        i += len;
+    }
+    return true;
+}
+
+std::string moqt::to_hex(const std::vector<uint8_t>& data) {
+    std::string result;
+    char byte[3];
+    for (size_t i = 0; i < data.size(); ++i) {
+        if (i > 0) result += ' ';
+        std::snprintf(byte, sizeof(byte), "%02x", data[i]);
+        result += byte;
+    }
+    return result;
+}
+
+std::vector<uint8_t> moqt::from_hex(const std::string& text) {
+    std::string digits;
+    for (char c : text) {
+        if (std::isspace(static_cast<unsigned char>(c))) continue;
+        if (!std::isxdigit(static_cast<unsigned char>(c))) throw std::invalid_argument("invalid hex: " + text);
+        digits += c;
+    }
+    if (digits.size() % 2 != 0) throw std::invalid_argument("odd number of hex digits: " + text);
+    std::vector<uint8_t> bytes;
+    for (size_t i = 0; i < digits.size(); i += 2) {
+        bytes.push_back(static_cast<uint8_t>(std::stoul(digits.substr(i, 2), nullptr, 16)));
+    }
+    return bytes;
+}
+
+uint32_t moqt::crc32(const std::vector<uint8_t>& data) {
+    uint32_t crc = 0xFFFFFFFF;
+    for (uint8_t byte : data) {
+        crc ^= byte;
+        for (int bit = 0; bit < 8; ++bit) {
+            crc = (crc >> 1) ^ (0xEDB88320 & (0u - (crc & 1)));
+        }
+    }
+    return ~crc;
+}
+
+std::vector<uint8_t> moqt::strip_crc32(const std::vector<uint8_t>& data) {
+    if (data.size() < 4) throw ChecksumMismatch("message too short for a CRC-32 trailer");
+    std::vector<uint8_t> inner(data.begin(), data.end() - 4);
+    size_t n = data.size();
+    uint32_t expected = (static_cast<uint32_t>(data[n - 4]) << 24) | (static_cast<uint32_t>(data[n - 3]) << 16)
+                        | (static_cast<uint32_t>(data[n - 2]) << 8) | data[n - 1];
+    uint32_t actual = crc32(inner);
+    if (actual != expected) {
+        char buf[64];
+        std::snprintf(buf, sizeof(buf), "expected 0x%08x, computed 0x%08x", expected, actual);
+        throw ChecksumMismatch(buf);
+    }
+    return inner;
+}
+
+std::string moqt::parse_error_report(const std::string& name, const std::exception& e, size_t byte_offset) {
+    collect_issue(e, byte_offset, failed_field_or(name), IssueSeverity::FATAL);
+    return name + " parse error: " + e.what() + " (byte_offset=" + std::to_string(byte_offset_base + byte_offset) +
+           ")";
+}
+
+std::string moqt::protocol_violation_report(const std::string& name, const std::exception& e, size_t byte_offset) {
+    collect_issue(e, byte_offset, failed_field_or(name), IssueSeverity::FATAL);
+    const auto* violation = dynamic_cast<const ProtocolViolation*>(&e);
+    if (violation && violation->located()) byte_offset = violation->byte_offset();
+    return name + " protocol violation: " + e.what() + " (byte_offset=" + std::to_string(byte_offset_base + byte_offset)
+           + ")";
+}
+
+std::string moqt::termination_code_name(uint64_t code) {
+    switch (code) {
+        case TERMINATION_NO_ERROR: return "NO_ERROR";
+        case TERMINATION_INTERNAL_ERROR: return "INTERNAL_ERROR";
+        case TERMINATION_UNAUTHORIZED: return "UNAUTHORIZED";
+        case TERMINATION_PROTOCOL_VIOLATION: return "PROTOCOL_VIOLATION";
+        case TERMINATION_INVALID_REQUEST_ID: return "INVALID_REQUEST_ID";
+        case TERMINATION_DUPLICATE_TRACK_ALIAS: return "DUPLICATE_TRACK_ALIAS";
+        case TERMINATION_KEY_VALUE_FORMATTING_ERROR: return "KEY_VALUE_FORMATTING_ERROR";
+        case TERMINATION_TOO_MANY_REQUESTS: return "TOO_MANY_REQUESTS";
+        case TERMINATION_INVALID_PATH: return "INVALID_PATH";
+        case TERMINATION_MALFORMED_PATH: return "MALFORMED_PATH";
+        case TERMINATION_GOAWAY_TIMEOUT: return "GOAWAY_TIMEOUT";
+        case TERMINATION_CONTROL_MESSAGE_TIMEOUT: return "CONTROL_MESSAGE_TIMEOUT";
+        case TERMINATION_DATA_STREAM_TIMEOUT: return "DATA_STREAM_TIMEOUT";
+        case TERMINATION_AUTH_TOKEN_CACHE_OVERFLOW: return "AUTH_TOKEN_CACHE_OVERFLOW";
+        case TERMINATION_DUPLICATE_AUTH_TOKEN_ALIAS: return "DUPLICATE_AUTH_TOKEN_ALIAS";
+        case TERMINATION_VERSION_NEGOTIATION_FAILED: return "VERSION_NEGOTIATION_FAILED";
+        default: return "UNKNOWN";
+    }
+}
+
+moqt::ProtocolViolation::ProtocolViolation(const std::string& what, SessionTerminationCode code)
+    : std::runtime_error(code == TERMINATION_PROTOCOL_VIOLATION ? what
+                                                                 : what + " (" + termination_code_name(code) + ")"),
+      code_(code) {}
+
+moqt::ProtocolViolation::ProtocolViolation(const std::string& what, const std::string& field, size_t byte_offset,
+                                           SessionTerminationCode code)
+    : ProtocolViolation(what, code) {
+    field_ = field;
+    byte_offset_ = byte_offset;
+}
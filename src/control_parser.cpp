@@ -2,62 +2,1692 @@
 // Handles parsing of MoQT control messages
 
 #include <moqt/control_parser.hpp>
-#include <moqt/common.hpp> 
+#include <moqt/common.hpp>
+#include <moqt/encoder.hpp>
+#include <algorithm>
+#include <iomanip>
+#include <set>
 #include <sstream>
 #include <stdexcept>
 
 namespace moqt {
 
-std::string parse_subscribe(const std::vector<uint8_t>& payload) {
+namespace {
+
+// Removes a subscription and frees its track alias if no other
+// subscription still uses it. Returns the freed subscription's alias.
+uint64_t end_subscription(SessionState& state, std::map<uint64_t, Subscription>::iterator it) {
+    uint64_t track_alias = it->second.track_alias;
+    state.active_subscriptions.erase(it);
+    for (const auto& entry : state.active_subscriptions) {
+        if (entry.second.track_alias == track_alias) return track_alias;
+    }
+    state.active_tracks.erase(track_alias);
+    return track_alias;
+}
+
+// Joins tuple fields with '/' for display
+std::string join_tuple(const std::vector<std::string>& fields) {
+    std::string joined;
+    for (size_t i = 0; i < fields.size(); ++i) {
+        if (i > 0) joined += "/";
+        joined += fields[i];
+    }
+    return joined;
+}
+
+// Every field of a control message has been read; anything left over is
+// a miscomputed length or appended garbage unless the options allow it
+void check_trailing_bytes(const std::vector<uint8_t>& payload, size_t offset, const ValidationOptions& options) {
+    if (offset < payload.size() && !options.allow_trailing_bytes) {
+        ProtocolViolation e(std::to_string(payload.size() - offset) + " trailing bytes after the last field",
+                            "trailing bytes", offset);
+        if (!recover_from(e, offset, "trailing bytes")) throw e;
+    }
+}
+
+// Request IDs chosen by the client have the least significant bit unset,
+// those chosen by the server have it set. requester is the direction the
+// request travelled in; when unknown the client is assumed. offset is
+// where the Request ID was read from.
+void validate_request_id(uint64_t request_id, size_t offset, Direction requester) {
+    if (requester == SERVER_TO_CLIENT) {
+        if (request_id % 2 != 1) {
+            throw ProtocolViolation("request_id=" + std::to_string(request_id) + " is not a server (odd) request ID",
+                                    "request_id", offset, TERMINATION_INVALID_REQUEST_ID);
+        }
+        return;
+    }
+    if (request_id % 2 != 0) {
+        throw ProtocolViolation("request_id=" + std::to_string(request_id) + " is not a client (even) request ID",
+                                "request_id", offset, TERMINATION_INVALID_REQUEST_ID);
+    }
+}
+
+// Applies a decoded auth token sent in direction to the receiver's token
+// cache. REGISTER adds the token under an alias not already registered,
+// even for the same value, and must fit in the size the receiver
+// advertised; USE_ALIAS and DELETE must name a registered alias, and
+// DELETE frees it. token_size is the length of the Token Value, and
+// violations are located at the parameter field read from offset.
+void apply_auth_token(SessionState& state, Direction direction, uint64_t alias_type, uint64_t alias,
+                      uint64_t token_size, const std::string& field, size_t offset) {
+    AuthTokenCache& cache = state.auth_tokens(direction);
+    if (alias_type == AUTH_TOKEN_REGISTER) {
+        if (cache.tokens.count(alias)) {
+            throw ProtocolViolation("auth token alias " + std::to_string(alias) + " is already registered", field,
+                                    offset, TERMINATION_DUPLICATE_AUTH_TOKEN_ALIAS);
+        }
+        if (cache.bytes + token_size > cache.max_size) {
+            throw ProtocolViolation("registering auth token alias " + std::to_string(alias) + " needs "
+                                    + std::to_string(cache.bytes + token_size) + " bytes of a "
+                                    + std::to_string(cache.max_size) + "-byte cache",
+                                    field, offset, TERMINATION_AUTH_TOKEN_CACHE_OVERFLOW);
+        }
+        cache.tokens[alias] = token_size;
+        cache.bytes += token_size;
+    } else if (alias_type == AUTH_TOKEN_USE_ALIAS || alias_type == AUTH_TOKEN_DELETE) {
+        auto it = cache.tokens.find(alias);
+        if (it == cache.tokens.end()) {
+            throw ProtocolViolation("auth token alias " + std::to_string(alias) + " is not registered", field,
+                                    offset);
+        }
+        if (alias_type == AUTH_TOKEN_DELETE) {
+            cache.bytes -= it->second;
+            cache.tokens.erase(it);
+        }
+    }
+}
+
+// Decodes an AUTHORIZATION_TOKEN parameter value sent in direction and
+// applies it to the receiver's token cache. The token is read from a copy
+// of the value alone, so the parameter length bounds it exactly: fields
+// running past it and bytes left over after it are both errors, located
+// at the parameter field read from field_offset.
+std::string describe_auth_token(const std::string& value, SessionState& state, Direction direction,
+                                const std::string& field, size_t field_offset) {
+    std::vector<uint8_t> token(value.begin(), value.end());
+    ScopedVarintLog copied(nullptr);
+    size_t offset = 0;
+    std::ostringstream out;
+    uint64_t alias_type = 0;
+    uint64_t alias = 0;
+    uint64_t token_size = 0;
+    try {
+        alias_type = read_varint(token, offset);
+        out << "alias_type=" << auth_token_alias_type_name(alias_type);
+        if (alias_type != AUTH_TOKEN_USE_VALUE) {
+            alias = read_varint(token, offset);
+            out << ", alias=" << alias;
+        }
+        if (alias_type == AUTH_TOKEN_REGISTER || alias_type == AUTH_TOKEN_USE_VALUE) {
+            out << ", token_type=" << read_varint(token, offset);
+            token_size = token.size() - offset;
+            out << ", token_value_length=" << token_size;
+            offset = token.size();
+        } else if (alias_type != AUTH_TOKEN_DELETE && alias_type != AUTH_TOKEN_USE_ALIAS) {
+            throw ProtocolViolation("undefined auth token alias_type=" + std::to_string(alias_type), field,
+                                    field_offset, TERMINATION_KEY_VALUE_FORMATTING_ERROR);
+        }
+    } catch (const std::out_of_range&) {
+        throw ProtocolViolation("auth token fields overrun its " + std::to_string(token.size()) + "-byte parameter",
+                                field, field_offset, TERMINATION_KEY_VALUE_FORMATTING_ERROR);
+    }
+    if (offset != token.size()) {
+        throw ProtocolViolation("auth token leaves " + std::to_string(token.size() - offset)
+                                    + " unused bytes in its parameter",
+                                field, field_offset, TERMINATION_KEY_VALUE_FORMATTING_ERROR);
+    }
+    apply_auth_token(state, direction, alias_type, alias, token_size, field, field_offset);
+    return out.str();
+}
+
+// Renders a duration in milliseconds as hours, minutes and seconds,
+// e.g. 5400250 as "1h30m0.250s"
+std::string describe_duration(uint64_t ms) {
+    std::ostringstream out;
+    uint64_t hours = ms / 3600000;
+    uint64_t minutes = ms / 60000 % 60;
+    uint64_t seconds = ms / 1000 % 60;
+    uint64_t millis = ms % 1000;
+    if (hours) out << hours << "h";
+    if (hours || minutes) out << minutes << "m";
+    out << seconds;
+    if (millis) out << "." << std::setw(3) << std::setfill('0') << millis;
+    out << "s";
+    return out.str();
+}
+
+// Throws if a defined parameter type, AUTHORIZATION_TOKEN included, occurs
+// twice in one list. Unknown types are exempt. The repeat is located at
+// the parameter field read from offset.
+void check_single_occurrence(std::set<uint64_t>& seen, uint64_t type, const std::string& name, const char* kind,
+                             const std::string& field, size_t offset) {
+    if (name == "UNKNOWN") return;
+    if (!seen.insert(type).second) {
+        throw ProtocolViolation("duplicate " + name + " " + kind + " parameter", field, offset,
+                                TERMINATION_KEY_VALUE_FORMATTING_ERROR);
+    }
+}
+
+// Names parameter i of a list for an issue found in it
+std::string parameter_field(uint64_t i) {
+    return "Params[" + std::to_string(i) + "]";
+}
+
+// Reads a parameter count followed by key-value pairs, appends them to
+// report and stores them in list. Even types carry a varint value, odd
+// types a length-prefixed one. In collect-all mode a duplicate or rejected
+// parameter is recorded and the rest of the list still read.
+void read_parameters(const std::vector<uint8_t>& payload, size_t& offset, std::ostringstream& report,
+                     SessionState& state, Direction direction, std::vector<Parameter>& list) {
+    uint64_t count = read_varint(payload, offset, "Params");
+    report << "; Params=";
+    std::set<uint64_t> seen;
+    for (uint64_t i = 0; i < count; ++i) {
+        size_t start = offset;
+        std::string field = parameter_field(i);
+        uint64_t type = read_varint(payload, offset, field);
+        try {
+            check_single_occurrence(seen, type, parameter_name(type), "request", field, start);
+        } catch (const ProtocolViolation& e) {
+            if (!recover_from(e, start, field)) throw;
+        }
+        report << " [" << type << ":";
+        Parameter param;
+        param.type = type;
+        if (type == PARAM_DELIVERY_TIMEOUT || type == PARAM_MAX_CACHE_DURATION) {
+            // Both are even types, so the key-value encoding always gives
+            // them a varint value: a duration in milliseconds
+            uint64_t ms = read_varint(payload, offset, field);
+            param.value = ms;
+            report << (type == PARAM_DELIVERY_TIMEOUT ? "delivery_timeout " : "max_cache_duration ") << ms << "ms";
+            if (type == PARAM_DELIVERY_TIMEOUT && ms == 0) {
+                report << " (no timeout)";
+            } else {
+                report << " (" << describe_duration(ms) << ")";
+            }
+        } else if (type % 2 == 0) {
+            param.value = read_varint(payload, offset, field);
+            report << param.value;
+        } else if (type == PARAM_AUTHORIZATION_TOKEN) {
+            std::string value = read_lp_string(payload, offset, field);
+            param.bytes = value;
+            report << "auth_token ";
+            try {
+                report << describe_auth_token(value, state, direction, field, start);
+            } catch (const std::exception& e) {
+                // The parameter length already bounds the token, so the
+                // list goes on after it
+                if (!recover_from(e, start, field)) throw;
+                report << "rejected";
+            }
+        } else {
+            param.bytes = read_lp_string(payload, offset, field);
+            report << param.bytes;
+        }
+        report << "]";
+        list.push_back(param);
+    }
+}
+
+// Values of the setup parameters the session state depends on; each is 0
+// when its parameter is absent
+struct SetupParameters {
+    bool has_max_request_id = false;
+    uint64_t max_request_id = 0;
+    uint64_t max_auth_token_cache_size = 0;
+    bool has_path = false;
+};
+
+// Reads the parameters of CLIENT_SETUP or SERVER_SETUP, encoded like
+// request parameters but with their own type space, appends them to
+// report, preceded by the decoded MAX_REQUEST_ID if there is one, and
+// stores them in list
+SetupParameters read_setup_parameters(const std::vector<uint8_t>& payload, size_t& offset,
+                                      std::ostringstream& out, std::vector<Parameter>& list) {
+    SetupParameters params;
+    std::ostringstream report;
+    uint64_t count = read_varint(payload, offset, "Params");
+    report << "; Params=";
+    std::set<uint64_t> seen;
+    for (uint64_t i = 0; i < count; ++i) {
+        size_t start = offset;
+        std::string field = parameter_field(i);
+        uint64_t type = read_varint(payload, offset, field);
+        try {
+            check_single_occurrence(seen, type, setup_parameter_name(type), "setup", field, start);
+        } catch (const ProtocolViolation& e) {
+            if (!recover_from(e, start, field)) throw;
+        }
+        report << " [" << type << ":";
+        Parameter param;
+        param.type = type;
+        if (type % 2 == 0) {
+            uint64_t value = read_varint(payload, offset, field);
+            param.value = value;
+            if (type == SETUP_PARAM_MAX_REQUEST_ID) {
+                params.has_max_request_id = true;
+                params.max_request_id = value;
+            }
+            if (type == SETUP_PARAM_MAX_AUTH_TOKEN_CACHE_SIZE) params.max_auth_token_cache_size = value;
+            report << value;
+        } else {
+            if (type == SETUP_PARAM_PATH) params.has_path = true;
+            param.bytes = read_lp_string(payload, offset, field);
+            report << param.bytes;
+        }
+        report << "]";
+        list.push_back(param);
+    }
+    if (params.has_max_request_id) out << ", max_request_id=" << params.max_request_id;
+    out << report.str();
+    return params;
+}
+
+// Checks the single-byte SUBSCRIBE fields. When group order or forward is
+// out of range, suggests a swap of adjacent fields if that would make all
+// three valid, since encoders commonly write them in the wrong order.
+// offset is where the priority was read from; the other two follow it.
+void check_subscribe_flags(uint8_t priority, uint8_t group_order, uint8_t forward, size_t offset) {
+    auto valid_order = [](uint8_t v) { return v <= 2; };
+    auto valid_forward = [](uint8_t v) { return v <= 1; };
+    std::string problem;
+    std::string field;
+    if (!valid_order(group_order)) {
+        problem = "invalid group_order=" + std::to_string(group_order);
+        field = "group_order";
+        offset += 1;
+    } else if (!valid_forward(forward)) {
+        problem = "invalid forward=" + std::to_string(forward);
+        field = "forward";
+        offset += 2;
+    } else {
+        return;
+    }
+    std::string hint;
+    if (valid_order(forward) && valid_forward(group_order)) {
+        hint = "group_order and forward";
+    } else if (valid_order(priority) && valid_forward(forward)) {
+        hint = "subscriber_priority and group_order";
+    } else if (valid_order(group_order) && valid_forward(priority)) {
+        hint = "subscriber_priority and forward";
+    }
+    if (!hint.empty()) problem += " (hint: " + hint + " may be swapped)";
+    throw ProtocolViolation(problem, field, offset);
+}
+
+// Checks a new request's ID against the maximum granted to its sender,
+// once one has been granted by SETUP or MAX_REQUEST_ID. Warns when the
+// request takes the last ID below the maximum, since the sender is then
+// blocked until the peer raises it. offset is where the Request ID was
+// read from.
+void check_request_limit(const SessionState& state, uint64_t request_id, size_t offset, Direction direction,
+                         std::ostringstream& warnings) {
+    auto it = state.max_request_ids.find(reverse(direction));
+    if (it == state.max_request_ids.end()) return;
+    uint64_t limit = it->second;
+    if (request_id >= limit) {
+        throw ProtocolViolation("request_id=" + std::to_string(request_id) + " is not below max_request_id="
+                                + std::to_string(limit), "request_id", offset, TERMINATION_TOO_MANY_REQUESTS);
+    }
+    if (request_id + 2 >= limit) {
+        warnings << " [request_id=" << request_id << " uses the last Request ID below max_request_id=" << limit << "]";
+    }
+}
+
+// Reads the SUBSCRIBE fields after Filter Type: the optional Start Location
+// and End Group, End Object in the drafts that have it, then the
+// parameters into list. Advances offset past the parameters and sets
+// end_group_offset to where End Group was read from.
+void read_filter_fields(const std::vector<uint8_t>& payload, size_t& offset, bool has_start,
+                        bool has_end_group, Subscription& sub, std::ostringstream& params, SessionState& state,
+                        Direction direction, std::vector<Parameter>& list, size_t& end_group_offset) {
+    sub.open_ended = !has_end_group;
+    if (has_start) sub.start = read_location(payload, offset, "start");
+    end_group_offset = offset;
+    if (has_end_group) sub.end_group = read_varint(payload, offset, "end_group");
+    if (has_end_group && subscribe_has_end_object(state.current_version)) {
+        sub.end_object = read_varint(payload, offset, "end_object");
+    }
+    read_parameters(payload, offset, params, state, direction, list);
+}
+
+// Called when the fields after Filter Type do not fit the filter's spec.
+// If the bytes fit another filter's layout exactly, the usual cause is a
+// field added or left out, so name it, locating the violation at the
+// Filter Type read from filter_type_offset.
+void check_filter_layout(const std::vector<uint8_t>& payload, size_t offset, const FilterFieldSpec& spec,
+                         const SessionState& state, Direction direction, size_t filter_type_offset) {
+    const bool layouts[][2] = {{false, false}, {true, false}, {true, true}};
+    std::string name = filter_type_name(spec.filter_type);
+    ScopedIssueCollector trial(nullptr);
+    ScopedFieldRecorder no_spans(nullptr);
+    ScopedVarintLog no_log(nullptr);
+    for (const auto& layout : layouts) {
+        if (layout[0] == spec.has_start && layout[1] == spec.has_end_group) continue;
+        Subscription scratch{};
+        std::ostringstream scratch_params;
+        std::vector<Parameter> scratch_list;
+        SessionState scratch_state = state;
+        size_t end = offset;
+        size_t scratch_end_group = 0;
+        try {
+            read_filter_fields(payload, end, layout[0], layout[1], scratch, scratch_params, scratch_state,
+                               direction, scratch_list, scratch_end_group);
+            if (end != payload.size()) continue;
+        } catch (const std::exception&) {
+            continue;
+        }
+        std::string problem;
+        if (layout[0] && !spec.has_start) {
+            problem = name + " must not carry a start location";
+        } else if (!layout[0] && spec.has_start) {
+            problem = name + " is missing its start location";
+        } else if (layout[1] && !spec.has_end_group) {
+            problem = name + " must not carry an end group";
+        } else {
+            problem = name + " is missing its end group";
+        }
+        throw ProtocolViolation(problem, "filter_type", filter_type_offset);
+    }
+}
+
+// Whether the bytes from offset on are exactly a Start Location, with or
+// without the end of an ABSOLUTE_RANGE in version's layout: what an
+// encoder that writes the range fields of an absolute filter after the
+// parameters leaves behind
+bool reads_as_range_fields(const std::vector<uint8_t>& payload, size_t offset, uint64_t version) {
+    ScopedIssueCollector trial(nullptr);
+    ScopedFieldRecorder no_spans(nullptr);
+    ScopedVarintLog no_log(nullptr);
+    size_t fields = 0;
+    try {
+        while (offset < payload.size()) {
+            read_varint(payload, offset);
+            ++fields;
+        }
+    } catch (const std::exception&) {
+        return false;
+    }
+    size_t range_fields = subscribe_has_end_object(version) ? 4 : 3;
+    return fields == 2 || fields == range_fields;
+}
+
+} // namespace
+
+namespace {
+
+const FilterFieldSpec filter_field_specs[] = {
+    {FILTER_NEXT_GROUP_START, false, false},
+    {FILTER_LATEST_OBJECT, false, false},
+    {FILTER_ABSOLUTE_START, true, false},
+    {FILTER_ABSOLUTE_RANGE, true, true},
+};
+
+} // namespace
+
+const FilterFieldSpec* find_filter_field_spec(uint64_t filter_type) {
+    for (const auto& spec : filter_field_specs) {
+        if (spec.filter_type == filter_type) return &spec;
+    }
+    return nullptr;
+}
+
+bool subscribe_has_end_object(uint64_t version) {
+    return version >= DRAFT_VERSION_BASE && version < DRAFT_VERSION_BASE + 8;
+}
+
+bool checks_group_aligned_fetch(uint64_t version) {
+    return !(version >= DRAFT_VERSION_BASE && version < DRAFT_VERSION_BASE + 7);
+}
+
+std::string filter_type_name(uint64_t type) {
+    switch (type) {
+        case FILTER_NEXT_GROUP_START: return "NEXT_GROUP_START";
+        case FILTER_LATEST_OBJECT: return "LATEST_OBJECT";
+        case FILTER_ABSOLUTE_START: return "ABSOLUTE_START";
+        case FILTER_ABSOLUTE_RANGE: return "ABSOLUTE_RANGE";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_subscribe(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                            const ValidationOptions& options) {
     size_t offset = 0;
     std::ostringstream report;
+    std::ostringstream warnings;
     try {
-        uint64_t request_id = read_varint(payload, offset);
-        uint64_t track_alias = read_varint(payload, offset);
-        report << "SUBSCRIBE: request_id=" << request_id << ", track_alias=" << track_alias;
+        Subscription sub{};
+        size_t request_id_offset = offset;
+        sub.request_id = read_varint(payload, offset, "request_id");
+        size_t track_alias_offset = offset;
+        sub.track_alias = read_varint(payload, offset, "track_alias");
+        sub.track_namespace = read_tuple(payload, offset, 1, "track_namespace");
+        sub.track_name = read_lp_string(payload, offset, "track_name");
+        size_t priority_offset = offset;
+        uint8_t priority = read_u8(payload, offset, "priority");
+        uint8_t group_order = read_u8(payload, offset, "group_order");
+        uint8_t forward = read_u8(payload, offset, "forward");
+        size_t filter_type_offset = offset;
+        sub.filter_type = read_varint(payload, offset, "filter_type");
+        sub.open_ended = true;
+        report << "SUBSCRIBE: request_id=" << sub.request_id << ", track_alias=" << sub.track_alias
+               << ", namespace=" << join_tuple(sub.track_namespace)
+               << ", name=" << sub.track_name
+               << ", priority=" << static_cast<int>(priority)
+               << ", group_order=" << static_cast<int>(group_order)
+               << ", forward=" << static_cast<int>(forward)
+               << ", filter=" << filter_type_name(sub.filter_type) << "(" << sub.filter_type << ")";
+        check_subscribe_flags(priority, group_order, forward, priority_offset);
+        const FilterFieldSpec* spec = find_filter_field_spec(sub.filter_type);
+        if (!spec) {
+            throw ProtocolViolation("invalid filter_type=" + std::to_string(sub.filter_type), "filter_type",
+                                    filter_type_offset);
+        }
+        std::ostringstream params;
+        SubscribeMessage decoded;
+        size_t filter_fields = offset;
+        size_t end_group_offset = offset;
+        try {
+            read_filter_fields(payload, offset, spec->has_start, spec->has_end_group, sub, params, state, direction,
+                               decoded.params, end_group_offset);
+        } catch (const ProtocolViolation& e) {
+            // Unless a parameter failed to decode, the fields did, so the
+            // layout is not what is wrong
+            if (e.code() == TERMINATION_KEY_VALUE_FORMATTING_ERROR) {
+                check_filter_layout(payload, filter_fields, *spec, state, direction, filter_type_offset);
+            }
+            throw;
+        } catch (const std::exception&) {
+            check_filter_layout(payload, filter_fields, *spec, state, direction, filter_type_offset);
+            throw;
+        }
+        bool has_end_object = spec->has_end_group && subscribe_has_end_object(state.current_version);
+        decoded.request_id = sub.request_id;
+        decoded.track_alias = sub.track_alias;
+        decoded.track_namespace = sub.track_namespace;
+        decoded.track_name = sub.track_name;
+        decoded.subscriber_priority = priority;
+        decoded.group_order = group_order;
+        decoded.forward = forward;
+        decoded.filter_type = sub.filter_type;
+        decoded.start = sub.start;
+        decoded.end_group = sub.end_group;
+        decoded.has_end_object = has_end_object;
+        decoded.end_object = sub.end_object;
+        record_message({SUBSCRIBE, decoded});
+        if (offset != payload.size()) {
+            check_filter_layout(payload, filter_fields, *spec, state, direction, filter_type_offset);
+        }
+        // Trailing bytes may be allowed, but not range fields on a filter
+        // that has none
+        if (!spec->has_start && offset < payload.size() &&
+            reads_as_range_fields(payload, offset, state.current_version)) {
+            throw ProtocolViolation(filter_type_name(sub.filter_type) + " carries "
+                                    + std::to_string(payload.size() - offset)
+                                    + " bytes of range fields after its parameters",
+                                    "trailing bytes", offset);
+        }
+        check_trailing_bytes(payload, offset, options);
+        if (spec->has_start) report << ", start=" << to_string(sub.start);
+        if (has_end_object) {
+            report << ", end=" << to_string(Location{sub.end_group, sub.end_object});
+            if (sub.end_object == 0) report << " (whole group)";
+        } else if (spec->has_end_group) {
+            report << ", end_group=" << sub.end_group;
+        }
+        report << params.str();
+        // End Group is inclusive, so a range ending in the start group
+        // still delivers the objects from the start on
+        if (subscription_range(sub).empty()) {
+            if (sub.end_object != 0) {
+                throw ProtocolViolation("end=" + to_string(Location{sub.end_group, sub.end_object})
+                                        + " requests no objects from start=" + to_string(sub.start),
+                                        "end_group", end_group_offset);
+            }
+            throw ProtocolViolation("end_group=" + std::to_string(sub.end_group) + " is before start="
+                                    + to_string(sub.start), "end_group", end_group_offset);
+        }
+        validate_request_id(sub.request_id, request_id_offset, direction);
+        check_request_limit(state, sub.request_id, request_id_offset, direction, warnings);
+        if (state.active_tracks.count(sub.track_alias)) {
+            for (const auto& entry : state.active_subscriptions) {
+                const Subscription& other = entry.second;
+                if (other.track_alias == sub.track_alias
+                    && (other.track_namespace != sub.track_namespace || other.track_name != sub.track_name)) {
+                    throw ProtocolViolation("duplicate track_alias=" + std::to_string(sub.track_alias),
+                                            "track_alias", track_alias_offset, TERMINATION_DUPLICATE_TRACK_ALIAS);
+                }
+            }
+        }
+        state.active_subscriptions[sub.request_id] = sub;
+        state.active_tracks.insert(sub.track_alias);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE", e, offset);
     } catch (const std::exception& e) {
-        return std::string("SUBSCRIBE parse error: ") + e.what();
+        return parse_error_report("SUBSCRIBE", e, offset);
     }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
     return report.str();
 }
 
-std::string parse_client_setup(const std::vector<uint8_t>& payload) {
+std::string parse_subscribe_update(const std::vector<uint8_t>& payload, SessionState& state,
+                                   Direction direction, const ValidationOptions& options) {
     size_t offset = 0;
     std::ostringstream report;
     try {
-        uint64_t version_count = read_varint(payload, offset);
-        report << "CLIENT_SETUP: versions=" << version_count;
-        for (uint64_t i = 0; i < version_count; ++i) {
-            uint64_t version = read_varint(payload, offset);
-            report << " v" << version;
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        size_t start_offset = offset;
+        Location start = read_location(payload, offset, "start");
+        // End Group is encoded as the last group plus one; zero means open-ended
+        size_t end_group_offset = offset;
+        uint64_t end_group_plus_one = read_varint(payload, offset, "end_group");
+        uint8_t priority = read_u8(payload, offset, "priority");
+        uint8_t forward = read_u8(payload, offset, "forward");
+        report << "SUBSCRIBE_UPDATE: request_id=" << request_id
+               << ", start=" << to_string(start)
+               << ", end_group=";
+        if (end_group_plus_one == 0) {
+            report << "open";
+        } else {
+            report << end_group_plus_one - 1;
         }
-        report << "; Params=";
-        while (offset < payload.size()) {
-            uint64_t param_type = read_varint(payload, offset);
-            std::string param_value = read_lp_string(payload, offset);
-            report << " [" << param_type << ":" << param_value << "]";
+        report << ", priority=" << static_cast<int>(priority)
+               << ", forward=" << static_cast<int>(forward);
+        SubscribeUpdateMessage decoded;
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        decoded.request_id = request_id;
+        decoded.start = start;
+        decoded.open_ended = end_group_plus_one == 0;
+        decoded.end_group = decoded.open_ended ? 0 : end_group_plus_one - 1;
+        decoded.subscriber_priority = priority;
+        decoded.forward = forward;
+        record_message({SUBSCRIBE_UPDATE, decoded});
+        check_trailing_bytes(payload, offset, options);
+
+        auto it = state.active_subscriptions.find(request_id);
+        if (it == state.active_subscriptions.end()) {
+            throw ProtocolViolation("update for unknown subscription request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
         }
+        Subscription& sub = it->second;
+        if (start < sub.start) {
+            throw ProtocolViolation("start location moved earlier than "
+                                    + std::to_string(sub.start.group) + ":" + std::to_string(sub.start.object),
+                                    "start", start_offset);
+        }
+        if (!sub.open_ended && (end_group_plus_one == 0 || end_group_plus_one - 1 > sub.end_group)) {
+            throw ProtocolViolation("end group extended past " + std::to_string(sub.end_group), "end_group",
+                                    end_group_offset);
+        }
+        sub.start = start;
+        sub.open_ended = end_group_plus_one == 0;
+        if (!sub.open_ended) sub.end_group = end_group_plus_one - 1;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_UPDATE", e, offset);
     } catch (const std::exception& e) {
-        return std::string("CLIENT_SETUP parse error: ") + e.what();
+        return parse_error_report("SUBSCRIBE_UPDATE", e, offset);
     }
     return report.str();
 }
 
-std::string parse_server_setup(const std::vector<uint8_t>& payload) {
+std::string parse_subscribe_ok(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                               const ValidationOptions& options) {
     size_t offset = 0;
     std::ostringstream report;
     try {
-        uint64_t version = read_varint(payload, offset);
-        report << "SERVER_SETUP: version=" << version << "; Params=";
-        while (offset < payload.size()) {
-            uint64_t param_type = read_varint(payload, offset);
-            std::string param_value = read_lp_string(payload, offset);
-            report << " [" << param_type << ":" << param_value << "]";
+        SubscribeOkMessage decoded;
+        size_t request_id_offset = offset;
+        decoded.request_id = read_varint(payload, offset, "request_id");
+        decoded.expires = read_varint(payload, offset, "expires");
+        size_t group_order_offset = offset;
+        decoded.group_order = read_u8(payload, offset, "group_order");
+        size_t content_exists_offset = offset;
+        decoded.content_exists = read_u8(payload, offset, "content_exists");
+        report << "SUBSCRIBE_OK: request_id=" << decoded.request_id
+               << ", expires=" << decoded.expires << "ms"
+               << ", group_order=" << static_cast<int>(decoded.group_order)
+               << ", content_exists=" << static_cast<int>(decoded.content_exists);
+        if (decoded.content_exists > 1) {
+            throw ProtocolViolation("invalid content_exists=" + std::to_string(decoded.content_exists),
+                                    "content_exists", content_exists_offset);
+        }
+        if (decoded.content_exists) {
+            decoded.largest = read_location(payload, offset, "largest");
+            report << ", largest=" << to_string(decoded.largest);
+        }
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        record_message({SUBSCRIBE_OK, decoded});
+        check_trailing_bytes(payload, offset, options);
+        // As for FETCH_OK, the publisher must pick ascending (1) or descending (2)
+        if (decoded.group_order == 0 || decoded.group_order > 2) {
+            throw ProtocolViolation("invalid group_order=" + std::to_string(decoded.group_order), "group_order",
+                                    group_order_offset);
+        }
+        if (!state.active_subscriptions.count(decoded.request_id)) {
+            throw ProtocolViolation("unknown subscription request_id=" + std::to_string(decoded.request_id),
+                                    "request_id", request_id_offset);
+        }
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_OK", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SUBSCRIBE_OK", e, offset);
+    }
+    return report.str();
+}
+
+std::string subscribe_error_code_name(uint64_t code) {
+    switch (code) {
+        case SUBSCRIBE_INTERNAL_ERROR: return "INTERNAL_ERROR";
+        case SUBSCRIBE_UNAUTHORIZED: return "UNAUTHORIZED";
+        case SUBSCRIBE_TIMEOUT: return "TIMEOUT";
+        case SUBSCRIBE_NOT_SUPPORTED: return "NOT_SUPPORTED";
+        case SUBSCRIBE_TRACK_DOES_NOT_EXIST: return "TRACK_DOES_NOT_EXIST";
+        case SUBSCRIBE_INVALID_RANGE: return "INVALID_RANGE";
+        case SUBSCRIBE_RETRY_TRACK_ALIAS: return "RETRY_TRACK_ALIAS";
+        case SUBSCRIBE_MALFORMED_AUTH_TOKEN: return "MALFORMED_AUTH_TOKEN";
+        case SUBSCRIBE_UNKNOWN_AUTH_TOKEN_ALIAS: return "UNKNOWN_AUTH_TOKEN_ALIAS";
+        case SUBSCRIBE_EXPIRED_AUTH_TOKEN: return "EXPIRED_AUTH_TOKEN";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_subscribe_error(const std::vector<uint8_t>& payload, SessionState& state,
+                                  const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        uint64_t error_code = read_varint(payload, offset, "error_code");
+        size_t reason_offset = offset;
+        std::string reason = read_lp_string(payload, offset, "reason");
+        uint64_t track_alias = read_varint(payload, offset, "track_alias");
+        record_message({SUBSCRIBE_ERROR, SubscribeErrorMessage{request_id, error_code, reason, track_alias}});
+        check_trailing_bytes(payload, offset, options);
+        if (!is_valid_utf8(reason)) {
+            throw ProtocolViolation("reason phrase is not valid UTF-8", "reason", reason_offset);
         }
+        auto it = state.active_subscriptions.find(request_id);
+        if (it == state.active_subscriptions.end()) {
+            throw ProtocolViolation("unknown subscription request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        // The rejected subscription never started, so its alias is free again
+        end_subscription(state, it);
+        report << "SUBSCRIBE_ERROR: request_id=" << request_id
+               << ", error_code=" << subscribe_error_code_name(error_code) << "(" << error_code << ")"
+               << ", reason=\"" << reason << "\""
+               << ", track_alias=" << track_alias;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_ERROR", e, offset);
     } catch (const std::exception& e) {
-        return std::string("SERVER_SETUP parse error: ") + e.what();
+        return parse_error_report("SUBSCRIBE_ERROR", e, offset);
     }
     return report.str();
 }
 
+std::string subscribe_done_code_name(uint64_t code) {
+    switch (code) {
+        case SUBSCRIBE_DONE_INTERNAL_ERROR: return "INTERNAL_ERROR";
+        case SUBSCRIBE_DONE_UNAUTHORIZED: return "UNAUTHORIZED";
+        case SUBSCRIBE_DONE_TRACK_ENDED: return "TRACK_ENDED";
+        case SUBSCRIBE_DONE_SUBSCRIPTION_ENDED: return "SUBSCRIPTION_ENDED";
+        case SUBSCRIBE_DONE_GOING_AWAY: return "GOING_AWAY";
+        case SUBSCRIBE_DONE_EXPIRED: return "EXPIRED";
+        case SUBSCRIBE_DONE_TOO_FAR_BEHIND: return "TOO_FAR_BEHIND";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_subscribe_done(const std::vector<uint8_t>& payload, SessionState& state,
+                                 const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        uint64_t status_code = read_varint(payload, offset, "status_code");
+        uint64_t stream_count = read_varint(payload, offset, "stream_count");
+        std::string reason = read_lp_string(payload, offset, "reason");
+        record_message({SUBSCRIBE_DONE, SubscribeDoneMessage{request_id, status_code, stream_count, reason}});
+        check_trailing_bytes(payload, offset, options);
+        auto it = state.active_subscriptions.find(request_id);
+        if (it == state.active_subscriptions.end()) {
+            throw ProtocolViolation("unknown subscription request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        uint64_t track_alias = end_subscription(state, it);
+        report << "SUBSCRIBE_DONE: request_id=" << request_id
+               << ", status_code=" << subscribe_done_code_name(status_code) << "(" << status_code << ")"
+               << ", stream_count=" << stream_count
+               << ", reason=\"" << reason << "\""
+               << ", track_alias=" << track_alias;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_DONE", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SUBSCRIBE_DONE", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_unsubscribe(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                              const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        record_message({UNSUBSCRIBE, RequestIdMessage{request_id}});
+        check_trailing_bytes(payload, offset, options);
+        validate_request_id(request_id, request_id_offset, direction);
+        auto it = state.active_subscriptions.find(request_id);
+        if (it == state.active_subscriptions.end()) {
+            throw ProtocolViolation("unsubscribe for unknown request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        uint64_t track_alias = end_subscription(state, it);
+        report << "UNSUBSCRIBE: request_id=" << request_id << ", track_alias=" << track_alias;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("UNSUBSCRIBE", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("UNSUBSCRIBE", e, offset);
+    }
+    return report.str();
+}
+
+std::string fetch_type_name(uint64_t type) {
+    switch (type) {
+        case FETCH_STANDALONE: return "STANDALONE";
+        case FETCH_RELATIVE_JOINING: return "RELATIVE_JOINING";
+        case FETCH_ABSOLUTE_JOINING: return "ABSOLUTE_JOINING";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_fetch(const std::vector<uint8_t>& payload, SessionState& state, const ValidationOptions& options,
+                        Direction direction) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        Fetch fetch{};
+        FetchMessage decoded;
+        size_t request_id_offset = offset;
+        fetch.request_id = read_varint(payload, offset, "request_id");
+        uint8_t priority = read_u8(payload, offset, "priority");
+        uint8_t group_order = read_u8(payload, offset, "group_order");
+        size_t fetch_type_offset = offset;
+        fetch.fetch_type = read_varint(payload, offset, "fetch_type");
+        size_t joining_request_id_offset = offset;
+        report << "FETCH: request_id=" << fetch.request_id
+               << ", priority=" << static_cast<int>(priority)
+               << ", group_order=" << static_cast<int>(group_order)
+               << ", fetch_type=" << fetch_type_name(fetch.fetch_type) << "(" << fetch.fetch_type << ")";
+        if (fetch.fetch_type == FETCH_STANDALONE) {
+            fetch.track_namespace = read_tuple(payload, offset, 1, "track_namespace");
+            fetch.track_name = read_lp_string(payload, offset, "track_name");
+            size_t start_offset = offset;
+            fetch.start = read_location(payload, offset, "start");
+            size_t end_offset = offset;
+            fetch.end = read_location(payload, offset, "end");
+            report << ", namespace=" << join_tuple(fetch.track_namespace)
+                   << ", name=" << fetch.track_name
+                   << ", start=" << to_string(fetch.start)
+                   << ", end=" << to_string(fetch.end);
+            // End Object is the last object plus one, with 0 asking for
+            // the whole end group
+            if (fetch.end.object == 0) report << " (whole group)";
+            if (fetch_range(fetch).empty()) {
+                if (fetch.end.object != 0) {
+                    throw ProtocolViolation("end=" + to_string(fetch.end) + " requests no objects from start="
+                                            + to_string(fetch.start), "end", end_offset);
+                }
+                throw ProtocolViolation("end group " + std::to_string(fetch.end.group) + " is before start="
+                                        + to_string(fetch.start), "end", end_offset);
+            }
+            if (options.require_group_aligned_fetch && checks_group_aligned_fetch(state.current_version)
+                && fetch.start.object != 0) {
+                throw ProtocolViolation("start=" + to_string(fetch.start) + " is not group aligned", "start",
+                                        start_offset);
+            }
+        } else if (fetch.fetch_type == FETCH_RELATIVE_JOINING || fetch.fetch_type == FETCH_ABSOLUTE_JOINING) {
+            joining_request_id_offset = offset;
+            fetch.joining_request_id = read_varint(payload, offset, "joining_request_id");
+            fetch.joining_start = read_varint(payload, offset, "joining_start");
+            report << ", joining_request_id=" << fetch.joining_request_id
+                   << ", joining_start=" << fetch.joining_start
+                   << (fetch.fetch_type == FETCH_RELATIVE_JOINING ? " (groups back)" : " (group)");
+        } else {
+            throw ProtocolViolation("invalid fetch_type=" + std::to_string(fetch.fetch_type), "fetch_type",
+                                    fetch_type_offset);
+        }
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        decoded.request_id = fetch.request_id;
+        decoded.subscriber_priority = priority;
+        decoded.group_order = group_order;
+        decoded.fetch_type = fetch.fetch_type;
+        decoded.track_namespace = fetch.track_namespace;
+        decoded.track_name = fetch.track_name;
+        decoded.start = fetch.start;
+        decoded.end = fetch.end;
+        decoded.joining_request_id = fetch.joining_request_id;
+        decoded.joining_start = fetch.joining_start;
+        record_message({FETCH, decoded});
+        check_trailing_bytes(payload, offset, options);
+        if (fetch.fetch_type != FETCH_STANDALONE && !state.active_subscriptions.count(fetch.joining_request_id)) {
+            throw ProtocolViolation("joining_request_id=" + std::to_string(fetch.joining_request_id)
+                                    + " is not an active subscription", "joining_request_id",
+                                    joining_request_id_offset);
+        }
+        validate_request_id(fetch.request_id, request_id_offset, direction);
+        check_request_limit(state, fetch.request_id, request_id_offset, direction, warnings);
+        state.active_fetches[fetch.request_id] = fetch;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("FETCH", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("FETCH", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string parse_fetch_ok(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                           const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        size_t group_order_offset = offset;
+        uint8_t group_order = read_u8(payload, offset, "group_order");
+        uint8_t end_of_track = read_u8(payload, offset, "end_of_track");
+        Location end_location = read_location(payload, offset, "end_location");
+        report << "FETCH_OK: request_id=" << request_id
+               << ", group_order=" << static_cast<int>(group_order)
+               << ", end_of_track=" << static_cast<int>(end_of_track)
+               << ", end=" << to_string(end_location);
+        FetchOkMessage decoded{request_id, group_order, end_of_track, end_location, {}};
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        record_message({FETCH_OK, decoded});
+        check_trailing_bytes(payload, offset, options);
+        // Unlike SUBSCRIBE, the publisher must pick ascending (1) or descending (2)
+        if (group_order == 0 || group_order > 2) {
+            throw ProtocolViolation("invalid group_order=" + std::to_string(group_order), "group_order",
+                                    group_order_offset);
+        }
+        if (end_of_track > 1) {
+            throw ProtocolViolation("invalid end_of_track=" + std::to_string(end_of_track), "end_of_track",
+                                    group_order_offset + 1);
+        }
+        auto it = state.active_fetches.find(request_id);
+        if (it == state.active_fetches.end()) {
+            throw ProtocolViolation("no pending fetch for request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        it->second.accepted = true;
+        it->second.end_location = end_location;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("FETCH_OK", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("FETCH_OK", e, offset);
+    }
+    return report.str();
+}
+
+std::string fetch_error_code_name(uint64_t code) {
+    switch (code) {
+        case FETCH_INTERNAL_ERROR: return "INTERNAL_ERROR";
+        case FETCH_UNAUTHORIZED: return "UNAUTHORIZED";
+        case FETCH_TIMEOUT: return "TIMEOUT";
+        case FETCH_NOT_SUPPORTED: return "NOT_SUPPORTED";
+        case FETCH_TRACK_DOES_NOT_EXIST: return "TRACK_DOES_NOT_EXIST";
+        case FETCH_INVALID_RANGE: return "INVALID_RANGE";
+        case FETCH_NO_OBJECTS: return "NO_OBJECTS";
+        case FETCH_MALFORMED_AUTH_TOKEN: return "MALFORMED_AUTH_TOKEN";
+        case FETCH_UNKNOWN_AUTH_TOKEN_ALIAS: return "UNKNOWN_AUTH_TOKEN_ALIAS";
+        case FETCH_EXPIRED_AUTH_TOKEN: return "EXPIRED_AUTH_TOKEN";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_fetch_error(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                              const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        uint64_t error_code = read_varint(payload, offset, "error_code");
+        size_t reason_offset = offset;
+        std::string reason = read_lp_string(payload, offset, "reason");
+        record_message({FETCH_ERROR, RequestErrorMessage{request_id, error_code, reason}});
+        check_trailing_bytes(payload, offset, options);
+        // The fetch being answered was sent the other way
+        validate_request_id(request_id, request_id_offset, reverse(direction));
+        if (!is_valid_utf8(reason)) {
+            throw ProtocolViolation("reason phrase is not valid UTF-8", "reason", reason_offset);
+        }
+        auto it = state.active_fetches.find(request_id);
+        if (it == state.active_fetches.end()) {
+            throw ProtocolViolation("no pending fetch for request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        state.active_fetches.erase(it);
+        report << "FETCH_ERROR: request_id=" << request_id
+               << ", error_code=" << fetch_error_code_name(error_code) << "(" << error_code << ")"
+               << ", reason=\"" << reason << "\"";
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("FETCH_ERROR", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("FETCH_ERROR", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_fetch_cancel(const std::vector<uint8_t>& payload, SessionState& state,
+                               const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        record_message({FETCH_CANCEL, RequestIdMessage{request_id}});
+        check_trailing_bytes(payload, offset, options);
+        auto it = state.active_fetches.find(request_id);
+        if (it == state.active_fetches.end()) {
+            throw ProtocolViolation("cancel for unknown fetch request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        state.active_fetches.erase(it);
+        report << "FETCH_CANCEL: request_id=" << request_id;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("FETCH_CANCEL", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("FETCH_CANCEL", e, offset);
+    }
+    return report.str();
+}
+
+std::string announce_error_code_name(uint64_t code) {
+    switch (code) {
+        case ANNOUNCE_INTERNAL_ERROR: return "INTERNAL_ERROR";
+        case ANNOUNCE_UNAUTHORIZED: return "UNAUTHORIZED";
+        case ANNOUNCE_TIMEOUT: return "TIMEOUT";
+        case ANNOUNCE_NOT_SUPPORTED: return "NOT_SUPPORTED";
+        case ANNOUNCE_UNINTERESTED: return "UNINTERESTED";
+        case ANNOUNCE_MALFORMED_AUTH_TOKEN: return "MALFORMED_AUTH_TOKEN";
+        case ANNOUNCE_UNKNOWN_AUTH_TOKEN_ALIAS: return "UNKNOWN_AUTH_TOKEN_ALIAS";
+        case ANNOUNCE_EXPIRED_AUTH_TOKEN: return "EXPIRED_AUTH_TOKEN";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_announce(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                           const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        std::vector<std::string> track_namespace = read_tuple(payload, offset, 1, "track_namespace");
+        report << "ANNOUNCE: request_id=" << request_id
+               << ", namespace=" << join_tuple(track_namespace);
+        AnnounceMessage decoded{request_id, track_namespace, {}};
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        record_message({ANNOUNCE, decoded});
+        check_trailing_bytes(payload, offset, options);
+        validate_request_id(request_id, request_id_offset, direction);
+        check_request_limit(state, request_id, request_id_offset, direction, warnings);
+        state.pending_announces[request_id] = track_namespace;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("ANNOUNCE", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("ANNOUNCE", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string parse_announce_ok(const std::vector<uint8_t>& payload, SessionState& state,
+                              const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        record_message({ANNOUNCE_OK, RequestIdMessage{request_id}});
+        check_trailing_bytes(payload, offset, options);
+        auto it = state.pending_announces.find(request_id);
+        if (it == state.pending_announces.end()) {
+            throw ProtocolViolation("no pending announce for request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        report << "ANNOUNCE_OK: request_id=" << request_id
+               << ", namespace=" << join_tuple(it->second);
+        state.announced_namespaces.insert(it->second);
+        state.pending_announces.erase(it);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("ANNOUNCE_OK", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("ANNOUNCE_OK", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_announce_error(const std::vector<uint8_t>& payload, SessionState& state,
+                                 const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        uint64_t error_code = read_varint(payload, offset, "error_code");
+        std::string reason = read_lp_string(payload, offset, "reason");
+        record_message({ANNOUNCE_ERROR, RequestErrorMessage{request_id, error_code, reason}});
+        check_trailing_bytes(payload, offset, options);
+        auto it = state.pending_announces.find(request_id);
+        if (it == state.pending_announces.end()) {
+            throw ProtocolViolation("no pending announce for request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        report << "ANNOUNCE_ERROR: request_id=" << request_id
+               << ", namespace=" << join_tuple(it->second)
+               << ", error_code=" << announce_error_code_name(error_code) << "(" << error_code << ")"
+               << ", reason=\"" << reason << "\"";
+        state.pending_announces.erase(it);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("ANNOUNCE_ERROR", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("ANNOUNCE_ERROR", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_unannounce(const std::vector<uint8_t>& payload, SessionState& state,
+                             const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t track_namespace_offset = offset;
+        std::vector<std::string> track_namespace = read_tuple(payload, offset, 1, "track_namespace");
+        record_message({UNANNOUNCE, NamespaceMessage{track_namespace}});
+        check_trailing_bytes(payload, offset, options);
+        bool announced = state.announced_namespaces.erase(track_namespace) > 0;
+        for (auto it = state.pending_announces.begin(); it != state.pending_announces.end();) {
+            if (it->second == track_namespace) {
+                it = state.pending_announces.erase(it);
+                announced = true;
+            } else {
+                ++it;
+            }
+        }
+        if (!announced) {
+            throw ProtocolViolation("unannounce of unknown namespace " + join_tuple(track_namespace),
+                                    "track_namespace", track_namespace_offset);
+        }
+        report << "UNANNOUNCE: namespace=" << join_tuple(track_namespace);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("UNANNOUNCE", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("UNANNOUNCE", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_announce_cancel(const std::vector<uint8_t>& payload, SessionState& state,
+                                  const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        std::vector<std::string> track_namespace = read_tuple(payload, offset, 1, "track_namespace");
+        uint64_t error_code = read_varint(payload, offset, "error_code");
+        std::string reason = read_lp_string(payload, offset, "reason");
+        record_message({ANNOUNCE_CANCEL, AnnounceCancelMessage{track_namespace, error_code, reason}});
+        check_trailing_bytes(payload, offset, options);
+        report << "ANNOUNCE_CANCEL: namespace=" << join_tuple(track_namespace)
+               << ", error_code=" << announce_error_code_name(error_code) << "(" << error_code << ")"
+               << ", reason=\"" << reason << "\"";
+        state.announced_namespaces.erase(track_namespace);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("ANNOUNCE_CANCEL", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("ANNOUNCE_CANCEL", e, offset);
+    }
+    return report.str();
+}
+
+std::string track_status_code_name(uint64_t code) {
+    switch (code) {
+        case TRACK_STATUS_IN_PROGRESS: return "IN_PROGRESS";
+        case TRACK_STATUS_DOES_NOT_EXIST: return "DOES_NOT_EXIST";
+        case TRACK_STATUS_NOT_YET_BEGUN: return "NOT_YET_BEGUN";
+        case TRACK_STATUS_FINISHED: return "FINISHED";
+        case TRACK_STATUS_RELAY_UNAVAILABLE: return "RELAY_UNAVAILABLE";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_track_status_request(const std::vector<uint8_t>& payload, SessionState& state,
+                                       Direction direction, const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        std::vector<std::string> track_namespace = read_tuple(payload, offset, 1, "track_namespace");
+        std::string track_name = read_lp_string(payload, offset, "track_name");
+        report << "TRACK_STATUS_REQUEST: request_id=" << request_id
+               << ", namespace=" << join_tuple(track_namespace)
+               << ", name=" << track_name;
+        TrackStatusRequestMessage decoded{request_id, track_namespace, track_name, {}};
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        record_message({TRACK_STATUS_REQUEST, decoded});
+        check_trailing_bytes(payload, offset, options);
+        validate_request_id(request_id, request_id_offset, direction);
+        check_request_limit(state, request_id, request_id_offset, direction, warnings);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("TRACK_STATUS_REQUEST", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("TRACK_STATUS_REQUEST", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string parse_track_status(const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction, const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        uint64_t status_code = read_varint(payload, offset, "status_code");
+        size_t largest_offset = offset;
+        Location largest = read_location(payload, offset, "largest");
+        report << "TRACK_STATUS: request_id=" << request_id
+               << ", status_code=" << track_status_code_name(status_code) << "(" << status_code << ")"
+               << ", largest=" << to_string(largest);
+        TrackStatusMessage decoded{request_id, status_code, largest, {}};
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        record_message({TRACK_STATUS, decoded});
+        check_trailing_bytes(payload, offset, options);
+        // A track with no published objects has no largest location to
+        // report; the fields are still on the wire but must be zero
+        bool has_objects = status_code != TRACK_STATUS_DOES_NOT_EXIST && status_code != TRACK_STATUS_NOT_YET_BEGUN;
+        if (!has_objects && (largest.group != 0 || largest.object != 0)) {
+            throw ProtocolViolation("largest location " + to_string(largest) + " must be 0:0 for "
+                                    + track_status_code_name(status_code), "largest", largest_offset);
+        }
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("TRACK_STATUS", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("TRACK_STATUS", e, offset);
+    }
+    return report.str();
+}
+
+std::string subscribe_announces_error_code_name(uint64_t code) {
+    switch (code) {
+        case SUBSCRIBE_ANNOUNCES_INTERNAL_ERROR: return "INTERNAL_ERROR";
+        case SUBSCRIBE_ANNOUNCES_UNAUTHORIZED: return "UNAUTHORIZED";
+        case SUBSCRIBE_ANNOUNCES_TIMEOUT: return "TIMEOUT";
+        case SUBSCRIBE_ANNOUNCES_NOT_SUPPORTED: return "NOT_SUPPORTED";
+        case SUBSCRIBE_ANNOUNCES_NAMESPACE_PREFIX_UNKNOWN: return "NAMESPACE_PREFIX_UNKNOWN";
+        case SUBSCRIBE_ANNOUNCES_NAMESPACE_PREFIX_OVERLAP: return "NAMESPACE_PREFIX_OVERLAP";
+        case SUBSCRIBE_ANNOUNCES_MALFORMED_AUTH_TOKEN: return "MALFORMED_AUTH_TOKEN";
+        case SUBSCRIBE_ANNOUNCES_UNKNOWN_AUTH_TOKEN_ALIAS: return "UNKNOWN_AUTH_TOKEN_ALIAS";
+        case SUBSCRIBE_ANNOUNCES_EXPIRED_AUTH_TOKEN: return "EXPIRED_AUTH_TOKEN";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parse_subscribe_announces(const std::vector<uint8_t>& payload, SessionState& state,
+                                      Direction direction, const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        std::vector<std::string> prefix = read_tuple(payload, offset, 0, "track_namespace_prefix");
+        report << "SUBSCRIBE_ANNOUNCES: request_id=" << request_id
+               << ", namespace_prefix=" << join_tuple(prefix);
+        AnnounceMessage decoded{request_id, prefix, {}};
+        read_parameters(payload, offset, report, state, direction, decoded.params);
+        record_message({SUBSCRIBE_ANNOUNCES, decoded});
+        check_trailing_bytes(payload, offset, options);
+        validate_request_id(request_id, request_id_offset, direction);
+        check_request_limit(state, request_id, request_id_offset, direction, warnings);
+        state.pending_namespace_prefixes[request_id] = prefix;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_ANNOUNCES", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SUBSCRIBE_ANNOUNCES", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string parse_subscribe_announces_ok(const std::vector<uint8_t>& payload, SessionState& state,
+                                         const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        record_message({SUBSCRIBE_ANNOUNCES_OK, RequestIdMessage{request_id}});
+        check_trailing_bytes(payload, offset, options);
+        auto it = state.pending_namespace_prefixes.find(request_id);
+        if (it == state.pending_namespace_prefixes.end()) {
+            throw ProtocolViolation("no pending SUBSCRIBE_ANNOUNCES for request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        report << "SUBSCRIBE_ANNOUNCES_OK: request_id=" << request_id
+               << ", namespace_prefix=" << join_tuple(it->second);
+        state.subscribed_namespace_prefixes.insert(it->second);
+        state.pending_namespace_prefixes.erase(it);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_ANNOUNCES_OK", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SUBSCRIBE_ANNOUNCES_OK", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_unsubscribe_announces(const std::vector<uint8_t>& payload, SessionState& state,
+                                        const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t prefix_offset = offset;
+        std::vector<std::string> prefix = read_tuple(payload, offset, 0, "track_namespace_prefix");
+        record_message({UNSUBSCRIBE_ANNOUNCES, NamespaceMessage{prefix}});
+        check_trailing_bytes(payload, offset, options);
+        bool subscribed = state.subscribed_namespace_prefixes.erase(prefix) > 0;
+        for (auto it = state.pending_namespace_prefixes.begin(); it != state.pending_namespace_prefixes.end();) {
+            if (it->second == prefix) {
+                it = state.pending_namespace_prefixes.erase(it);
+                subscribed = true;
+            } else {
+                ++it;
+            }
+        }
+        if (!subscribed) {
+            throw ProtocolViolation("unsubscribe of unknown namespace prefix " + join_tuple(prefix),
+                                    "track_namespace_prefix", prefix_offset);
+        }
+        report << "UNSUBSCRIBE_ANNOUNCES: namespace_prefix=" << join_tuple(prefix);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("UNSUBSCRIBE_ANNOUNCES", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("UNSUBSCRIBE_ANNOUNCES", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_subscribe_announces_error(const std::vector<uint8_t>& payload, SessionState& state,
+                                            const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t request_id_offset = offset;
+        uint64_t request_id = read_varint(payload, offset, "request_id");
+        size_t error_code_offset = offset;
+        uint64_t error_code = read_varint(payload, offset, "error_code");
+        std::string reason = read_lp_string(payload, offset, "reason");
+        record_message({SUBSCRIBE_ANNOUNCES_ERROR, RequestErrorMessage{request_id, error_code, reason}});
+        check_trailing_bytes(payload, offset, options);
+        std::string code_name = subscribe_announces_error_code_name(error_code);
+        if (code_name == "UNKNOWN") {
+            throw ProtocolViolation("undefined error_code=" + std::to_string(error_code), "error_code",
+                                    error_code_offset);
+        }
+        auto it = state.pending_namespace_prefixes.find(request_id);
+        if (it == state.pending_namespace_prefixes.end()) {
+            throw ProtocolViolation("no pending SUBSCRIBE_ANNOUNCES for request_id=" + std::to_string(request_id),
+                                    "request_id", request_id_offset);
+        }
+        report << "SUBSCRIBE_ANNOUNCES_ERROR: request_id=" << request_id
+               << ", namespace_prefix=" << join_tuple(it->second)
+               << ", error_code=" << code_name << "(" << error_code << ")"
+               << ", reason=\"" << reason << "\"";
+        state.pending_namespace_prefixes.erase(it);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBSCRIBE_ANNOUNCES_ERROR", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SUBSCRIBE_ANNOUNCES_ERROR", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_max_request_id(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                                 const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t max_request_id_offset = offset;
+        uint64_t max_request_id = read_varint(payload, offset, "max_request_id");
+        record_message({MAX_REQUEST_ID, RequestIdMessage{max_request_id}});
+        check_trailing_bytes(payload, offset, options);
+        // Without a previous maximum the peer starts from zero request IDs
+        auto previous = state.max_request_ids.find(direction);
+        uint64_t granted = previous == state.max_request_ids.end() ? 0 : previous->second;
+        if (previous == state.max_request_ids.end() && max_request_id == 0) {
+            throw ProtocolViolation("max_request_id=0 grants no request IDs", "max_request_id",
+                                    max_request_id_offset);
+        }
+        // The maximum may only increase; repeating it is as wrong as lowering it
+        if (previous != state.max_request_ids.end() && max_request_id <= granted) {
+            throw ProtocolViolation("max_request_id=" + std::to_string(max_request_id)
+                                    + (max_request_id == granted ? " repeats" : " lowers")
+                                    + " the previous maximum " + std::to_string(granted),
+                                    "max_request_id", max_request_id_offset);
+        }
+        report << "MAX_REQUEST_ID: max_request_id=" << max_request_id << ", delta=+" << max_request_id - granted;
+        if (direction != DIRECTION_UNKNOWN) report << ", direction=" << direction_name(direction);
+        state.max_request_ids[direction] = max_request_id;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("MAX_REQUEST_ID", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("MAX_REQUEST_ID", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_requests_blocked(const std::vector<uint8_t>& payload, const SessionState& state,
+                                   Direction direction, const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t max_request_id_offset = offset;
+        uint64_t blocked = read_varint(payload, offset, "max_request_id");
+        record_message({REQUESTS_BLOCKED, RequestIdMessage{blocked}});
+        check_trailing_bytes(payload, offset, options);
+        // A peer can only be blocked at the limit it was actually given
+        auto granted = state.max_request_ids.find(reverse(direction));
+        if (granted == state.max_request_ids.end()) {
+            throw ProtocolViolation("blocked at max_request_id=" + std::to_string(blocked)
+                                    + " but no maximum granted", "max_request_id", max_request_id_offset);
+        }
+        if (blocked != granted->second) {
+            throw ProtocolViolation("blocked at max_request_id=" + std::to_string(blocked)
+                                    + " but tracked max_request_id=" + std::to_string(granted->second),
+                                    "max_request_id", max_request_id_offset);
+        }
+        report << "REQUESTS_BLOCKED: max_request_id=" << blocked << ", tracked_max_request_id=" << granted->second;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("REQUESTS_BLOCKED", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("REQUESTS_BLOCKED", e, offset);
+    }
+    return report.str();
+}
+
+// Reads the parameters of a legacy SETUP, in which every parameter is a
+// type, a length and that many value bytes, whatever its type. ROLE and
+// MAX_SUBSCRIBE_ID, which became MAX_REQUEST_ID, hold a varint that must
+// fill the value. Appends them to report like read_setup_parameters.
+SetupParameters read_legacy_setup_parameters(const std::vector<uint8_t>& payload, size_t& offset,
+                                             std::ostringstream& out) {
+    SetupParameters params;
+    std::ostringstream report;
+    uint64_t count = read_varint(payload, offset, "Params");
+    report << "; Params=";
+    std::set<uint64_t> seen;
+    for (uint64_t i = 0; i < count; ++i) {
+        size_t start = offset;
+        std::string field = parameter_field(i);
+        uint64_t type = read_varint(payload, offset, field);
+        std::string value = read_lp_string(payload, offset, field);
+        if (!seen.insert(type).second) {
+            throw ProtocolViolation("duplicate setup parameter " + std::to_string(type), field, start,
+                                    TERMINATION_KEY_VALUE_FORMATTING_ERROR);
+        }
+        report << " [" << type << ":";
+        if (type == LEGACY_SETUP_PARAM_ROLE || type == SETUP_PARAM_MAX_REQUEST_ID) {
+            std::vector<uint8_t> bytes(value.begin(), value.end());
+            size_t position = 0;
+            uint64_t number = read_varint(bytes, position, field);
+            if (position != bytes.size()) {
+                throw ProtocolViolation("setup parameter " + std::to_string(type) + " has "
+                                        + std::to_string(bytes.size() - position) + " bytes after its varint",
+                                        field, start);
+            }
+            if (type == LEGACY_SETUP_PARAM_ROLE) {
+                if (number < 1 || number > 3) {
+                    throw ProtocolViolation("invalid role=" + std::to_string(number), field, start);
+                }
+                report << "role=" << number;
+            } else {
+                params.has_max_request_id = true;
+                params.max_request_id = number;
+                report << number;
+            }
+        } else {
+            if (type == SETUP_PARAM_PATH) params.has_path = true;
+            report << value;
+        }
+        report << "]";
+    }
+    if (params.has_max_request_id) out << ", max_request_id=" << params.max_request_id;
+    out << report.str();
+    return params;
+}
+
+// Reads the fields of CLIENT_SETUP after its type, checks them against
+// the sender and transport and records them in the session
+void read_client_setup(const std::vector<uint8_t>& payload, size_t& offset, SessionState& state,
+                       Direction direction, const ValidationOptions& options, bool legacy,
+                       std::ostringstream& report) {
+    uint64_t version_count = read_varint(payload, offset, "version_count");
+    report << "CLIENT_SETUP: versions=" << version_count;
+    std::vector<uint64_t> versions;
+    for (uint64_t i = 0; i < version_count; ++i) {
+        uint64_t version = read_varint(payload, offset, "version");
+        versions.push_back(version);
+        report << " v" << version;
+    }
+    ClientSetupMessage decoded{versions, {}};
+    SetupParameters params = legacy ? read_legacy_setup_parameters(payload, offset, report)
+                                    : read_setup_parameters(payload, offset, report, decoded.params);
+    if (!legacy) record_message({CLIENT_SETUP, decoded});
+    check_trailing_bytes(payload, offset, options);
+    if (direction == SERVER_TO_CLIENT) throw ProtocolViolation("CLIENT_SETUP sent by the server");
+    if (params.has_path && options.transport == Transport::WEBTRANSPORT) {
+        throw ProtocolViolation("PATH setup parameter is not allowed over WebTransport");
+    }
+    if (!params.has_path && options.transport == Transport::QUIC) {
+        throw ProtocolViolation("PATH setup parameter is required over raw QUIC");
+    }
+    state.client_setup_seen = true;
+    state.offered_versions = versions;
+    state.max_request_ids[direction] = params.max_request_id;
+    state.auth_tokens(SERVER_TO_CLIENT).max_size = params.max_auth_token_cache_size;
+}
+
+// Reads the fields of SERVER_SETUP after its type, checks the selected
+// version against CLIENT_SETUP and records it in the session
+void read_server_setup(const std::vector<uint8_t>& payload, size_t& offset, SessionState& state,
+                       Direction direction, const ValidationOptions& options, bool legacy,
+                       std::ostringstream& report) {
+    size_t version_offset = offset;
+    uint64_t version = read_varint(payload, offset, "version");
+    report << "SERVER_SETUP: version=" << version;
+    ServerSetupMessage decoded{version, {}};
+    SetupParameters params = legacy ? read_legacy_setup_parameters(payload, offset, report)
+                                    : read_setup_parameters(payload, offset, report, decoded.params);
+    if (!legacy) record_message({SERVER_SETUP, decoded});
+    check_trailing_bytes(payload, offset, options);
+    if (direction == CLIENT_TO_SERVER) throw ProtocolViolation("SERVER_SETUP sent by the client");
+    if (params.has_path) throw ProtocolViolation("PATH setup parameter is only sent by the client");
+    if (!state.client_setup_seen) {
+        throw ProtocolViolation("selected version " + std::to_string(version) + " without a preceding CLIENT_SETUP",
+                                "version", version_offset, TERMINATION_VERSION_NEGOTIATION_FAILED);
+    }
+    const auto& offered = state.offered_versions;
+    if (std::find(offered.begin(), offered.end(), version) == offered.end()) {
+        throw ProtocolViolation("selected version " + std::to_string(version) + " was not offered by CLIENT_SETUP",
+                                "version", version_offset, TERMINATION_VERSION_NEGOTIATION_FAILED);
+    }
+    state.server_setup_seen = true;
+    state.current_version = version;
+    state.max_request_ids[direction] = params.max_request_id;
+    state.auth_tokens(CLIENT_TO_SERVER).max_size = params.max_auth_token_cache_size;
+}
+
+std::string parse_client_setup(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                               const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        read_client_setup(payload, offset, state, direction, options, false, report);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("CLIENT_SETUP", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("CLIENT_SETUP", e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_server_setup(const std::vector<uint8_t>& payload, SessionState& state, Direction direction,
+                               const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        read_server_setup(payload, offset, state, direction, options, false, report);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SERVER_SETUP", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SERVER_SETUP", e, offset);
+    }
+    return report.str();
+}
+
+bool has_varint_length(uint64_t type, bool after_legacy_setup, const ValidationOptions& options) {
+    if (!options.accept_legacy_setup) return false;
+    return after_legacy_setup || type == LEGACY_CLIENT_SETUP || type == LEGACY_SERVER_SETUP;
+}
+
+uint64_t read_control_length(const std::vector<uint8_t>& stream, size_t& offset, bool varint_length,
+                             const ValidationOptions& options) {
+    uint64_t length = varint_length ? read_varint_canonical(stream, offset) : read_u16(stream, offset);
+    if (options.max_message_bytes != 0 && length > options.max_message_bytes) {
+        throw ProtocolViolation("declared length " + std::to_string(length) + " exceeds max_message_bytes="
+                                + std::to_string(options.max_message_bytes));
+    }
+    return length;
+}
+
+std::string parse_legacy_setup(uint64_t type, const std::vector<uint8_t>& payload, SessionState& state,
+                               Direction direction, const ValidationOptions& options) {
+    // A SETUP of 0x01 is the client's until the client's has been seen
+    bool client = type == LEGACY_CLIENT_SETUP || (type == LEGACY_SETUP && !state.client_setup_seen);
+    std::string name = client ? "CLIENT_SETUP" : "SERVER_SETUP";
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        if (client ? state.client_setup_seen : state.server_setup_seen) {
+            throw ProtocolViolation(name + " was already sent in this session");
+        }
+        if (client) {
+            read_client_setup(payload, offset, state, direction, options, true, report);
+        } else {
+            read_server_setup(payload, offset, state, direction, options, true, report);
+        }
+        std::ostringstream type_hex;
+        type_hex << std::hex << std::setw(2) << std::setfill('0') << type;
+        report << "; Legacy= [type 0x" << type_hex.str() << " from a draft before 11]";
+        if (type != LEGACY_SETUP) state.legacy_framing = true;
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report(name, e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report(name, e, offset);
+    }
+    return report.str();
+}
+
+std::string parse_goaway(const std::vector<uint8_t>& payload, Direction direction, const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    try {
+        size_t uri_offset = offset;
+        std::string uri = read_lp_string(payload, offset, "uri");
+        record_message({GOAWAY, GoawayMessage{uri}});
+        check_trailing_bytes(payload, offset, options);
+        report << "GOAWAY: new_session_uri=\"" << uri << "\"";
+        if (direction == CLIENT_TO_SERVER) throw ProtocolViolation("GOAWAY sent by the client");
+        if (!is_valid_utf8(uri)) throw ProtocolViolation("new session URI is not valid UTF-8", "uri", uri_offset);
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("GOAWAY", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("GOAWAY", e, offset);
+    }
+    return report.str();
+}
+
+std::string control_message_name(uint64_t type) {
+    switch (type) {
+        case SUBSCRIBE_UPDATE: return "SUBSCRIBE_UPDATE";
+        case SUBSCRIBE: return "SUBSCRIBE";
+        case SUBSCRIBE_OK: return "SUBSCRIBE_OK";
+        case SUBSCRIBE_ERROR: return "SUBSCRIBE_ERROR";
+        case ANNOUNCE: return "ANNOUNCE";
+        case ANNOUNCE_OK: return "ANNOUNCE_OK";
+        case ANNOUNCE_ERROR: return "ANNOUNCE_ERROR";
+        case UNANNOUNCE: return "UNANNOUNCE";
+        case UNSUBSCRIBE: return "UNSUBSCRIBE";
+        case SUBSCRIBE_DONE: return "SUBSCRIBE_DONE";
+        case ANNOUNCE_CANCEL: return "ANNOUNCE_CANCEL";
+        case TRACK_STATUS_REQUEST: return "TRACK_STATUS_REQUEST";
+        case TRACK_STATUS: return "TRACK_STATUS";
+        case GOAWAY: return "GOAWAY";
+        case SUBSCRIBE_ANNOUNCES: return "SUBSCRIBE_ANNOUNCES";
+        case SUBSCRIBE_ANNOUNCES_OK: return "SUBSCRIBE_ANNOUNCES_OK";
+        case SUBSCRIBE_ANNOUNCES_ERROR: return "SUBSCRIBE_ANNOUNCES_ERROR";
+        case UNSUBSCRIBE_ANNOUNCES: return "UNSUBSCRIBE_ANNOUNCES";
+        case MAX_REQUEST_ID: return "MAX_REQUEST_ID";
+        case FETCH: return "FETCH";
+        case FETCH_CANCEL: return "FETCH_CANCEL";
+        case FETCH_OK: return "FETCH_OK";
+        case FETCH_ERROR: return "FETCH_ERROR";
+        case REQUESTS_BLOCKED: return "REQUESTS_BLOCKED";
+        case CLIENT_SETUP: return "CLIENT_SETUP";
+        case SERVER_SETUP: return "SERVER_SETUP";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string setup_parameter_name(uint64_t type) {
+    switch (type) {
+        case SETUP_PARAM_PATH: return "PATH";
+        case SETUP_PARAM_MAX_REQUEST_ID: return "MAX_REQUEST_ID";
+        case SETUP_PARAM_AUTHORIZATION_TOKEN: return "AUTHORIZATION_TOKEN";
+        case SETUP_PARAM_MAX_AUTH_TOKEN_CACHE_SIZE: return "MAX_AUTH_TOKEN_CACHE_SIZE";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string parameter_name(uint64_t type) {
+    switch (type) {
+        case PARAM_AUTHORIZATION_TOKEN: return "AUTHORIZATION_TOKEN";
+        case PARAM_DELIVERY_TIMEOUT: return "DELIVERY_TIMEOUT";
+        case PARAM_MAX_CACHE_DURATION: return "MAX_CACHE_DURATION";
+        default: return "UNKNOWN";
+    }
+}
+
+std::string auth_token_alias_type_name(uint64_t type) {
+    switch (type) {
+        case AUTH_TOKEN_DELETE: return "DELETE";
+        case AUTH_TOKEN_REGISTER: return "REGISTER";
+        case AUTH_TOKEN_USE_ALIAS: return "USE_ALIAS";
+        case AUTH_TOKEN_USE_VALUE: return "USE_VALUE";
+        default: return "UNKNOWN";
+    }
+}
+
 } // namespace moqt
@@ -0,0 +1,506 @@
+// data_parser.cpp
+// Handles parsing of MoQT data streams and datagrams
+
+#include <moqt/data_parser.hpp>
+#include <moqt/common.hpp>
+#include <moqt/encoder.hpp>
+#include <map>
+#include <set>
+#include <sstream>
+#include <stdexcept>
+
+namespace moqt {
+
+namespace {
+
+// What an object's extension header block holds
+struct ExtensionHeaders {
+    // Where the headers start in the message, and how many bytes they
+    // take: 0 when the stream type carries none
+    size_t offset = 0;
+    uint64_t length = 0;
+    bool has_prior_group_id_gap = false;
+    uint64_t prior_group_id_gap = 0;
+    // "name=description" for each header of a registered type, in order
+    std::vector<std::string> described;
+};
+
+struct ExtensionHeaderHandler {
+    std::string name;
+    ExtensionHeaderDecoder decode;
+};
+
+std::map<uint64_t, ExtensionHeaderHandler>& extension_handlers() {
+    static std::map<uint64_t, ExtensionHeaderHandler> handlers;
+    return handlers;
+}
+
+// Describes one extension header value with the decoder registered for
+// its type. value_offset locates the value in the message for an issue.
+void describe_extension(ExtensionHeaders& headers, uint64_t type, const std::vector<uint8_t>& value,
+                        size_t value_offset) {
+    auto it = extension_handlers().find(type);
+    if (it == extension_handlers().end()) return;
+    const ExtensionHeaderHandler& handler = it->second;
+    try {
+        headers.described.push_back(handler.name + "=" + handler.decode(value));
+    } catch (const std::exception& e) {
+        // The header's own bounds are known, so the block goes on after it
+        std::runtime_error error(handler.name + " extension header: " + e.what());
+        if (!recover_from(error, value_offset, handler.name)) throw error;
+    }
+}
+
+// Reads an extension header block: its length, then headers that must
+// fill it exactly. Each is a type and, like parameters, a varint value
+// for even types or a length-prefixed one for odd types. Headers of a
+// registered type are described by its decoder.
+ExtensionHeaders read_extensions(const std::vector<uint8_t>& data, size_t& offset) {
+    ExtensionHeaders headers;
+    headers.length = read_varint_canonical(data, offset, "extension_headers_length");
+    try {
+        check_remaining(data, offset, headers.length, "Extension headers exceed buffer");
+    } catch (const std::out_of_range&) {
+        note_failed_field("extension_headers");
+        throw;
+    }
+    headers.offset = offset;
+    std::vector<uint8_t> block(data.begin() + offset, data.begin() + offset + headers.length);
+    size_t position = 0;
+    try {
+        // The block is kept whole, so its own varints are not logged
+        ScopedVarintLog copied(nullptr);
+        while (position < block.size()) {
+            uint64_t type = read_varint(block, position);
+            size_t value_start = position;
+            if (type % 2 != 0) {
+                std::string value = read_lp_string(block, position);
+                describe_extension(headers, type, std::vector<uint8_t>(value.begin(), value.end()),
+                                   offset + position - value.size());
+                continue;
+            }
+            uint64_t value = read_varint(block, position);
+            describe_extension(headers, type,
+                               std::vector<uint8_t>(block.begin() + value_start, block.begin() + position),
+                               offset + value_start);
+            if (type == EXTENSION_PRIOR_GROUP_ID_GAP) {
+                headers.has_prior_group_id_gap = true;
+                headers.prior_group_id_gap = value;
+            }
+        }
+    } catch (const std::out_of_range&) {
+        note_failed_field("extension_headers");
+        throw std::runtime_error("extension headers overrun their " + std::to_string(headers.length)
+                                 + "-byte block");
+    }
+    note_field_span("extension_headers", offset, offset + headers.length);
+    offset += headers.length;
+    return headers;
+}
+
+// Skips over an object payload of the given length
+void skip_payload(const std::vector<uint8_t>& data, size_t& offset, uint64_t len) {
+    try {
+        check_remaining(data, offset, len, "Object payload exceeds buffer");
+    } catch (const std::out_of_range&) {
+        note_failed_field("payload");
+        throw;
+    }
+    note_field_span("payload", offset, offset + len);
+    offset += len;
+}
+
+// Appends a warning if the payload breaks the configured size limit
+void check_payload_size(std::ostringstream& warnings, const ValidationOptions& options,
+                        size_t index, uint64_t size) {
+    if (options.max_object_payload == 0 || size <= options.max_object_payload) return;
+    warnings << " [object " << index << ": payload size " << size
+             << " exceeds max_object_payload " << options.max_object_payload << "]";
+}
+
+// Checks that a data message's track alias belongs to an active
+// subscription of the session, if there is one. Unknown aliases are
+// warnings unless the options require them to be active.
+void check_track_alias(std::ostringstream& warnings, const ValidationOptions& options,
+                       const SessionState* session, uint64_t track_alias) {
+    if (!session || session->active_tracks.count(track_alias)) return;
+    std::string problem = "track_alias=" + std::to_string(track_alias) + " has no active subscription";
+    if (options.require_active_track_alias) throw ProtocolViolation(problem);
+    warnings << " [" << problem << "]";
+}
+
+// Throws if the buffer ends where the named field should start, so that
+// truncation is reported with the field
+void require_field(const std::vector<uint8_t>& data, size_t offset, const char* field) {
+    if (offset >= data.size()) {
+        note_failed_field(field);
+        throw std::out_of_range("missing " + std::string(field));
+    }
+}
+
+struct SubgroupHeader {
+    uint64_t type;
+    uint64_t track_alias;
+    uint64_t group_id;
+    bool explicit_subgroup;
+    // Types 0x0A and 0x0B take the first object's ID as the subgroup ID
+    bool subgroup_from_first_object;
+    uint64_t subgroup_id;
+    uint8_t priority;
+    bool has_extensions;
+};
+
+// One object read from a subgroup or fetch stream
+struct StreamObject {
+    uint64_t group_id;
+    uint64_t subgroup_id;
+    uint64_t object_id;
+    // Only fetch stream objects carry their own priority
+    uint8_t priority;
+    // Where the payload starts in the message
+    size_t payload_offset;
+    uint64_t payload_len;
+    ExtensionHeaders extensions;
+    // Zero-length objects carry an Object Status instead of a payload
+    bool has_status;
+    uint64_t status;
+};
+
+SubgroupHeader read_subgroup_header(const std::vector<uint8_t>& data, size_t& offset) {
+    SubgroupHeader header{};
+    header.type = read_varint_canonical(data, offset, "type");
+    if (header.type < SUBGROUP_HEADER_MIN || header.type > SUBGROUP_HEADER_MAX) {
+        note_failed_field("type");
+        throw std::runtime_error("Not a subgroup header type: " + std::to_string(header.type));
+    }
+    header.has_extensions = (header.type & 0x01) != 0;
+    header.track_alias = read_varint(data, offset, "track_alias");
+    header.group_id = read_varint(data, offset, "group_id");
+    header.explicit_subgroup = header.type >= 0x0C;
+    header.subgroup_from_first_object = header.type == 0x0A || header.type == 0x0B;
+    header.subgroup_id = header.explicit_subgroup ? read_varint(data, offset, "subgroup_id") : 0;
+    header.priority = read_u8(data, offset, "publisher_priority");
+    return header;
+}
+
+// Reads the object length, then either the status or the payload
+void read_object_body(const std::vector<uint8_t>& data, size_t& offset, StreamObject& object) {
+    object.payload_len = read_varint_canonical(data, offset, "payload_length");
+    object.has_status = object.payload_len == 0;
+    object.payload_offset = offset;
+    if (object.has_status) {
+        object.status = read_varint(data, offset, "object_status");
+    } else {
+        skip_payload(data, offset, object.payload_len);
+    }
+}
+
+// The fields of an object as its encoder takes them, with the extension
+// headers and payload copied out of data
+ObjectFields object_fields(const std::vector<uint8_t>& data, const StreamObject& object) {
+    ObjectFields fields;
+    fields.object_id = object.object_id;
+    auto extensions = data.begin() + object.extensions.offset;
+    fields.extensions.assign(extensions, extensions + object.extensions.length);
+    if (object.has_status) {
+        fields.status = object.status;
+    } else {
+        fields.payload.assign(data.begin() + object.payload_offset,
+                              data.begin() + object.payload_offset + object.payload_len);
+    }
+    return fields;
+}
+
+StreamObject read_subgroup_object(const std::vector<uint8_t>& data, size_t& offset, const SubgroupHeader& header) {
+    StreamObject object{};
+    object.group_id = header.group_id;
+    object.subgroup_id = header.subgroup_id;
+    object.object_id = read_varint(data, offset, "object_id");
+    if (header.has_extensions) object.extensions = read_extensions(data, offset);
+    read_object_body(data, offset, object);
+    return object;
+}
+
+// True if data from offset on reads as a whole subgroup stream: a header,
+// then objects up to the end of the buffer
+bool is_subgroup_stream_at(const std::vector<uint8_t>& data, size_t offset) {
+    ScopedIssueCollector trial(nullptr);
+    ScopedFieldRecorder no_spans(nullptr);
+    ScopedVarintLog no_log(nullptr);
+    try {
+        SubgroupHeader header = read_subgroup_header(data, offset);
+        while (offset < data.size()) read_subgroup_object(data, offset, header);
+    } catch (const std::exception&) {
+        return false;
+    }
+    return true;
+}
+
+// Called when an object fails to parse. Throws, moving offset back to
+// it, if a second stream starts where one of the objects read so far
+// did.
+void check_concatenated_header(const std::vector<uint8_t>& data, const std::vector<size_t>& object_starts,
+                               size_t& offset) {
+    for (size_t i = 0; i < object_starts.size(); ++i) {
+        if (!is_subgroup_stream_at(data, object_starts[i])) continue;
+        offset = object_starts[i];
+        throw std::runtime_error("a second subgroup header starts where object " + std::to_string(i)
+                                 + " would; a subgroup stream has exactly one header");
+    }
+}
+
+uint64_t read_fetch_header(const std::vector<uint8_t>& data, size_t& offset) {
+    uint64_t type = read_varint_canonical(data, offset, "type");
+    if (type != FETCH_HEADER) {
+        note_failed_field("type");
+        throw std::runtime_error("Not a fetch header type: " + std::to_string(type));
+    }
+    return read_varint(data, offset, "request_id");
+}
+
+StreamObject read_fetch_object(const std::vector<uint8_t>& data, size_t& offset) {
+    StreamObject object{};
+    object.group_id = read_varint(data, offset, "group_id");
+    object.subgroup_id = read_varint(data, offset, "subgroup_id");
+    object.object_id = read_varint(data, offset, "object_id");
+    object.priority = read_u8(data, offset, "publisher_priority");
+    object.extensions = read_extensions(data, offset);
+    read_object_body(data, offset, object);
+    return object;
+}
+
+// Appends one object entry to a stream report
+void report_object(std::ostringstream& report, const StreamObject& object, bool full_location) {
+    report << " [";
+    if (full_location) report << object.group_id << "/" << object.subgroup_id << "/";
+    report << object.object_id << ":";
+    if (object.has_status) {
+        report << "status=" << object.status;
+    } else {
+        report << "len=" << object.payload_len;
+    }
+    for (const std::string& described : object.extensions.described) report << ", " << described;
+    report << "]";
+}
+
+// Running totals for count-only mode
+struct ObjectTally {
+    size_t objects = 0;
+    uint64_t payload_bytes = 0;
+    std::set<uint64_t> groups;
+
+    void add(const StreamObject& object) {
+        ++objects;
+        payload_bytes += object.payload_len;
+        groups.insert(object.group_id);
+    }
+
+    std::string str(size_t stream_bytes) const {
+        std::ostringstream out;
+        out << "objects=" << objects << ", groups=" << groups.size() << ", group_range=";
+        if (groups.empty()) {
+            out << "none";
+        } else {
+            out << *groups.begin() << "-" << *groups.rbegin();
+        }
+        out << ", payload_bytes=" << payload_bytes << ", stream_bytes=" << stream_bytes;
+        return out.str();
+    }
+};
+
+// Called when an object of a type 0x0A or 0x0B stream fails to parse.
+// Throws if the stream reads cleanly as the type that carries a Subgroup
+// ID field, since the header then most likely has a stray one.
+void check_stray_subgroup_id(const std::vector<uint8_t>& data, const SubgroupHeader& header) {
+    std::vector<uint8_t> retyped = data;
+    retyped[0] = static_cast<uint8_t>(header.type + 2);
+    if (!is_subgroup_stream_at(retyped, 0)) return;
+    throw ProtocolViolation("type=" + std::to_string(header.type) + " has no Subgroup ID field, but the stream "
+                            "reads as type=" + std::to_string(header.type + 2) + " with one");
+}
+
+} // namespace
+
+void register_extension_header(uint64_t type, const std::string& name, ExtensionHeaderDecoder decoder) {
+    extension_handlers()[type] = ExtensionHeaderHandler{name, std::move(decoder)};
+}
+
+std::string parse_subgroup_stream(const std::vector<uint8_t>& data, const ValidationOptions& options,
+                                  const SessionState* session) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        SubgroupHeader header = read_subgroup_header(data, offset);
+        check_track_alias(warnings, options, session, header.track_alias);
+        size_t objects = 0;
+        bool any_extensions = false;
+        bool has_prior_group = false;
+        uint64_t prior_group_id = 0;
+        std::vector<size_t> object_starts;
+        std::ostringstream object_report;
+        SubgroupStreamMessage decoded;
+        for (; offset < data.size(); ++objects) {
+            object_starts.push_back(offset);
+            StreamObject object;
+            try {
+                object = read_subgroup_object(data, offset, header);
+            } catch (const ProtocolViolation&) {
+                throw;
+            } catch (const std::exception&) {
+                if (options.reject_concatenated_subgroups) check_concatenated_header(data, object_starts, offset);
+                if (header.subgroup_from_first_object) check_stray_subgroup_id(data, header);
+                throw;
+            }
+            if (objects == 0 && object.extensions.has_prior_group_id_gap) {
+                uint64_t gap = object.extensions.prior_group_id_gap;
+                if (gap > header.group_id) {
+                    throw ProtocolViolation("prior_group_id_gap=" + std::to_string(gap) + " reaches below group 0 "
+                                            "from group_id=" + std::to_string(header.group_id),
+                                            "Objects[0]", object_starts.back());
+                }
+                has_prior_group = true;
+                prior_group_id = header.group_id - gap;
+            }
+            if (header.subgroup_from_first_object && objects == 0) {
+                header.subgroup_id = object.object_id;
+            } else if (header.subgroup_from_first_object && object.object_id <= header.subgroup_id) {
+                throw ProtocolViolation("object_id=" + std::to_string(object.object_id) + " is not above the first "
+                                        "object_id=" + std::to_string(header.subgroup_id) + ", which type="
+                                        + std::to_string(header.type) + " takes as the subgroup ID",
+                                        "Objects[" + std::to_string(objects) + "]", object_starts.back());
+            }
+            note_field_span("Objects[" + std::to_string(objects) + "]", object_starts.back(), offset);
+            if (!object.has_status) check_payload_size(warnings, options, objects, object.payload_len);
+            any_extensions = any_extensions || object.extensions.length > 0;
+            report_object(object_report, object, false);
+            decoded.objects.push_back(object_fields(data, object));
+        }
+        decoded.type = header.type;
+        decoded.track_alias = header.track_alias;
+        decoded.group_id = header.group_id;
+        decoded.subgroup_id = header.subgroup_id;
+        decoded.publisher_priority = header.priority;
+        record_message({header.type, decoded});
+        report << "SUBGROUP_HEADER: type=" << header.type << ", track_alias=" << header.track_alias
+               << ", group_id=" << header.group_id;
+        if (has_prior_group) report << ", prior_group_id=" << prior_group_id;
+        if (header.explicit_subgroup || (header.subgroup_from_first_object && objects > 0)) {
+            report << ", subgroup_id=" << header.subgroup_id;
+        }
+        report << ", publisher_priority=" << static_cast<int>(header.priority) << "; Objects=" << object_report.str();
+        if (header.has_extensions && objects > 0 && !any_extensions) {
+            std::string problem = "type=" + std::to_string(header.type) + " signals extensions but none of its "
+                                  + std::to_string(objects) + " objects has any";
+            if (options.require_subgroup_extensions) throw ProtocolViolation(problem);
+            warnings << " [" << problem << "; type=" << (header.type & ~uint64_t{1}) << " omits the fields]";
+        }
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("SUBGROUP_HEADER", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("SUBGROUP_HEADER", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string parse_fetch_stream(const std::vector<uint8_t>& data, const ValidationOptions& options) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        FetchStreamMessage decoded;
+        decoded.request_id = read_fetch_header(data, offset);
+        report << "FETCH_HEADER: request_id=" << decoded.request_id << "; Objects=";
+        for (size_t index = 0; offset < data.size(); ++index) {
+            size_t start = offset;
+            StreamObject object = read_fetch_object(data, offset);
+            note_field_span("Objects[" + std::to_string(index) + "]", start, offset);
+            if (!object.has_status) check_payload_size(warnings, options, index, object.payload_len);
+            report_object(report, object, true);
+            decoded.objects.push_back({object.group_id, object.subgroup_id, object.priority,
+                                       object_fields(data, object)});
+        }
+        record_message({FETCH_HEADER, decoded});
+    } catch (const std::exception& e) {
+        return parse_error_report("FETCH_HEADER", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string parse_object_datagram(const std::vector<uint8_t>& data, const ValidationOptions& options,
+                                  const SessionState* session) {
+    size_t offset = 0;
+    std::ostringstream report;
+    std::ostringstream warnings;
+    try {
+        uint64_t type = read_varint_canonical(data, offset, "type");
+        if (type > OBJECT_DATAGRAM_STATUS_EXT) {
+            note_failed_field("type");
+            throw std::runtime_error("Not an object datagram type: " + std::to_string(type));
+        }
+        require_field(data, offset, "track_alias");
+        uint64_t track_alias = read_varint(data, offset, "track_alias");
+        require_field(data, offset, "group_id");
+        uint64_t group_id = read_varint(data, offset, "group_id");
+        require_field(data, offset, "object_id");
+        uint64_t object_id = read_varint(data, offset, "object_id");
+        require_field(data, offset, "publisher_priority");
+        uint8_t priority = read_u8(data, offset, "publisher_priority");
+        ExtensionHeaders extensions;
+        if (type == OBJECT_DATAGRAM_EXT || type == OBJECT_DATAGRAM_STATUS_EXT) {
+            require_field(data, offset, "extension_headers_length");
+            extensions = read_extensions(data, offset);
+        }
+        report << "OBJECT_DATAGRAM: type=" << type << ", track_alias=" << track_alias
+               << ", group_id=" << group_id << ", object_id=" << object_id
+               << ", publisher_priority=" << static_cast<int>(priority);
+        for (const std::string& described : extensions.described) report << ", " << described;
+        check_track_alias(warnings, options, session, track_alias);
+        ObjectDatagramMessage decoded{type, track_alias, group_id, priority, {}};
+        decoded.object.object_id = object_id;
+        auto block = data.begin() + extensions.offset;
+        decoded.object.extensions.assign(block, block + extensions.length);
+        if (type >= OBJECT_DATAGRAM_STATUS) {
+            require_field(data, offset, "object_status");
+            decoded.object.status = read_varint(data, offset, "object_status");
+            report << ", status=" << decoded.object.status;
+        } else {
+            // The payload runs to the end of the datagram and may be empty
+            uint64_t payload_len = data.size() - offset;
+            note_field_span("payload", offset, data.size());
+            check_payload_size(warnings, options, 0, payload_len);
+            report << ", len=" << payload_len;
+            decoded.object.payload.assign(data.begin() + offset, data.end());
+        }
+        record_message({type, decoded});
+    } catch (const ProtocolViolation& e) {
+        return protocol_violation_report("OBJECT_DATAGRAM", e, offset);
+    } catch (const std::exception& e) {
+        return parse_error_report("OBJECT_DATAGRAM", e, offset);
+    }
+    if (!warnings.str().empty()) report << "; Warnings=" << warnings.str();
+    return report.str();
+}
+
+std::string count_stream_objects(const std::vector<uint8_t>& data) {
+    size_t offset = 0;
+    ObjectTally tally;
+    try {
+        size_t peek = 0;
+        std::string stream = read_varint(data, peek) == FETCH_HEADER ? "FETCH_HEADER" : "SUBGROUP_HEADER";
+        if (stream == "FETCH_HEADER") {
+            read_fetch_header(data, offset);
+            while (offset < data.size()) tally.add(read_fetch_object(data, offset));
+        } else {
+            SubgroupHeader header = read_subgroup_header(data, offset);
+            while (offset < data.size()) tally.add(read_subgroup_object(data, offset, header));
+        }
+        return "COUNT: stream=" + stream + ", " + tally.str(data.size());
+    } catch (const std::exception& e) {
+        return std::string("COUNT parse error: ") + e.what() + " after " + std::to_string(tally.objects) + " objects";
+    }
+}
+
+} // namespace moqt
@@ -0,0 +1,696 @@
+// encoder.cpp
+// Wire encodings for control messages, data streams and datagrams
+
+#include <moqt/encoder.hpp>
+#include <moqt/control_parser.hpp>
+#include <moqt/data_parser.hpp>
+#include <stdexcept>
+#include <utility>
+
+namespace moqt {
+
+namespace {
+
+// The active message recorder; null while none is recording
+thread_local DecodedMessage* message_recorder = nullptr;
+
+void write_u8(std::vector<uint8_t>& out, uint8_t value) {
+    out.push_back(value);
+}
+
+void write_bytes(std::vector<uint8_t>& out, const std::string& bytes) {
+    write_varint(out, bytes.size());
+    out.insert(out.end(), bytes.begin(), bytes.end());
+}
+
+void write_bytes(std::vector<uint8_t>& out, const std::vector<uint8_t>& bytes) {
+    write_varint(out, bytes.size());
+    out.insert(out.end(), bytes.begin(), bytes.end());
+}
+
+void write_tuple(std::vector<uint8_t>& out, const std::vector<std::string>& fields) {
+    write_varint(out, fields.size());
+    for (const auto& field : fields) write_bytes(out, field);
+}
+
+void write_location(std::vector<uint8_t>& out, const Location& location) {
+    write_varint(out, location.group);
+    write_varint(out, location.object);
+}
+
+void write_parameters(std::vector<uint8_t>& out, const std::vector<Parameter>& params) {
+    write_varint(out, params.size());
+    for (const auto& param : params) {
+        write_varint(out, param.type);
+        if (param.type % 2 == 0) {
+            write_varint(out, param.value);
+        } else {
+            write_bytes(out, param.bytes);
+        }
+    }
+}
+
+// Starts a control message of the given type
+std::vector<uint8_t> start_message(uint64_t type) {
+    std::vector<uint8_t> out;
+    write_varint(out, type);
+    return out;
+}
+
+std::vector<uint8_t> request_id_message(uint64_t type, uint64_t request_id) {
+    std::vector<uint8_t> out = start_message(type);
+    write_varint(out, request_id);
+    return out;
+}
+
+std::vector<uint8_t> request_error_message(uint64_t type, const RequestErrorMessage& message) {
+    std::vector<uint8_t> out = start_message(type);
+    write_varint(out, message.request_id);
+    write_varint(out, message.error_code);
+    write_bytes(out, message.reason);
+    return out;
+}
+
+std::vector<uint8_t> namespace_message(uint64_t type, const std::vector<std::string>& track_namespace) {
+    std::vector<uint8_t> out = start_message(type);
+    write_tuple(out, track_namespace);
+    return out;
+}
+
+std::vector<uint8_t> announce_message(uint64_t type, const AnnounceMessage& message) {
+    std::vector<uint8_t> out = start_message(type);
+    write_varint(out, message.request_id);
+    write_tuple(out, message.track_namespace);
+    write_parameters(out, message.params);
+    return out;
+}
+
+// Writes the extension block (if the stream type has one), then the
+// payload length and payload, or a zero length and the status
+void write_object_body(std::vector<uint8_t>& out, const ObjectFields& object, bool has_extensions) {
+    if (has_extensions) {
+        write_bytes(out, object.extensions);
+    } else if (!object.extensions.empty()) {
+        throw std::invalid_argument("object " + std::to_string(object.object_id)
+                                    + " has extensions but its type carries none");
+    }
+    write_bytes(out, object.payload);
+    if (object.payload.empty()) write_varint(out, object.status);
+}
+
+} // namespace
+
+std::vector<uint8_t> encode_client_setup(const ClientSetupMessage& message) {
+    std::vector<uint8_t> out = start_message(CLIENT_SETUP);
+    write_varint(out, message.versions.size());
+    for (uint64_t version : message.versions) write_varint(out, version);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_server_setup(const ServerSetupMessage& message) {
+    std::vector<uint8_t> out = start_message(SERVER_SETUP);
+    write_varint(out, message.version);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_subscribe(const SubscribeMessage& message) {
+    const FilterFieldSpec* spec = find_filter_field_spec(message.filter_type);
+    if (!spec) throw std::invalid_argument("invalid filter_type=" + std::to_string(message.filter_type));
+    std::vector<uint8_t> out = start_message(SUBSCRIBE);
+    write_varint(out, message.request_id);
+    write_varint(out, message.track_alias);
+    write_tuple(out, message.track_namespace);
+    write_bytes(out, message.track_name);
+    write_u8(out, message.subscriber_priority);
+    write_u8(out, message.group_order);
+    write_u8(out, message.forward);
+    write_varint(out, message.filter_type);
+    if (spec->has_start) write_location(out, message.start);
+    if (spec->has_end_group) write_varint(out, message.end_group);
+    if (spec->has_end_group && message.has_end_object) write_varint(out, message.end_object);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_subscribe_update(const SubscribeUpdateMessage& message) {
+    std::vector<uint8_t> out = start_message(SUBSCRIBE_UPDATE);
+    write_varint(out, message.request_id);
+    write_location(out, message.start);
+    write_varint(out, message.open_ended ? 0 : message.end_group + 1);
+    write_u8(out, message.subscriber_priority);
+    write_u8(out, message.forward);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_subscribe_ok(const SubscribeOkMessage& message) {
+    std::vector<uint8_t> out = start_message(SUBSCRIBE_OK);
+    write_varint(out, message.request_id);
+    write_varint(out, message.expires);
+    write_u8(out, message.group_order);
+    write_u8(out, message.content_exists);
+    if (message.content_exists) write_location(out, message.largest);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_subscribe_error(const SubscribeErrorMessage& message) {
+    std::vector<uint8_t> out = start_message(SUBSCRIBE_ERROR);
+    write_varint(out, message.request_id);
+    write_varint(out, message.error_code);
+    write_bytes(out, message.reason);
+    write_varint(out, message.track_alias);
+    return out;
+}
+
+std::vector<uint8_t> encode_subscribe_done(const SubscribeDoneMessage& message) {
+    std::vector<uint8_t> out = start_message(SUBSCRIBE_DONE);
+    write_varint(out, message.request_id);
+    write_varint(out, message.status_code);
+    write_varint(out, message.stream_count);
+    write_bytes(out, message.reason);
+    return out;
+}
+
+std::vector<uint8_t> encode_unsubscribe(uint64_t request_id) {
+    return request_id_message(UNSUBSCRIBE, request_id);
+}
+
+std::vector<uint8_t> encode_announce(const AnnounceMessage& message) {
+    return announce_message(ANNOUNCE, message);
+}
+
+std::vector<uint8_t> encode_announce_ok(uint64_t request_id) {
+    return request_id_message(ANNOUNCE_OK, request_id);
+}
+
+std::vector<uint8_t> encode_announce_error(const RequestErrorMessage& message) {
+    return request_error_message(ANNOUNCE_ERROR, message);
+}
+
+std::vector<uint8_t> encode_unannounce(const std::vector<std::string>& track_namespace) {
+    return namespace_message(UNANNOUNCE, track_namespace);
+}
+
+std::vector<uint8_t> encode_announce_cancel(const AnnounceCancelMessage& message) {
+    std::vector<uint8_t> out = namespace_message(ANNOUNCE_CANCEL, message.track_namespace);
+    write_varint(out, message.error_code);
+    write_bytes(out, message.reason);
+    return out;
+}
+
+std::vector<uint8_t> encode_track_status_request(const TrackStatusRequestMessage& message) {
+    std::vector<uint8_t> out = start_message(TRACK_STATUS_REQUEST);
+    write_varint(out, message.request_id);
+    write_tuple(out, message.track_namespace);
+    write_bytes(out, message.track_name);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_track_status(const TrackStatusMessage& message) {
+    std::vector<uint8_t> out = start_message(TRACK_STATUS);
+    write_varint(out, message.request_id);
+    write_varint(out, message.status_code);
+    write_location(out, message.largest);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_goaway(const std::string& new_session_uri) {
+    std::vector<uint8_t> out = start_message(GOAWAY);
+    write_bytes(out, new_session_uri);
+    return out;
+}
+
+std::vector<uint8_t> encode_subscribe_announces(const AnnounceMessage& message) {
+    return announce_message(SUBSCRIBE_ANNOUNCES, message);
+}
+
+std::vector<uint8_t> encode_subscribe_announces_ok(uint64_t request_id) {
+    return request_id_message(SUBSCRIBE_ANNOUNCES_OK, request_id);
+}
+
+std::vector<uint8_t> encode_subscribe_announces_error(const RequestErrorMessage& message) {
+    return request_error_message(SUBSCRIBE_ANNOUNCES_ERROR, message);
+}
+
+std::vector<uint8_t> encode_unsubscribe_announces(const std::vector<std::string>& prefix) {
+    return namespace_message(UNSUBSCRIBE_ANNOUNCES, prefix);
+}
+
+std::vector<uint8_t> encode_max_request_id(uint64_t max_request_id) {
+    return request_id_message(MAX_REQUEST_ID, max_request_id);
+}
+
+std::vector<uint8_t> encode_requests_blocked(uint64_t max_request_id) {
+    return request_id_message(REQUESTS_BLOCKED, max_request_id);
+}
+
+std::vector<uint8_t> encode_fetch(const FetchMessage& message) {
+    if (message.fetch_type != FETCH_STANDALONE && message.fetch_type != FETCH_RELATIVE_JOINING
+        && message.fetch_type != FETCH_ABSOLUTE_JOINING) {
+        throw std::invalid_argument("invalid fetch_type=" + std::to_string(message.fetch_type));
+    }
+    std::vector<uint8_t> out = start_message(FETCH);
+    write_varint(out, message.request_id);
+    write_u8(out, message.subscriber_priority);
+    write_u8(out, message.group_order);
+    write_varint(out, message.fetch_type);
+    if (message.fetch_type == FETCH_STANDALONE) {
+        write_tuple(out, message.track_namespace);
+        write_bytes(out, message.track_name);
+        write_location(out, message.start);
+        write_location(out, message.end);
+    } else {
+        write_varint(out, message.joining_request_id);
+        write_varint(out, message.joining_start);
+    }
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_fetch_ok(const FetchOkMessage& message) {
+    std::vector<uint8_t> out = start_message(FETCH_OK);
+    write_varint(out, message.request_id);
+    write_u8(out, message.group_order);
+    write_u8(out, message.end_of_track);
+    write_location(out, message.end_location);
+    write_parameters(out, message.params);
+    return out;
+}
+
+std::vector<uint8_t> encode_fetch_error(const RequestErrorMessage& message) {
+    return request_error_message(FETCH_ERROR, message);
+}
+
+std::vector<uint8_t> encode_fetch_cancel(uint64_t request_id) {
+    return request_id_message(FETCH_CANCEL, request_id);
+}
+
+std::vector<uint8_t> frame_control_message(const std::vector<uint8_t>& message, bool legacy_framing) {
+    if (message.empty()) throw std::invalid_argument("empty control message");
+    size_t offset = 0;
+    uint64_t type = read_varint_canonical(message, offset);
+    size_t length = message.size() - offset;
+    std::vector<uint8_t> out(message.begin(), message.begin() + offset);
+    if (legacy_framing || type == LEGACY_CLIENT_SETUP || type == LEGACY_SERVER_SETUP) {
+        write_varint(out, length);
+        out.insert(out.end(), message.begin() + offset, message.end());
+        return out;
+    }
+    if (length > 0xFFFF) {
+        throw std::invalid_argument("control message payload of " + std::to_string(length)
+                                    + " bytes does not fit a 16-bit length");
+    }
+    write_u8(out, static_cast<uint8_t>(length >> 8));
+    write_u8(out, static_cast<uint8_t>(length));
+    out.insert(out.end(), message.begin() + offset, message.end());
+    return out;
+}
+
+std::vector<uint8_t> encode_subgroup_stream(const SubgroupStreamMessage& message) {
+    if (message.type < SUBGROUP_HEADER_MIN || message.type > SUBGROUP_HEADER_MAX) {
+        throw std::invalid_argument("Not a subgroup header type: " + std::to_string(message.type));
+    }
+    // Types 0x08 and 0x09 imply Subgroup ID 0, and 0x0A and 0x0B the first
+    // object's ID
+    if (message.type < 0x0C) {
+        uint64_t implied = message.type >= 0x0A && !message.objects.empty() ? message.objects[0].object_id : 0;
+        if (message.subgroup_id != implied) {
+            throw std::invalid_argument("type " + std::to_string(message.type) + " implies subgroup_id="
+                                        + std::to_string(implied) + ", not "
+                                        + std::to_string(message.subgroup_id));
+        }
+    }
+    std::vector<uint8_t> out;
+    write_varint(out, message.type);
+    write_varint(out, message.track_alias);
+    write_varint(out, message.group_id);
+    if (message.type >= 0x0C) write_varint(out, message.subgroup_id);
+    write_u8(out, message.publisher_priority);
+    for (const auto& object : message.objects) {
+        write_varint(out, object.object_id);
+        write_object_body(out, object, (message.type & 0x01) != 0);
+    }
+    return out;
+}
+
+std::vector<uint8_t> encode_fetch_stream(const FetchStreamMessage& message) {
+    std::vector<uint8_t> out;
+    write_varint(out, FETCH_HEADER);
+    write_varint(out, message.request_id);
+    for (const auto& entry : message.objects) {
+        write_varint(out, entry.group_id);
+        write_varint(out, entry.subgroup_id);
+        write_varint(out, entry.object.object_id);
+        write_u8(out, entry.publisher_priority);
+        write_object_body(out, entry.object, true);
+    }
+    return out;
+}
+
+std::vector<uint8_t> encode_object_datagram(const ObjectDatagramMessage& message) {
+    if (message.type > OBJECT_DATAGRAM_STATUS_EXT) {
+        throw std::invalid_argument("Not an object datagram type: " + std::to_string(message.type));
+    }
+    bool has_extensions = message.type == OBJECT_DATAGRAM_EXT || message.type == OBJECT_DATAGRAM_STATUS_EXT;
+    const ObjectFields& object = message.object;
+    if (!has_extensions && !object.extensions.empty()) {
+        throw std::invalid_argument("datagram type " + std::to_string(message.type) + " carries no extensions");
+    }
+    std::vector<uint8_t> out;
+    write_varint(out, message.type);
+    write_varint(out, message.track_alias);
+    write_varint(out, message.group_id);
+    write_varint(out, object.object_id);
+    write_u8(out, message.publisher_priority);
+    if (has_extensions) write_bytes(out, object.extensions);
+    if (message.type >= OBJECT_DATAGRAM_STATUS) {
+        write_varint(out, object.status);
+    } else {
+        // The payload runs to the end of the datagram
+        out.insert(out.end(), object.payload.begin(), object.payload.end());
+    }
+    return out;
+}
+
+ScopedMessageRecorder::ScopedMessageRecorder(DecodedMessage* message) : previous_(message_recorder) {
+    message_recorder = message;
+}
+
+ScopedMessageRecorder::~ScopedMessageRecorder() {
+    message_recorder = previous_;
+}
+
+void record_message(DecodedMessage message) {
+    if (message_recorder) *message_recorder = std::move(message);
+}
+
+namespace {
+
+void visit_object_body(const ObjectFields& object, bool has_extensions, FieldVisitor& visitor) {
+    if (has_extensions) visitor.extensions("extension_headers", object.extensions);
+    if (object.payload.empty()) {
+        visitor.varint("object_status", object.status);
+    } else {
+        visitor.payload("object_payload", object.payload);
+    }
+}
+
+// One overload per struct, taking the message type for the structs that
+// several types share
+void visit_message(std::monostate, uint64_t, FieldVisitor&) {}
+
+void visit_message(const ClientSetupMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varints("supported_versions", message.versions);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const ServerSetupMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("selected_version", message.version);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const SubscribeMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.varint("track_alias", message.track_alias);
+    visitor.tuple("track_namespace", message.track_namespace);
+    visitor.text("track_name", message.track_name);
+    visitor.byte("subscriber_priority", message.subscriber_priority);
+    visitor.byte("group_order", message.group_order);
+    visitor.byte("forward", message.forward);
+    visitor.varint("filter_type", message.filter_type);
+    const FilterFieldSpec* spec = find_filter_field_spec(message.filter_type);
+    if (spec && spec->has_start) visitor.location("start_location", message.start);
+    if (spec && spec->has_end_group) visitor.varint("end_group", message.end_group);
+    if (spec && spec->has_end_group && message.has_end_object) visitor.varint("end_object", message.end_object);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const SubscribeUpdateMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.location("start_location", message.start);
+    visitor.varint("end_group", message.open_ended ? 0 : message.end_group + 1);
+    visitor.byte("subscriber_priority", message.subscriber_priority);
+    visitor.byte("forward", message.forward);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const SubscribeOkMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.varint("expires", message.expires);
+    visitor.byte("group_order", message.group_order);
+    visitor.byte("content_exists", message.content_exists);
+    if (message.content_exists) visitor.location("largest_location", message.largest);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const SubscribeErrorMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.varint("error_code", message.error_code);
+    visitor.text("reason", message.reason);
+    visitor.varint("track_alias", message.track_alias);
+}
+
+void visit_message(const SubscribeDoneMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.varint("status_code", message.status_code);
+    visitor.varint("stream_count", message.stream_count);
+    visitor.text("reason", message.reason);
+}
+
+void visit_message(const RequestErrorMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.varint("error_code", message.error_code);
+    visitor.text("reason", message.reason);
+}
+
+const char* namespace_field(uint64_t type) {
+    return type == SUBSCRIBE_ANNOUNCES || type == UNSUBSCRIBE_ANNOUNCES ? "track_namespace_prefix" : "track_namespace";
+}
+
+void visit_message(const AnnounceMessage& message, uint64_t type, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.tuple(namespace_field(type), message.track_namespace);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const NamespaceMessage& message, uint64_t type, FieldVisitor& visitor) {
+    visitor.tuple(namespace_field(type), message.track_namespace);
+}
+
+void visit_message(const RequestIdMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+}
+
+void visit_message(const GoawayMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.text("new_session_uri", message.new_session_uri);
+}
+
+void visit_message(const AnnounceCancelMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.tuple("track_namespace", message.track_namespace);
+    visitor.varint("error_code", message.error_code);
+    visitor.text("reason", message.reason);
+}
+
+void visit_message(const TrackStatusRequestMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.tuple("track_namespace", message.track_namespace);
+    visitor.text("track_name", message.track_name);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const TrackStatusMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.varint("status_code", message.status_code);
+    visitor.location("largest_location", message.largest);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const FetchMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.byte("subscriber_priority", message.subscriber_priority);
+    visitor.byte("group_order", message.group_order);
+    visitor.varint("fetch_type", message.fetch_type);
+    if (message.fetch_type == FETCH_STANDALONE) {
+        visitor.tuple("track_namespace", message.track_namespace);
+        visitor.text("track_name", message.track_name);
+        visitor.location("start_location", message.start);
+        visitor.location("end_location", message.end);
+    } else {
+        visitor.varint("joining_request_id", message.joining_request_id);
+        visitor.varint("joining_start", message.joining_start);
+    }
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const FetchOkMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    visitor.byte("group_order", message.group_order);
+    visitor.byte("end_of_track", message.end_of_track);
+    visitor.location("end_location", message.end_location);
+    visitor.parameters("parameters", message.params);
+}
+
+void visit_message(const SubgroupStreamMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("stream_type", message.type);
+    visitor.varint("track_alias", message.track_alias);
+    visitor.varint("group_id", message.group_id);
+    visitor.varint("subgroup_id", message.subgroup_id);
+    visitor.byte("publisher_priority", message.publisher_priority);
+    for (const auto& object : message.objects) {
+        visitor.begin_object();
+        visitor.varint("object_id", object.object_id);
+        visit_object_body(object, (message.type & 0x01) != 0, visitor);
+        visitor.end_object();
+    }
+}
+
+void visit_message(const FetchStreamMessage& message, uint64_t, FieldVisitor& visitor) {
+    visitor.varint("request_id", message.request_id);
+    for (const auto& entry : message.objects) {
+        visitor.begin_object();
+        visitor.varint("group_id", entry.group_id);
+        visitor.varint("subgroup_id", entry.subgroup_id);
+        visitor.varint("object_id", entry.object.object_id);
+        visitor.byte("publisher_priority", entry.publisher_priority);
+        visit_object_body(entry.object, true, visitor);
+        visitor.end_object();
+    }
+}
+
+void visit_message(const ObjectDatagramMessage& message, uint64_t, FieldVisitor& visitor) {
+    const ObjectFields& object = message.object;
+    visitor.varint("datagram_type", message.type);
+    visitor.varint("track_alias", message.track_alias);
+    visitor.varint("group_id", message.group_id);
+    visitor.varint("object_id", object.object_id);
+    visitor.byte("publisher_priority", message.publisher_priority);
+    if (message.type == OBJECT_DATAGRAM_EXT || message.type == OBJECT_DATAGRAM_STATUS_EXT) {
+        visitor.extensions("extension_headers", object.extensions);
+    }
+    if (message.type >= OBJECT_DATAGRAM_STATUS) {
+        visitor.varint("object_status", object.status);
+    } else {
+        visitor.payload("object_payload", object.payload);
+    }
+}
+
+} // namespace
+
+void visit_fields(const DecodedMessage& message, FieldVisitor& visitor) {
+    std::visit([&](const auto& fields) { visit_message(fields, message.type, visitor); }, message.fields);
+}
+
+namespace {
+
+// One overload per struct, taking the message type for the structs that
+// several types share
+std::vector<uint8_t> encode_fields(std::monostate, uint64_t) {
+    throw std::invalid_argument("message has no decoded fields to encode");
+}
+
+std::vector<uint8_t> encode_fields(const ClientSetupMessage& message, uint64_t) {
+    return encode_client_setup(message);
+}
+
+std::vector<uint8_t> encode_fields(const ServerSetupMessage& message, uint64_t) {
+    return encode_server_setup(message);
+}
+
+std::vector<uint8_t> encode_fields(const SubscribeMessage& message, uint64_t) {
+    return encode_subscribe(message);
+}
+
+std::vector<uint8_t> encode_fields(const SubscribeUpdateMessage& message, uint64_t) {
+    return encode_subscribe_update(message);
+}
+
+std::vector<uint8_t> encode_fields(const SubscribeOkMessage& message, uint64_t) {
+    return encode_subscribe_ok(message);
+}
+
+std::vector<uint8_t> encode_fields(const SubscribeErrorMessage& message, uint64_t) {
+    return encode_subscribe_error(message);
+}
+
+std::vector<uint8_t> encode_fields(const SubscribeDoneMessage& message, uint64_t) {
+    return encode_subscribe_done(message);
+}
+
+std::invalid_argument wrong_type(const char* fields, uint64_t type) {
+    return std::invalid_argument(std::string(fields) + " fields do not belong to message type "
+                                 + std::to_string(type));
+}
+
+std::vector<uint8_t> encode_fields(const RequestErrorMessage& message, uint64_t type) {
+    if (type != ANNOUNCE_ERROR && type != SUBSCRIBE_ANNOUNCES_ERROR && type != FETCH_ERROR) {
+        throw wrong_type("request error", type);
+    }
+    return request_error_message(type, message);
+}
+
+std::vector<uint8_t> encode_fields(const AnnounceMessage& message, uint64_t type) {
+    if (type != ANNOUNCE && type != SUBSCRIBE_ANNOUNCES) throw wrong_type("announce", type);
+    return announce_message(type, message);
+}
+
+std::vector<uint8_t> encode_fields(const NamespaceMessage& message, uint64_t type) {
+    if (type != UNANNOUNCE && type != UNSUBSCRIBE_ANNOUNCES) throw wrong_type("namespace", type);
+    return namespace_message(type, message.track_namespace);
+}
+
+std::vector<uint8_t> encode_fields(const RequestIdMessage& message, uint64_t type) {
+    if (type != UNSUBSCRIBE && type != ANNOUNCE_OK && type != SUBSCRIBE_ANNOUNCES_OK && type != FETCH_CANCEL
+        && type != MAX_REQUEST_ID && type != REQUESTS_BLOCKED) {
+        throw wrong_type("request ID", type);
+    }
+    return request_id_message(type, message.request_id);
+}
+
+std::vector<uint8_t> encode_fields(const GoawayMessage& message, uint64_t) {
+    return encode_goaway(message.new_session_uri);
+}
+
+std::vector<uint8_t> encode_fields(const AnnounceCancelMessage& message, uint64_t) {
+    return encode_announce_cancel(message);
+}
+
+std::vector<uint8_t> encode_fields(const TrackStatusRequestMessage& message, uint64_t) {
+    return encode_track_status_request(message);
+}
+
+std::vector<uint8_t> encode_fields(const TrackStatusMessage& message, uint64_t) {
+    return encode_track_status(message);
+}
+
+std::vector<uint8_t> encode_fields(const FetchMessage& message, uint64_t) {
+    return encode_fetch(message);
+}
+
+std::vector<uint8_t> encode_fields(const FetchOkMessage& message, uint64_t) {
+    return encode_fetch_ok(message);
+}
+
+std::vector<uint8_t> encode_fields(const SubgroupStreamMessage& message, uint64_t) {
+    return encode_subgroup_stream(message);
+}
+
+std::vector<uint8_t> encode_fields(const FetchStreamMessage& message, uint64_t) {
+    return encode_fetch_stream(message);
+}
+
+std::vector<uint8_t> encode_fields(const ObjectDatagramMessage& message, uint64_t) {
+    return encode_object_datagram(message);
+}
+
+} // namespace
+
+std::vector<uint8_t> encode_message(const DecodedMessage& message) {
+    return std::visit([&](const auto& fields) { return encode_fields(fields, message.type); }, message.fields);
+}
+
+} // namespace moqt
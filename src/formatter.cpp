@@ -0,0 +1,307 @@
+// formatter.cpp
+// Built-in output formatters and the formatter registry
+
+#include <moqt/formatter.hpp>
+#include <moqt/common.hpp>
+#include <moqt/control_parser.hpp>
+#include <moqt/data_parser.hpp>
+#include <moqt/json.hpp>
+#include <moqt/qlog.hpp>
+#include <sstream>
+#include <utility>
+
+namespace moqt {
+
+namespace {
+
+class TextFormatter : public OutputFormatter {
+public:
+    std::string format(const ValidationResult& result) const override {
+        std::string origin = result.origin.empty() ? "" : "[" + result.origin + "] ";
+        if (result.valid) return origin + result.report;
+        // In decimal, as every other format writes it
+        std::string details = "termination_code=" + std::to_string(result.termination_code);
+        // Parse error reports already end with their byte offset
+        if (result.located && result.report.find("(byte_offset=") == std::string::npos) {
+            details += ", byte_offset=" + std::to_string(result.byte_offset);
+        }
+        if (result.located) details += ", field=" + result.field;
+        return origin + result.report + " [" + details + "]";
+    }
+};
+
+std::string quoted(const std::string& text) {
+    return "\"" + json_escape(text) + "\"";
+}
+
+// A key of the result objects the JSON, NDJSON and YAML formatters write,
+// in the order they write them. result_members and result_json_schema
+// both walk this table, so the two cannot drift apart.
+struct ResultKey {
+    const char* name;
+    const char* type;  // JSON Schema type of the value
+    bool required;
+    const char* description;
+    // The value as JSON, or an empty string if result has no such key
+    std::string (*value)(const ValidationResult& result);
+};
+
+const ResultKey RESULT_KEYS[] = {
+    {"schema_version", "\"integer\"", true, "Version of this result structure",
+     [](const ValidationResult&) { return std::to_string(RESULT_SCHEMA_VERSION); }},
+    {"input", "\"string\"", true, "Hex dump of the validated bytes",
+     [](const ValidationResult& result) { return quoted(result.input); }},
+    {"origin", "\"string\"", false, "Where in a capture the message was found",
+     [](const ValidationResult& result) { return result.origin.empty() ? "" : quoted(result.origin); }},
+    {"message_type", "[\"string\", \"null\"]", true,
+     "Message or stream type the report is about, e.g. SUBSCRIBE, or null if it names none",
+     [](const ValidationResult& result) {
+         std::string message_type = result_message_type(result.report);
+         return message_type.empty() ? "null" : quoted(message_type);
+     }},
+    {"valid", "\"boolean\"", true, "Whether the message is valid",
+     [](const ValidationResult& result) -> std::string { return result.valid ? "true" : "false"; }},
+    {"termination_code", "\"integer\"", false, "Code to terminate the session with, for invalid messages",
+     [](const ValidationResult& result) { return result.valid ? "" : std::to_string(result.termination_code); }},
+    {"byte_offset", "\"integer\"", false, "Where validation of an invalid message stopped, when known",
+     [](const ValidationResult& result) { return result.located ? std::to_string(result.byte_offset) : ""; }},
+    {"field", "\"string\"", false, "Field validation of an invalid message stopped at, when known",
+     [](const ValidationResult& result) { return result.located ? quoted(result.field) : ""; }},
+    {"message", "\"object\"", false,
+     "Fields of the message once every one was read, named as in qlog events; absent otherwise",
+     [](const ValidationResult& result) { return result.message.decoded() ? message_json(result.message) : ""; }},
+    {"report", "\"string\"", true, "Descriptive report of the validator",
+     [](const ValidationResult& result) { return quoted(result.report); }},
+};
+
+// The keys of result that are present, in RESULT_KEYS order, with their
+// values as JSON
+std::vector<std::pair<std::string, std::string>> result_members(const ValidationResult& result) {
+    std::vector<std::pair<std::string, std::string>> members;
+    for (const ResultKey& key : RESULT_KEYS) {
+        std::string value = key.value(result);
+        if (!value.empty()) members.emplace_back(key.name, value);
+    }
+    return members;
+}
+
+// One message of every struct, with every field its encoder may write,
+// so that the fields they have as JSON name every field a message key
+// can hold
+std::vector<DecodedMessage> schema_samples() {
+    std::vector<Parameter> params = {{SETUP_PARAM_MAX_REQUEST_ID, 1, ""}, {0x01, 0, "/"}};
+    std::vector<std::string> ns = {"ns"};
+    ObjectFields payload{1, {0x02, 0x01}, {'a'}, 0};
+    ObjectFields status{2, {}, {}, 3};
+    return {
+        {CLIENT_SETUP, ClientSetupMessage{{1}, params}},
+        {SERVER_SETUP, ServerSetupMessage{1, params}},
+        {SUBSCRIBE, SubscribeMessage{0, 1, ns, "t", 0x80, 0, 1, FILTER_ABSOLUTE_RANGE, {1, 0}, 2, true, 1, params}},
+        {SUBSCRIBE_UPDATE, SubscribeUpdateMessage{0, {1, 0}, 2, false, 0x80, 1, params}},
+        {SUBSCRIBE_OK, SubscribeOkMessage{0, 0, 1, 1, {1, 0}, params}},
+        {SUBSCRIBE_ERROR, SubscribeErrorMessage{0, 0, "", 1}},
+        {SUBSCRIBE_DONE, SubscribeDoneMessage{0, 0, 0, ""}},
+        {FETCH_ERROR, RequestErrorMessage{0, 0, ""}},
+        {ANNOUNCE, AnnounceMessage{0, ns, params}},
+        {SUBSCRIBE_ANNOUNCES, AnnounceMessage{0, ns, params}},
+        {UNANNOUNCE, NamespaceMessage{ns}},
+        {UNSUBSCRIBE_ANNOUNCES, NamespaceMessage{ns}},
+        {MAX_REQUEST_ID, RequestIdMessage{1}},
+        {GOAWAY, GoawayMessage{""}},
+        {ANNOUNCE_CANCEL, AnnounceCancelMessage{ns, 0, ""}},
+        {TRACK_STATUS_REQUEST, TrackStatusRequestMessage{0, ns, "t", params}},
+        {TRACK_STATUS, TrackStatusMessage{0, 0, {1, 0}, params}},
+        {FETCH, FetchMessage{0, 0x80, 0, FETCH_STANDALONE, ns, "t", {1, 0}, {2, 0}, 0, 0, params}},
+        {FETCH, FetchMessage{0, 0x80, 0, FETCH_RELATIVE_JOINING, {}, "", {}, {}, 2, 1, params}},
+        {FETCH_OK, FetchOkMessage{0, 1, 0, {2, 0}, params}},
+        {0x0D, SubgroupStreamMessage{0x0D, 1, 2, 3, 0x80, {payload, status}}},
+        {FETCH_HEADER, FetchStreamMessage{0, {{2, 3, 0x80, payload}, {2, 3, 0x80, status}}}},
+        {OBJECT_DATAGRAM_EXT, ObjectDatagramMessage{OBJECT_DATAGRAM_EXT, 1, 2, 0x80, payload}},
+        {OBJECT_DATAGRAM_STATUS_EXT, ObjectDatagramMessage{OBJECT_DATAGRAM_STATUS_EXT, 1, 2, 0x80, status}},
+    };
+}
+
+const char* schema_type(const JsonValue& value) {
+    switch (value.type) {
+        case JsonValue::Number: return "integer";
+        case JsonValue::String: return "string";
+        case JsonValue::Bool: return "boolean";
+        case JsonValue::Array: return "array";
+        case JsonValue::Object: return "object";
+        default: return "null";
+    }
+}
+
+// Adds the members of object not yet in properties, with their types
+void add_properties(const JsonValue& object, std::vector<std::pair<std::string, std::string>>& properties) {
+    for (const auto& member : object.object) {
+        bool known = false;
+        for (const auto& property : properties) known = known || property.first == member.first;
+        if (!known) properties.emplace_back(member.first, schema_type(member.second));
+    }
+}
+
+std::string properties_schema(const std::vector<std::pair<std::string, std::string>>& properties,
+                              const std::string& objects) {
+    std::string out = "{";
+    for (const auto& property : properties) {
+        out += (out.size() > 1 ? ", " : "") + quoted(property.first) + ": {\"type\": " + quoted(property.second);
+        if (property.first == "objects") out += ", \"items\": " + objects;
+        out += "}";
+    }
+    return out + "}";
+}
+
+// The schema of the message key, generated from the JSON the sample
+// messages are written as
+std::string message_schema() {
+    std::vector<std::pair<std::string, std::string>> fields;
+    std::vector<std::pair<std::string, std::string>> object_fields;
+    for (const auto& sample : schema_samples()) {
+        JsonValue message = parse_json(message_json(sample));
+        add_properties(message, fields);
+        if (const JsonValue* objects = message.get("objects")) {
+            for (const auto& object : objects->array) add_properties(object, object_fields);
+        }
+    }
+    std::string objects = "{\"type\": \"object\", \"properties\": " + properties_schema(object_fields, "")
+                          + ", \"additionalProperties\": false}";
+    return properties_schema(fields, objects);
+}
+
+class JsonFormatter : public OutputFormatter {
+public:
+    std::string format(const ValidationResult& result) const override {
+        std::string out = "{\n";
+        std::vector<std::pair<std::string, std::string>> members = result_members(result);
+        for (size_t i = 0; i < members.size(); ++i) {
+            out += "  \"" + members[i].first + "\": " + members[i].second + (i + 1 < members.size() ? ",\n" : "\n");
+        }
+        return out + "}";
+    }
+};
+
+class NdjsonFormatter : public OutputFormatter {
+public:
+    std::string format(const ValidationResult& result) const override {
+        std::string out = "{";
+        std::vector<std::pair<std::string, std::string>> members = result_members(result);
+        for (size_t i = 0; i < members.size(); ++i) {
+            out += (i ? ",\"" : "\"") + members[i].first + "\":" + members[i].second;
+        }
+        return out + "}";
+    }
+};
+
+class YamlFormatter : public OutputFormatter {
+public:
+    std::string format(const ValidationResult& result) const override {
+        // JSON scalars are valid YAML, and double-quoted YAML scalars
+        // accept the same escapes as JSON strings
+        std::string out;
+        std::vector<std::pair<std::string, std::string>> members = result_members(result);
+        for (size_t i = 0; i < members.size(); ++i) {
+            out += (i ? "\n  " : "- ") + members[i].first + ": " + members[i].second;
+        }
+        return out;
+    }
+};
+
+// One line of qlog events per result, so the output appends to an
+// NDJSON qlog stream
+class QlogFormatter : public OutputFormatter {
+public:
+    std::string format(const ValidationResult& result) const override { return qlog_events(result); }
+};
+
+std::map<std::string, std::unique_ptr<OutputFormatter>>& registry() {
+    static std::map<std::string, std::unique_ptr<OutputFormatter>> formatters = [] {
+        std::map<std::string, std::unique_ptr<OutputFormatter>> builtins;
+        builtins["text"] = std::make_unique<TextFormatter>();
+        builtins["json"] = std::make_unique<JsonFormatter>();
+        builtins["yaml"] = std::make_unique<YamlFormatter>();
+        builtins["ndjson"] = std::make_unique<NdjsonFormatter>();
+        builtins["qlog"] = std::make_unique<QlogFormatter>();
+        return builtins;
+    }();
+    return formatters;
+}
+
+} // namespace
+
+ValidationResult make_result(const std::vector<uint8_t>& input, const std::string& report) {
+    size_t colon = report.find(':');
+    bool valid = colon != std::string::npos && colon > 0
+                 && report.find(' ') > colon;
+    uint64_t code = valid ? TERMINATION_NO_ERROR : TERMINATION_PROTOCOL_VIOLATION;
+    return ValidationResult{to_hex(input), report, valid, code};
+}
+
+ValidationResult make_result(const std::vector<uint8_t>& input, const std::string& report,
+                             const std::vector<ValidationIssue>& issues, const DecodedMessage& message) {
+    ValidationResult result = make_result(input, report);
+    result.message = message;
+    if (result.valid) return result;
+    for (auto it = issues.rbegin(); it != issues.rend(); ++it) {
+        if (it->severity != IssueSeverity::FATAL) continue;
+        result.termination_code = it->code;
+        result.located = true;
+        result.byte_offset = it->byte_offset;
+        result.field = it->field;
+        break;
+    }
+    return result;
+}
+
+void register_formatter(const std::string& name, std::unique_ptr<OutputFormatter> formatter) {
+    registry()[name] = std::move(formatter);
+}
+
+const OutputFormatter* find_formatter(const std::string& name) {
+    auto it = registry().find(name);
+    return it == registry().end() ? nullptr : it->second.get();
+}
+
+std::string result_message_type(const std::string& report) {
+    size_t end = report.find_first_of(": ");
+    if (end == std::string::npos || end < 2) return "";
+    for (size_t i = 0; i < end; ++i) {
+        char c = report[i];
+        if (!(c >= 'A' && c <= 'Z') && !(c >= '0' && c <= '9') && c != '_') return "";
+    }
+    return report.substr(0, end);
+}
+
+std::string result_json_schema() {
+    std::ostringstream out;
+    out << "{\n"
+        << "  \"$schema\": \"https://json-schema.org/draft/2020-12/schema\",\n"
+        << "  \"title\": \"MoQT validation result, version " << RESULT_SCHEMA_VERSION << "\",\n"
+        << "  \"type\": \"object\",\n"
+        << "  \"properties\": {\n";
+    std::string required;
+    size_t count = sizeof(RESULT_KEYS) / sizeof(RESULT_KEYS[0]);
+    for (size_t i = 0; i < count; ++i) {
+        const ResultKey& key = RESULT_KEYS[i];
+        out << "    \"" << key.name << "\": {\"type\": " << key.type;
+        if (std::string(key.name) == "schema_version") out << ", \"const\": " << RESULT_SCHEMA_VERSION;
+        if (std::string(key.name) == "message") {
+            out << ", \"properties\": " << message_schema() << ", \"additionalProperties\": false";
+        }
+        out << ", \"description\": " << quoted(key.description) << "}" << (i + 1 < count ? ",\n" : "\n");
+        if (key.required) required += std::string(required.empty() ? "" : ", ") + "\"" + key.name + "\"";
+    }
+    out << "  },\n"
+        << "  \"required\": [" << required << "],\n"
+        << "  \"additionalProperties\": false\n"
+        << "}\n";
+    return out.str();
+}
+
+std::vector<std::string> formatter_names() {
+    std::vector<std::string> names;
+    for (const auto& entry : registry()) names.push_back(entry.first);
+    return names;
+}
+
+} // namespace moqt
@@ -0,0 +1,93 @@
+// golden.cpp
+// Golden file serialization and line diffs
+
+#include <moqt/golden.hpp>
+#include <moqt/json.hpp>
+#include <algorithm>
+#include <sstream>
+#include <stdexcept>
+
+namespace moqt {
+
+namespace {
+
+std::vector<std::string> split_lines(const std::string& text) {
+    std::vector<std::string> lines;
+    std::istringstream in(text);
+    std::string line;
+    while (std::getline(in, line)) lines.push_back(line);
+    return lines;
+}
+
+const JsonValue& require_member(const JsonValue& entry, size_t index, const std::string& key, JsonValue::Type type) {
+    const JsonValue* member = entry.get(key);
+    if (!member || member->type != type) {
+        throw std::runtime_error("golden result " + std::to_string(index) + " has no valid \"" + key + "\"");
+    }
+    return *member;
+}
+
+} // namespace
+
+std::string golden_json(const std::vector<ValidationResult>& results) {
+    std::ostringstream out;
+    out << "[\n";
+    for (size_t i = 0; i < results.size(); ++i) {
+        const ValidationResult& result = results[i];
+        out << "  {\"input\": \"" << json_escape(result.input) << "\", "
+            << "\"valid\": " << (result.valid ? "true" : "false") << ", "
+            << "\"report\": \"" << json_escape(result.report) << "\"}"
+            << (i + 1 < results.size() ? "," : "") << "\n";
+    }
+    out << "]\n";
+    return out.str();
+}
+
+std::vector<ValidationResult> read_golden(const std::string& json_text) {
+    JsonValue document = parse_json(json_text);
+    if (document.type != JsonValue::Array) throw std::runtime_error("golden file is not a JSON array");
+    std::vector<ValidationResult> results;
+    for (size_t i = 0; i < document.array.size(); ++i) {
+        const JsonValue& entry = document.array[i];
+        ValidationResult result;
+        result.input = require_member(entry, i, "input", JsonValue::String).string;
+        result.valid = require_member(entry, i, "valid", JsonValue::Bool).boolean;
+        result.report = require_member(entry, i, "report", JsonValue::String).string;
+        results.push_back(result);
+    }
+    return results;
+}
+
+std::string golden_diff(const std::string& expected, const std::string& actual) {
+    std::vector<std::string> a = split_lines(expected);
+    std::vector<std::string> b = split_lines(actual);
+    // common[i][j] is the longest common subsequence of a[i..] and b[j..]
+    std::vector<std::vector<size_t>> common(a.size() + 1, std::vector<size_t>(b.size() + 1, 0));
+    for (size_t i = a.size(); i-- > 0;) {
+        for (size_t j = b.size(); j-- > 0;) {
+            common[i][j] = a[i] == b[j] ? common[i + 1][j + 1] + 1 : std::max(common[i + 1][j], common[i][j + 1]);
+        }
+    }
+    std::ostringstream out;
+    size_t i = 0;
+    size_t j = 0;
+    bool in_hunk = false;
+    while (i < a.size() || j < b.size()) {
+        if (i < a.size() && j < b.size() && a[i] == b[j]) {
+            in_hunk = false;
+            ++i;
+            ++j;
+            continue;
+        }
+        if (!in_hunk) out << "@@ line " << i + 1 << "\n";
+        in_hunk = true;
+        if (j == b.size() || (i < a.size() && common[i + 1][j] >= common[i][j + 1])) {
+            out << "-" << a[i++] << "\n";
+        } else {
+            out << "+" << b[j++] << "\n";
+        }
+    }
+    return out.str();
+}
+
+} // namespace moqt
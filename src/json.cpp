@@ -0,0 +1,200 @@
+// json.cpp
+// Recursive-descent JSON reader
+
+#include <moqt/json.hpp>
+#include <cctype>
+#include <cstdio>
+#include <cstdlib>
+#include <stdexcept>
+
+namespace moqt {
+
+namespace {
+
+class JsonReader {
+public:
+    explicit JsonReader(const std::string& text) : text_(text) {}
+
+    JsonValue read_document() {
+        JsonValue value = read_value();
+        skip_whitespace();
+        if (pos_ != text_.size()) fail("trailing characters");
+        return value;
+    }
+
+private:
+    const std::string& text_;
+    size_t pos_ = 0;
+
+    [[noreturn]] void fail(const std::string& what) const {
+        throw std::runtime_error("JSON error at offset " + std::to_string(pos_) + ": " + what);
+    }
+
+    void skip_whitespace() {
+        while (pos_ < text_.size() && std::isspace(static_cast<unsigned char>(text_[pos_]))) ++pos_;
+    }
+
+    char peek() {
+        skip_whitespace();
+        if (pos_ >= text_.size()) fail("unexpected end of input");
+        return text_[pos_];
+    }
+
+    void expect(char c) {
+        if (peek() != c) fail(std::string("expected '") + c + "'");
+        ++pos_;
+    }
+
+    void expect_word(const std::string& word) {
+        if (text_.compare(pos_, word.size(), word) != 0) fail("expected " + word);
+        pos_ += word.size();
+    }
+
+    JsonValue read_value() {
+        JsonValue value;
+        char c = peek();
+        if (c == '{') {
+            value.type = JsonValue::Object;
+            ++pos_;
+            if (peek() == '}') {
+                ++pos_;
+                return value;
+            }
+            while (true) {
+                if (peek() != '"') fail("expected member name");
+                std::string key = read_string();
+                expect(':');
+                value.object.emplace_back(key, read_value());
+                if (peek() == ',') {
+                    ++pos_;
+                    continue;
+                }
+                expect('}');
+                return value;
+            }
+        }
+        if (c == '[') {
+            value.type = JsonValue::Array;
+            ++pos_;
+            if (peek() == ']') {
+                ++pos_;
+                return value;
+            }
+            while (true) {
+                value.array.push_back(read_value());
+                if (peek() == ',') {
+                    ++pos_;
+                    continue;
+                }
+                expect(']');
+                return value;
+            }
+        }
+        if (c == '"') {
+            value.type = JsonValue::String;
+            value.string = read_string();
+            return value;
+        }
+        if (c == 't' || c == 'f') {
+            value.type = JsonValue::Bool;
+            value.boolean = c == 't';
+            expect_word(value.boolean ? "true" : "false");
+            return value;
+        }
+        if (c == 'n') {
+            expect_word("null");
+            return value;
+        }
+        if (c == '-' || std::isdigit(static_cast<unsigned char>(c))) {
+            const char* start = text_.c_str() + pos_;
+            char* end = nullptr;
+            value.type = JsonValue::Number;
+            value.number = std::strtod(start, &end);
+            pos_ += static_cast<size_t>(end - start);
+            return value;
+        }
+        fail(std::string("unexpected character '") + c + "'");
+    }
+
+    std::string read_string() {
+        expect('"');
+        std::string out;
+        while (true) {
+            if (pos_ >= text_.size()) fail("unterminated string");
+            char c = text_[pos_++];
+            if (c == '"') return out;
+            if (c != '\\') {
+                out += c;
+                continue;
+            }
+            if (pos_ >= text_.size()) fail("unterminated escape");
+            char e = text_[pos_++];
+            switch (e) {
+                case '"': out += '"'; break;
+                case '\\': out += '\\'; break;
+                case '/': out += '/'; break;
+                case 'b': out += '\b'; break;
+                case 'f': out += '\f'; break;
+                case 'n': out += '\n'; break;
+                case 'r': out += '\r'; break;
+                case 't': out += '\t'; break;
+                case 'u': {
+                    if (pos_ + 4 > text_.size()) fail("short \\u escape");
+                    unsigned long cp = std::strtoul(text_.substr(pos_, 4).c_str(), nullptr, 16);
+                    pos_ += 4;
+                    // Encode the BMP code point as UTF-8; surrogate pairs are left as-is
+                    if (cp < 0x80) {
+                        out += static_cast<char>(cp);
+                    } else if (cp < 0x800) {
+                        out += static_cast<char>(0xC0 | (cp >> 6));
+                        out += static_cast<char>(0x80 | (cp & 0x3F));
+                    } else {
+                        out += static_cast<char>(0xE0 | (cp >> 12));
+                        out += static_cast<char>(0x80 | ((cp >> 6) & 0x3F));
+                        out += static_cast<char>(0x80 | (cp & 0x3F));
+                    }
+                    break;
+                }
+                default:
+                    fail(std::string("invalid escape '\\") + e + "'");
+            }
+        }
+    }
+};
+
+} // namespace
+
+const JsonValue* JsonValue::get(const std::string& key) const {
+    if (type != Object) return nullptr;
+    for (const auto& member : object) {
+        if (member.first == key) return &member.second;
+    }
+    return nullptr;
+}
+
+JsonValue parse_json(const std::string& text) {
+    return JsonReader(text).read_document();
+}
+
+std::string json_escape(const std::string& s) {
+    std::string out;
+    for (char c : s) {
+        switch (c) {
+            case '"': out += "\\\""; break;
+            case '\\': out += "\\\\"; break;
+            case '\n': out += "\\n"; break;
+            case '\t': out += "\\t"; break;
+            default:
+                if (static_cast<unsigned char>(c) < 0x20) {
+                    char buf[7];
+                    std::snprintf(buf, sizeof(buf), "\\u%04x", c);
+                    out += buf;
+                } else {
+                    out += c;
+                }
+        }
+    }
+    return out;
+}
+
+} // namespace moqt
@@ -1,24 +1,472 @@
 // main.cpp
-// CLI test driver for MoQT control message validator
+// CLI driver for MoQT control message validator
+//
+// Usage: moqt_validator [-format text|json|yaml|ndjson|qlog] [-checksum crc32] [-count-only]
+//                       [-qlog FILE] [-announce-summary] [-request-summary] [-strict]
+//                       [-allow-trailing] [-legacy-setup] [-transport quic|webtransport]
+//                       [-role client|server] [-control-stream] [-live]
+//                       [-batch FILE [-type control|stream|datagram]]
+//                       [-pcap FILE [-keylog FILE]]
+//                       [-annotate [-color] [-type control|stream|datagram]]
+//                       [-golden FILE [-update-golden]] [HEX_MESSAGE...]
+//        moqt_validator template MESSAGE [FILTER_TYPE]
+//        moqt_validator -schema
+// Each HEX_MESSAGE is validated in order against one session. Without
+// messages a few built-in samples are validated instead.
+//
+// With -checksum crc32 every message must end in a 4-byte big-endian
+// CRC-32 (IEEE) of the preceding bytes; it is checked and stripped before
+// the inner MoQT message is validated.
+//
+// With -control-stream every argument is a whole control stream of
+// length-prefixed messages, and each message in it is reported.
+//
+// With -live a binary control stream is read from standard input instead,
+// such as one piped from a QUIC client, and each message is reported as
+// soon as all of its bytes have arrived. The exit status is 1 if any
+// message failed or the stream ended inside one.
+//
+// With -count-only every message is a subgroup or fetch stream, and only
+// its object count, group range and byte totals are reported.
+//
+// With -qlog the raw bytes of every event in FILE are validated instead,
+// and recorded fields that disagree with the decode are reported.
+//
+// With -batch every line of FILE is a hex message instead, optionally
+// prefixed with control:, stream: or datagram:; unprefixed lines are of
+// the -type kind (default control). '#' starts a comment. A pass/fail
+// summary goes to stderr and the exit status is 1 if any message failed.
+//
+// With -pcap the MoQT sessions over raw QUIC in a pcap or pcapng FILE
+// are validated instead: 1-RTT packets are decrypted with the secrets in
+// the -keylog file (default $SSLKEYLOGFILE), each stream is reassembled,
+// and every result names the stream, capture frame and packet number it
+// came from. What could not be validated is listed on stderr.
+//
+// With -annotate every message is printed as a hex dump instead, each
+// field's bytes labelled and bracketed with its byte range; -color sets
+// each field in its own color. Messages are control messages, or with
+// -type stream or datagram data messages. -control-stream annotates every
+// message of each stream, with its type and length.
+//
+// With -transport the PATH setup parameter is checked for that transport:
+// required in CLIENT_SETUP over raw QUIC, forbidden over WebTransport.
+//
+// With -role every message is taken as sent by that endpoint, so request
+// ID parity and which messages it may send are checked for it.
+//
+// Message types and lengths encoded in more bytes than needed are always
+// rejected; with -strict every other varint is held to that too.
+// With -allow-trailing bytes left after the last field of a control
+// message are accepted instead of reported as a protocol violation.
+// With -legacy-setup the SETUP types of drafts before 11 (0x01, 0x40 and
+// 0x41) are validated too, and their reports name the legacy type. On
+// control streams 0x40 and 0x41 and the messages after them are framed
+// with the varint lengths of drafts 07 to 10.
+//
+// Every output format gives an invalid message the numeric termination
+// code an endpoint would close the session with, and where known the byte
+// offset and field validation stopped at.
+//
+// With -announce-summary the announced namespaces and subscribed prefixes
+// left in the session, and which prefixes route which namespaces, are
+// printed after the last message. -request-summary likewise prints the
+// outstanding requests and the maximum Request ID granted each way.
+//
+// With -golden the results are compared with those stored in FILE instead
+// of being printed; on a mismatch a line diff is written to stderr and the
+// exit status is 1. -update-golden rewrites FILE with the current results.
+//
+// -format qlog writes each result as qlog "moqt" events instead, one per
+// line, that can be appended to an NDJSON qlog trace: the decoded fields
+// and raw bytes of every message, and one event per object of a stream.
+// With -pcap each event is timed by the frame that completed its message.
+//
+// -schema prints a JSON Schema for the result objects of -format json
+// and ndjson. Each carries schema_version and message_type keys, and a
+// message object of the decoded fields once every field was read.
+//
+// The template subcommand prints a sample control message as commented
+// hex; FILTER_TYPE selects the SUBSCRIBE filter fields (default 2).
 
+#include <moqt/annotate.hpp>
+#include <moqt/batch.hpp>
+#include <moqt/common.hpp>
+#include <moqt/data_parser.hpp>
+#include <moqt/formatter.hpp>
+#include <moqt/golden.hpp>
+#include <moqt/message_template.hpp>
+#include <moqt/pcap.hpp>
+#include <moqt/qlog.hpp>
+#include <moqt/session_report.hpp>
 #include <moqt/validator.hpp>
+#include <cstdlib>
+#include <fstream>
+#include <iterator>
 #include <iostream>
+#include <sstream>
+#include <stdexcept>
+#include <string>
 #include <vector>
 
-int main() {
+namespace {
+
+void usage() {
+    std::cerr << "usage: moqt_validator [-format";
+    for (const auto& name : moqt::formatter_names()) std::cerr << " " << name;
+    std::cerr << "] [-checksum crc32] [-count-only] [-qlog FILE] [-announce-summary] [-request-summary]\n"
+              << "                      [-strict] [-allow-trailing] [-legacy-setup] [-transport quic|webtransport]\n"
+              << "                      [-role client|server] [-control-stream] [-live]\n"
+              << "                      [-batch FILE [-type control|stream|datagram]]\n"
+              << "                      [-pcap FILE [-keylog FILE]]\n"
+              << "                      [-annotate [-color] [-type control|stream|datagram]]\n"
+              << "                      [-golden FILE [-update-golden]] [HEX_MESSAGE...]\n";
+    std::cerr << "       moqt_validator template MESSAGE [FILTER_TYPE]\n";
+    std::cerr << "       moqt_validator -schema\n";
+    std::cerr << "templates:";
+    for (const auto& name : moqt::template_names()) std::cerr << " " << name;
+    std::cerr << "\n";
+}
+
+// Compares results with the golden file at path, or rewrites it when
+// update is set. Returns the process exit status.
+int check_golden(const std::string& path, bool update, const std::vector<moqt::ValidationResult>& results) {
+    std::string actual = moqt::golden_json(results);
+    if (update) {
+        std::ofstream file(path);
+        if (!(file << actual)) {
+            std::cerr << "cannot write " << path << "\n";
+            return 2;
+        }
+        return 0;
+    }
+    std::ifstream file(path);
+    if (!file) {
+        std::cerr << "cannot open " << path << "\n";
+        return 2;
+    }
+    std::stringstream text;
+    text << file.rdbuf();
+    std::string expected;
+    try {
+        expected = moqt::golden_json(moqt::read_golden(text.str()));
+    } catch (const std::exception& e) {
+        std::cerr << path << ": " << e.what() << "\n";
+        return 2;
+    }
+    std::string diff = moqt::golden_diff(expected, actual);
+    if (diff.empty()) return 0;
+    std::cerr << "results differ from " << path << "\n" << diff;
+    return 1;
+}
+
+int print_template(int argc, char* argv[]) {
+    if (argc < 3 || argc > 4) {
+        usage();
+        return 2;
+    }
+    try {
+        uint64_t filter_type = moqt::FILTER_LATEST_OBJECT;
+        if (argc == 4) filter_type = std::stoull(argv[3], nullptr, 0);
+        std::cout << moqt::message_template(argv[2], filter_type);
+    } catch (const std::exception& e) {
+        std::cerr << e.what() << "\n";
+        return 2;
+    }
+    return 0;
+}
+
+} // namespace
+
+int main(int argc, char* argv[]) {
     using namespace moqt;
 
-    // Test SUBSCRIBE: type=0x03, request_id=5, track_alias=7
-    std::vector<uint8_t> msg1 = {0x03, 0x05, 0x07};
-    std::cout << validate_control_message(msg1) << std::endl;
+    if (argc > 1 && std::string(argv[1]) == "template") return print_template(argc, argv);
+
+    std::string format = "text";
+    std::string checksum;
+    bool count_only = false;
+    bool control_stream = false;
+    bool announce_summary = false;
+    bool request_summary = false;
+    ValidationOptions options;
+    Direction direction = DIRECTION_UNKNOWN;
+    std::string qlog_path;
+    std::string golden_path;
+    std::string batch_path;
+    std::string pcap_path;
+    std::string keylog_path = std::getenv("SSLKEYLOGFILE") ? std::getenv("SSLKEYLOGFILE") : "";
+    BatchKind batch_kind = BatchKind::CONTROL;
+    bool update_golden = false;
+    bool live = false;
+    bool annotate = false;
+    bool color = false;
+    std::vector<std::vector<uint8_t>> messages;
+    try {
+        for (int i = 1; i < argc; ++i) {
+            std::string arg = argv[i];
+            if (arg == "-format" || arg == "--format") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                format = argv[i];
+            } else if (arg == "-checksum" || arg == "--checksum") {
+                if (++i >= argc || std::string(argv[i]) != "crc32") {
+                    usage();
+                    return 2;
+                }
+                checksum = argv[i];
+            } else if (arg == "-qlog" || arg == "--qlog") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                qlog_path = argv[i];
+            } else if (arg == "-golden" || arg == "--golden") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                golden_path = argv[i];
+            } else if (arg == "-batch" || arg == "--batch") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                batch_path = argv[i];
+            } else if (arg == "-pcap" || arg == "--pcap") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                pcap_path = argv[i];
+            } else if (arg == "-keylog" || arg == "--keylog") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                keylog_path = argv[i];
+            } else if (arg == "-type" || arg == "--type") {
+                if (++i >= argc) {
+                    usage();
+                    return 2;
+                }
+                batch_kind = parse_batch_kind(argv[i]);
+            } else if (arg == "-update-golden" || arg == "--update-golden") {
+                update_golden = true;
+            } else if (arg == "-count-only" || arg == "--count-only") {
+                count_only = true;
+            } else if (arg == "-control-stream" || arg == "--control-stream") {
+                control_stream = true;
+            } else if (arg == "-live" || arg == "--live") {
+                live = true;
+            } else if (arg == "-annotate" || arg == "--annotate") {
+                annotate = true;
+            } else if (arg == "-color" || arg == "--color") {
+                color = true;
+            } else if (arg == "-role" || arg == "--role") {
+                std::string role = ++i < argc ? argv[i] : "";
+                if (role != "client" && role != "server") {
+                    usage();
+                    return 2;
+                }
+                direction = role == "client" ? CLIENT_TO_SERVER : SERVER_TO_CLIENT;
+            } else if (arg == "-transport" || arg == "--transport") {
+                std::string transport = ++i < argc ? argv[i] : "";
+                if (transport != "quic" && transport != "webtransport") {
+                    usage();
+                    return 2;
+                }
+                options.transport = transport == "quic" ? Transport::QUIC : Transport::WEBTRANSPORT;
+            } else if (arg == "-strict" || arg == "--strict") {
+                options.canonical_varints = true;
+            } else if (arg == "-allow-trailing" || arg == "--allow-trailing") {
+                options.allow_trailing_bytes = true;
+            } else if (arg == "-legacy-setup" || arg == "--legacy-setup") {
+                options.accept_legacy_setup = true;
+            } else if (arg == "-announce-summary" || arg == "--announce-summary") {
+                announce_summary = true;
+            } else if (arg == "-request-summary" || arg == "--request-summary") {
+                request_summary = true;
+            } else if (arg == "-schema" || arg == "--schema") {
+                std::cout << result_json_schema();
+                return 0;
+            } else if (arg == "-h" || arg == "--help") {
+                usage();
+                return 0;
+            } else {
+                messages.push_back(moqt::from_hex(arg));
+            }
+        }
+    } catch (const std::exception& e) {
+        std::cerr << e.what() << "\n";
+        return 2;
+    }
+
+    if (update_golden && golden_path.empty()) {
+        usage();
+        return 2;
+    }
+
+    const OutputFormatter* formatter = find_formatter(format);
+    if (!formatter) {
+        std::cerr << "unknown format: " << format << "\n";
+        usage();
+        return 2;
+    }
+
+    std::vector<ValidationResult> results;
+    if (!qlog_path.empty()) {
+        std::ifstream file(qlog_path);
+        if (!file) {
+            std::cerr << "cannot open " << qlog_path << "\n";
+            return 2;
+        }
+        std::stringstream text;
+        text << file.rdbuf();
+        try {
+            for (const auto& verdict : validate_qlog(text.str())) {
+                std::string report = verdict.report;
+                if (!verdict.mismatches.empty()) {
+                    std::string joined;
+                    for (const auto& mismatch : verdict.mismatches) joined += (joined.empty() ? "" : "; ") + mismatch;
+                    report = "Qlog mismatch in event " + std::to_string(verdict.event.index) + ": " + joined
+                             + " (" + verdict.report + ")";
+                }
+                results.push_back(make_result(verdict.event.raw, report, verdict.issues, verdict.message));
+            }
+        } catch (const std::exception& e) {
+            std::cerr << qlog_path << ": " << e.what() << "\n";
+            return 2;
+        }
+        if (!golden_path.empty()) return check_golden(golden_path, update_golden, results);
+        for (const auto& result : results) std::cout << formatter->format(result) << std::endl;
+        return 0;
+    }
+
+    if (!pcap_path.empty()) {
+        std::ifstream file(pcap_path, std::ios::binary);
+        if (!file) {
+            std::cerr << "cannot open " << pcap_path << "\n";
+            return 2;
+        }
+        std::ifstream keylog(keylog_path);
+        if (keylog_path.empty() || !keylog) {
+            std::cerr << (keylog_path.empty() ? "-pcap needs -keylog or SSLKEYLOGFILE" : "cannot open " + keylog_path)
+                      << "\n";
+            return 2;
+        }
+        std::stringstream keylog_text;
+        keylog_text << keylog.rdbuf();
+        TrafficSecrets secrets;
+        try {
+            secrets = read_keylog(keylog_text.str());
+        } catch (const std::exception& e) {
+            std::cerr << keylog_path << ": " << e.what() << "\n";
+            return 2;
+        }
+        CaptureValidation capture;
+        try {
+            std::vector<uint8_t> bytes((std::istreambuf_iterator<char>(file)), std::istreambuf_iterator<char>());
+            capture = validate_capture(read_capture(bytes), secrets, options);
+        } catch (const std::exception& e) {
+            std::cerr << pcap_path << ": " << e.what() << "\n";
+            return 2;
+        }
+        for (const auto& note : capture.notes) std::cerr << pcap_path << ": " << note << "\n";
+        if (!golden_path.empty()) return check_golden(golden_path, update_golden, capture.results);
+        for (const auto& result : capture.results) std::cout << formatter->format(result) << std::endl;
+        return 0;
+    }
+
+    if (!batch_path.empty()) {
+        std::ifstream file(batch_path);
+        if (!file) {
+            std::cerr << "cannot open " << batch_path << "\n";
+            return 2;
+        }
+        std::stringstream text;
+        text << file.rdbuf();
+        std::vector<BatchEntry> entries;
+        try {
+            entries = read_batch(text.str(), batch_kind);
+        } catch (const std::exception& e) {
+            std::cerr << batch_path << ": " << e.what() << "\n";
+            return 2;
+        }
+        results = validate_batch(entries, options);
+        if (!golden_path.empty()) return check_golden(golden_path, update_golden, results);
+        for (const auto& result : results) std::cout << formatter->format(result) << std::endl;
+        std::cerr << batch_path << ": " << batch_summary(entries, results) << "\n";
+        for (const auto& result : results) {
+            if (!result.valid) return 1;
+        }
+        return 0;
+    }
+
+    if (live) {
+        SessionState state;
+        bool failed = false;
+        std::string error = validate_control_stream_live(std::cin, state, [&](const ValidationResult& result) {
+            std::cout << formatter->format(result) << std::endl;
+            failed = failed || !result.valid;
+        }, direction, options);
+        if (!error.empty()) std::cerr << error << "\n";
+        return failed || !error.empty() ? 1 : 0;
+    }
 
-    // Test CLIENT_SETUP: type=0x01, 1 version (0x01), param=0x01:"/test"
-    std::vector<uint8_t> msg2 = {0x01, 0x01, 0x01, 0x01, 0x05, '/', 't', 'e', 's', 't'};
-    std::cout << validate_control_message(msg2) << std::endl;
+    if (messages.empty()) {
+        // CLIENT_SETUP: type=0x20, 1 version (0x01), 1 param, PATH="/test"
+        messages.push_back({0x20, 0x01, 0x01, 0x01, 0x01, 0x05, '/', 't', 'e', 's', 't'});
+        // SERVER_SETUP: type=0x21, version=0x01, 1 param, MAX_REQUEST_ID=10
+        messages.push_back({0x21, 0x01, 0x01, 0x02, 0x0A});
+        // SUBSCRIBE: type=0x03, request_id=4, track_alias=7, track foo/bar,
+        // priority=0x80, default group order, forward, LATEST_OBJECT, no params
+        messages.push_back({0x03, 0x04, 0x07, 0x01, 0x03, 'f', 'o', 'o', 0x03, 'b', 'a', 'r',
+                            0x80, 0x00, 0x01, 0x02, 0x00});
+    }
 
-    // Test SERVER_SETUP: type=0x02, version=0x01, param=0x02:"ok"
-    std::vector<uint8_t> msg3 = {0x02, 0x01, 0x02, 0x02, 'o', 'k'};
-    std::cout << validate_control_message(msg3) << std::endl;
+    SessionState state;
+    if (annotate) {
+        for (const auto& message : messages) {
+            std::vector<AnnotatedMessage> annotated;
+            if (control_stream) {
+                annotated = annotate_control_stream(message, state, direction, options);
+            } else if (batch_kind == BatchKind::CONTROL) {
+                annotated.push_back(annotate_control_message(message, state, direction, options));
+            } else {
+                annotated.push_back(annotate_data_message(message, state, options));
+            }
+            for (const auto& entry : annotated) std::cout << format_annotated(entry, color) << std::endl;
+        }
+        return 0;
+    }
+    for (const auto& message : messages) {
+        if (control_stream) {
+            ControlStreamResult result = validate_control_stream(message, state, direction, options);
+            results.insert(results.end(), result.messages.begin(), result.messages.end());
+            if (!result.error.empty()) std::cerr << result.error << "\n";
+            continue;
+        }
+        std::string report;
+        std::vector<ValidationIssue> issues;
+        DecodedMessage decoded;
+        try {
+            std::vector<uint8_t> inner = checksum.empty() ? message : strip_crc32(message);
+            ScopedIssueCollector locator(&issues, false);
+            ScopedMessageRecorder fields(&decoded);
+            report = count_only ? count_stream_objects(inner)
+                                : validate_control_message(inner, state, direction, options);
+        } catch (const ChecksumMismatch& e) {
+            report = std::string("Checksum mismatch: ") + e.what();
+        }
+        results.push_back(make_result(message, report, issues, decoded));
+    }
+    if (!golden_path.empty()) return check_golden(golden_path, update_golden, results);
+    for (const auto& result : results) std::cout << formatter->format(result) << std::endl;
+    if (announce_summary) std::cout << announce_routing_report(state);
+    if (request_summary) std::cout << request_limit_report(state);
 
     return 0;
 }
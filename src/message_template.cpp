@@ -0,0 +1,156 @@
+// message_template.cpp
+// Sample messages behind the template subcommand
+
+#include <moqt/message_template.hpp>
+#include <moqt/encoder.hpp>
+#include <cstdio>
+#include <sstream>
+#include <stdexcept>
+#include <utility>
+
+namespace moqt {
+
+namespace {
+
+// One sample per template, in type order. Together they form a session:
+// SERVER_SETUP grants request IDs below 10, each request uses request ID
+// 0 and each reply answers it, and REQUESTS_BLOCKED reports the granted
+// maximum.
+const std::vector<std::pair<const char*, DecodedMessage>>& samples() {
+    const std::vector<std::string> ns = {"ns"};
+    static const std::vector<std::pair<const char*, DecodedMessage>> table = {
+        {"subscribe_update", {SUBSCRIBE_UPDATE, SubscribeUpdateMessage{0, {1, 0}, 0, true, 0x80, 1, {}}}},
+        {"subscribe", {SUBSCRIBE, SubscribeMessage{0, 1, ns, "track", 0x80, 0, 1, FILTER_LATEST_OBJECT, {1, 0}, 2,
+                                                   false, 0, {}}}},
+        {"subscribe_ok", {SUBSCRIBE_OK, SubscribeOkMessage{0, 0, 1, 0, {}, {}}}},
+        {"subscribe_error", {SUBSCRIBE_ERROR, SubscribeErrorMessage{0, 0, "", 1}}},
+        {"announce", {ANNOUNCE, AnnounceMessage{0, ns, {}}}},
+        {"announce_ok", {ANNOUNCE_OK, RequestIdMessage{0}}},
+        {"announce_error", {ANNOUNCE_ERROR, RequestErrorMessage{0, 0, ""}}},
+        {"unannounce", {UNANNOUNCE, NamespaceMessage{ns}}},
+        {"unsubscribe", {UNSUBSCRIBE, RequestIdMessage{0}}},
+        {"subscribe_done", {SUBSCRIBE_DONE, SubscribeDoneMessage{0, 0, 0, ""}}},
+        {"announce_cancel", {ANNOUNCE_CANCEL, AnnounceCancelMessage{ns, 0, ""}}},
+        {"track_status_request", {TRACK_STATUS_REQUEST, TrackStatusRequestMessage{0, ns, "track", {}}}},
+        {"track_status", {TRACK_STATUS, TrackStatusMessage{0, TRACK_STATUS_IN_PROGRESS, {1, 0}, {}}}},
+        {"goaway", {GOAWAY, GoawayMessage{""}}},
+        {"subscribe_announces", {SUBSCRIBE_ANNOUNCES, AnnounceMessage{0, ns, {}}}},
+        {"subscribe_announces_ok", {SUBSCRIBE_ANNOUNCES_OK, RequestIdMessage{0}}},
+        {"subscribe_announces_error", {SUBSCRIBE_ANNOUNCES_ERROR, RequestErrorMessage{0, 0, ""}}},
+        {"unsubscribe_announces", {UNSUBSCRIBE_ANNOUNCES, NamespaceMessage{ns}}},
+        {"max_request_id", {MAX_REQUEST_ID, RequestIdMessage{20}}},
+        {"fetch", {FETCH, FetchMessage{0, 0x80, 0, FETCH_STANDALONE, ns, "track", {1, 0}, {2, 0}, 0, 0, {}}}},
+        {"fetch_cancel", {FETCH_CANCEL, RequestIdMessage{0}}},
+        {"fetch_ok", {FETCH_OK, FetchOkMessage{0, 1, 0, {2, 0}, {}}}},
+        {"fetch_error", {FETCH_ERROR, RequestErrorMessage{0, 0, ""}}},
+        {"requests_blocked", {REQUESTS_BLOCKED, RequestIdMessage{10}}},
+        {"client_setup", {CLIENT_SETUP, ClientSetupMessage{{DRAFT_VERSION_BASE + 11}, {}}}},
+        {"server_setup", {SERVER_SETUP, ServerSetupMessage{DRAFT_VERSION_BASE + 11,
+                                                           {{SETUP_PARAM_MAX_REQUEST_ID, 10, ""}}}}},
+    };
+    return table;
+}
+
+std::string varint_hex(uint64_t value) {
+    std::vector<uint8_t> bytes;
+    write_varint(bytes, value);
+    return to_hex(bytes);
+}
+
+std::string text_hex(const std::string& value) {
+    std::string hex = varint_hex(value.size());
+    if (!value.empty()) hex += " " + to_hex(std::vector<uint8_t>(value.begin(), value.end()));
+    return hex;
+}
+
+void line(std::ostringstream& out, const std::string& bytes, const std::string& comment) {
+    out << bytes << std::string(bytes.size() < 12 ? 12 - bytes.size() : 1, ' ') << "# " << comment << "\n";
+}
+
+// Writes each field the encoder would write as one commented line of its
+// bytes, so the template is the sample message itself
+class TemplateWriter : public FieldVisitor {
+public:
+    explicit TemplateWriter(std::ostringstream& out) : out_(out) {}
+
+    void varint(const char* name, uint64_t value) override {
+        std::string field = name;
+        if (field == "filter_type") field += " " + filter_type_name(value);
+        line(out_, varint_hex(value), field + " (varint)");
+    }
+    void byte(const char* name, uint8_t value) override {
+        line(out_, to_hex(std::vector<uint8_t>{value}), std::string(name) + " (8 bits)");
+    }
+    void text(const char* name, const std::string& value) override {
+        line(out_, text_hex(value), std::string(name) + " length (varint) then bytes");
+    }
+    void tuple(const char* name, const std::vector<std::string>& value) override {
+        line(out_, varint_hex(value.size()), std::string(name) + " field count (varint)");
+        for (const auto& field : value) {
+            line(out_, text_hex(field), std::string(name) + " field: length (varint) then bytes");
+        }
+    }
+    void varints(const char* name, const std::vector<uint64_t>& value) override {
+        line(out_, varint_hex(value.size()), std::string(name) + " count (varint)");
+        for (uint64_t item : value) line(out_, varint_hex(item), std::string(name) + " entry (varint)");
+    }
+    void location(const char* name, const Location& value) override {
+        line(out_, varint_hex(value.group), std::string(name) + " group (varint)");
+        line(out_, varint_hex(value.object), std::string(name) + " object (varint)");
+    }
+    void parameters(const char*, const std::vector<Parameter>& value) override {
+        line(out_, varint_hex(value.size()), "number of parameters (varint)");
+        for (const auto& param : value) {
+            if (param.type % 2 == 0) {
+                line(out_, varint_hex(param.type) + " " + varint_hex(param.value),
+                     "parameter: even type (varint) then value (varint)");
+            } else {
+                line(out_, varint_hex(param.type) + " " + text_hex(param.bytes),
+                     "parameter: odd type (varint) then length (varint) and bytes");
+            }
+        }
+        if (!value.empty()) return;
+        line(out_, "", "each parameter: even type (varint) then value (varint), or");
+        line(out_, "", "odd type (varint) then length (varint) and bytes");
+    }
+    // Control messages carry no objects
+    void extensions(const char*, const std::vector<uint8_t>&) override {}
+    void payload(const char*, const std::vector<uint8_t>&) override {}
+
+private:
+    std::ostringstream& out_;
+};
+
+} // namespace
+
+std::string message_template(const std::string& message, uint64_t filter_type) {
+    for (const auto& sample : samples()) {
+        if (message != sample.first) continue;
+        DecodedMessage fields = sample.second;
+        if (auto* subscribe = std::get_if<SubscribeMessage>(&fields.fields)) {
+            if (!find_filter_field_spec(filter_type)) {
+                throw std::invalid_argument("unknown filter type: " + std::to_string(filter_type));
+            }
+            subscribe->filter_type = filter_type;
+        }
+        std::ostringstream out;
+        char type_hex[3];
+        std::snprintf(type_hex, sizeof(type_hex), "%02x", static_cast<unsigned>(fields.type));
+        out << "# " << sample.first << " (type 0x" << type_hex << ")";
+        if (fields.type == SUBSCRIBE) out << ", filter " << filter_type_name(filter_type);
+        out << "\n";
+        line(out, type_hex, "message type");
+        TemplateWriter writer(out);
+        visit_fields(fields, writer);
+        return out.str();
+    }
+    throw std::invalid_argument("no template for message: " + message);
+}
+
+std::vector<std::string> template_names() {
+    std::vector<std::string> names;
+    for (const auto& sample : samples()) names.push_back(sample.first);
+    return names;
+}
+
+} // namespace moqt
@@ -0,0 +1,1052 @@
+// pcap.cpp
+// Reads pcap and pcapng captures, decrypts QUIC and validates its streams
+
+#include <moqt/pcap.hpp>
+#include <moqt/common.hpp>
+#include <moqt/control_parser.hpp>
+#include <moqt/data_parser.hpp>
+#include <moqt/session.hpp>
+#include <moqt/validator.hpp>
+#include <algorithm>
+#include <cmath>
+#include <initializer_list>
+#include <map>
+#include <sstream>
+#include <stdexcept>
+#include <utility>
+#ifdef MOQT_HAVE_OPENSSL
+#include <openssl/evp.h>
+#include <memory>
+#endif
+
+namespace moqt {
+
+namespace {
+
+// Link-layer header types, as pcap and pcapng number them
+enum LinkType : uint32_t {
+    LINKTYPE_NULL = 0,
+    LINKTYPE_ETHERNET = 1,
+    LINKTYPE_RAW = 101,
+    LINKTYPE_LINUX_SLL = 113,
+    LINKTYPE_IPV4 = 228,
+    LINKTYPE_IPV6 = 229,
+    LINKTYPE_LINUX_SLL2 = 276,
+};
+
+const uint32_t PCAP_MAGIC_MICROSECONDS = 0xA1B2C3D4;
+const uint32_t PCAP_MAGIC_NANOSECONDS = 0xA1B23C4D;
+const uint32_t PCAPNG_SECTION_HEADER = 0x0A0D0D0A;
+const uint32_t PCAPNG_BYTE_ORDER_MAGIC = 0x1A2B3C4D;
+const uint32_t PCAPNG_INTERFACE_DESCRIPTION = 1;
+const uint32_t PCAPNG_PACKET = 2;
+const uint32_t PCAPNG_SIMPLE_PACKET = 3;
+const uint32_t PCAPNG_ENHANCED_PACKET = 6;
+const uint16_t PCAPNG_IF_TSRESOL = 9;
+// Microseconds, the resolution of interfaces without an if_tsresol option
+const uint8_t PCAPNG_DEFAULT_TSRESOL = 6;
+
+const uint32_t QUIC_VERSION_1 = 0x00000001;
+const size_t MAX_CONNECTION_ID_LENGTH = 20;
+
+// Reads a size-byte integer at offset in the given byte order. Throws
+// std::runtime_error past the end of the capture.
+uint64_t read_uint(const std::vector<uint8_t>& data, size_t offset, size_t size, bool big_endian) {
+    if (offset > data.size() || data.size() - offset < size) {
+        throw std::runtime_error("capture is truncated at byte " + std::to_string(offset));
+    }
+    uint64_t value = 0;
+    for (size_t i = 0; i < size; ++i) {
+        uint64_t byte = data[offset + (big_endian ? i : size - 1 - i)];
+        value = (value << 8) | byte;
+    }
+    return value;
+}
+
+// Big-endian fields of packet headers, or 0 past the end of a frame
+uint16_t be16(const std::vector<uint8_t>& data, size_t offset) {
+    if (offset + 2 > data.size()) return 0;
+    return static_cast<uint16_t>(data[offset] << 8 | data[offset + 1]);
+}
+
+std::string ipv4_address(const std::vector<uint8_t>& packet, size_t offset, uint16_t port) {
+    std::ostringstream out;
+    for (size_t i = 0; i < 4; ++i) out << (i ? "." : "") << static_cast<int>(packet[offset + i]);
+    out << ":" << port;
+    return out.str();
+}
+
+std::string ipv6_address(const std::vector<uint8_t>& packet, size_t offset, uint16_t port) {
+    std::ostringstream out;
+    out << "[" << std::hex;
+    for (size_t i = 0; i < 8; ++i) out << (i ? ":" : "") << be16(packet, offset + 2 * i);
+    out << std::dec << "]:" << port;
+    return out.str();
+}
+
+// Appends the UDP datagram in an IP packet to out, if it holds a whole one
+void read_ip_packet(const std::vector<uint8_t>& packet, size_t offset, size_t frame,
+                    std::vector<CapturedDatagram>& out) {
+    if (offset >= packet.size()) return;
+    size_t udp = 0;
+    size_t end = packet.size();
+    size_t source = 0;
+    size_t destination = 0;
+    bool ipv6 = false;
+    uint8_t version = packet[offset] >> 4;
+    if (version == 4) {
+        size_t header_length = (packet[offset] & 0x0F) * 4;
+        if (header_length < 20 || offset + header_length > packet.size()) return;
+        if (packet[offset + 9] != 17) return;
+        // Fragments, by the more fragments flag or a nonzero offset
+        if ((be16(packet, offset + 6) & 0x3FFF) != 0) return;
+        end = std::min(end, offset + be16(packet, offset + 2));
+        source = offset + 12;
+        destination = offset + 16;
+        udp = offset + header_length;
+    } else if (version == 6) {
+        if (offset + 40 > packet.size()) return;
+        end = std::min(end, offset + 40 + be16(packet, offset + 4));
+        uint8_t next = packet[offset + 6];
+        udp = offset + 40;
+        // Hop-by-hop, routing and destination options headers
+        while (next == 0 || next == 43 || next == 60) {
+            if (udp + 8 > end) return;
+            next = packet[udp];
+            udp += (packet[udp + 1] + 1) * 8;
+        }
+        if (next != 17) return;
+        source = offset + 8;
+        destination = offset + 24;
+        ipv6 = true;
+    } else {
+        return;
+    }
+    if (udp + 8 > end) return;
+    size_t udp_end = std::min(end, udp + be16(packet, udp + 4));
+    if (udp_end < udp + 8) return;
+    uint16_t source_port = be16(packet, udp);
+    uint16_t destination_port = be16(packet, udp + 2);
+    CapturedDatagram datagram;
+    datagram.frame = frame;
+    datagram.source = ipv6 ? ipv6_address(packet, source, source_port) : ipv4_address(packet, source, source_port);
+    datagram.destination = ipv6 ? ipv6_address(packet, destination, destination_port)
+                                : ipv4_address(packet, destination, destination_port);
+    datagram.payload.assign(packet.begin() + udp + 8, packet.begin() + udp_end);
+    out.push_back(datagram);
+}
+
+// Appends the UDP datagram in a captured link-layer frame to out
+void read_link_frame(uint32_t link_type, const std::vector<uint8_t>& packet, size_t frame,
+                     std::vector<CapturedDatagram>& out) {
+    switch (link_type) {
+        case LINKTYPE_ETHERNET: {
+            size_t offset = 12;
+            uint16_t ether_type = be16(packet, offset);
+            // 802.1Q and 802.1ad VLAN tags
+            while (ether_type == 0x8100 || ether_type == 0x88A8) {
+                offset += 4;
+                ether_type = be16(packet, offset);
+            }
+            if (ether_type == 0x0800 || ether_type == 0x86DD) read_ip_packet(packet, offset + 2, frame, out);
+            return;
+        }
+        case LINKTYPE_NULL:
+            // A 4-byte address family in the capturing host's byte order,
+            // which the IP version makes redundant
+            if (packet.size() >= 4) read_ip_packet(packet, 4, frame, out);
+            return;
+        case LINKTYPE_RAW:
+        case LINKTYPE_IPV4:
+        case LINKTYPE_IPV6:
+            read_ip_packet(packet, 0, frame, out);
+            return;
+        case LINKTYPE_LINUX_SLL:
+            read_ip_packet(packet, 16, frame, out);
+            return;
+        case LINKTYPE_LINUX_SLL2:
+            read_ip_packet(packet, 20, frame, out);
+            return;
+        default:
+            return;
+    }
+}
+
+std::vector<uint8_t> slice(const std::vector<uint8_t>& data, size_t offset, size_t length) {
+    if (offset > data.size() || data.size() - offset < length) {
+        throw std::runtime_error("capture is truncated at byte " + std::to_string(offset));
+    }
+    return std::vector<uint8_t>(data.begin() + offset, data.begin() + offset + length);
+}
+
+// Sets the capture time of the datagrams a record added, from first on
+void set_time(std::vector<CapturedDatagram>& datagrams, size_t first, uint64_t time_ns) {
+    for (size_t i = first; i < datagrams.size(); ++i) datagrams[i].time_ns = time_ns;
+}
+
+std::vector<CapturedDatagram> read_pcap(const std::vector<uint8_t>& file) {
+    uint32_t magic = static_cast<uint32_t>(read_uint(file, 0, 4, true));
+    bool big_endian = magic == PCAP_MAGIC_MICROSECONDS || magic == PCAP_MAGIC_NANOSECONDS;
+    bool nanoseconds = read_uint(file, 0, 4, big_endian) == PCAP_MAGIC_NANOSECONDS;
+    uint32_t link_type = static_cast<uint32_t>(read_uint(file, 20, 4, big_endian)) & 0xFFFF;
+    std::vector<CapturedDatagram> datagrams;
+    size_t offset = 24;
+    for (size_t frame = 1; offset < file.size(); ++frame) {
+        uint64_t seconds = read_uint(file, offset, 4, big_endian);
+        uint64_t fraction = read_uint(file, offset + 4, 4, big_endian);
+        size_t captured = read_uint(file, offset + 8, 4, big_endian);
+        size_t first = datagrams.size();
+        read_link_frame(link_type, slice(file, offset + 16, captured), frame, datagrams);
+        set_time(datagrams, first, seconds * 1000000000 + fraction * (nanoseconds ? 1 : 1000));
+        offset += 16 + captured;
+    }
+    return datagrams;
+}
+
+// Returns the if_tsresol option of the interface description block at
+// offset, or the default if it has none
+uint8_t interface_resolution(const std::vector<uint8_t>& file, size_t offset, size_t length, bool big_endian) {
+    size_t end = offset + length - 4;
+    size_t option = offset + 16;
+    while (option + 4 <= end) {
+        uint64_t code = read_uint(file, option, 2, big_endian);
+        size_t size = read_uint(file, option + 2, 2, big_endian);
+        // opt_endofopt
+        if (code == 0) break;
+        if (code == PCAPNG_IF_TSRESOL && size == 1 && option + 5 <= end) return file[option + 4];
+        option += 4 + (size + 3) / 4 * 4;
+    }
+    return PCAPNG_DEFAULT_TSRESOL;
+}
+
+// Converts a pcapng timestamp to nanoseconds. resolution is 10^-n
+// seconds, or 2^-n with the top bit set.
+uint64_t pcapng_time_ns(uint64_t timestamp, uint8_t resolution) {
+    if (resolution & 0x80) {
+        long double seconds = std::ldexp(static_cast<long double>(timestamp), -(resolution & 0x7F));
+        return static_cast<uint64_t>(seconds * 1e9L);
+    }
+    uint64_t time_ns = timestamp;
+    for (uint8_t digits = resolution; digits < 9; ++digits) time_ns *= 10;
+    for (uint8_t digits = resolution; digits > 9; --digits) time_ns /= 10;
+    return time_ns;
+}
+
+std::vector<CapturedDatagram> read_pcapng(const std::vector<uint8_t>& file) {
+    std::vector<CapturedDatagram> datagrams;
+    std::vector<uint32_t> link_types;
+    std::vector<uint8_t> resolutions;
+    bool big_endian = false;
+    size_t frame = 0;
+    size_t offset = 0;
+    while (offset < file.size()) {
+        uint32_t type = static_cast<uint32_t>(read_uint(file, offset, 4, big_endian));
+        if (type == PCAPNG_SECTION_HEADER) {
+            big_endian = read_uint(file, offset + 8, 4, true) == PCAPNG_BYTE_ORDER_MAGIC;
+            link_types.clear();
+            resolutions.clear();
+        }
+        size_t length = read_uint(file, offset + 4, 4, big_endian);
+        if (length < 12 || length % 4 != 0) {
+            throw std::runtime_error("pcapng block at byte " + std::to_string(offset) + " has length "
+                                     + std::to_string(length));
+        }
+        slice(file, offset, length);
+        if (type == PCAPNG_INTERFACE_DESCRIPTION) {
+            link_types.push_back(static_cast<uint32_t>(read_uint(file, offset + 8, 2, big_endian)));
+            resolutions.push_back(interface_resolution(file, offset, length, big_endian));
+        } else if (type == PCAPNG_ENHANCED_PACKET || type == PCAPNG_PACKET || type == PCAPNG_SIMPLE_PACKET) {
+            ++frame;
+            size_t interface = 0;
+            uint64_t timestamp = 0;
+            size_t data = offset + 12;
+            size_t captured = std::min<size_t>(read_uint(file, offset + 8, 4, big_endian), length - 16);
+            if (type != PCAPNG_SIMPLE_PACKET) {
+                interface = read_uint(file, offset + 8, type == PCAPNG_PACKET ? 2 : 4, big_endian);
+                timestamp = read_uint(file, offset + 12, 4, big_endian) << 32
+                            | read_uint(file, offset + 16, 4, big_endian);
+                captured = read_uint(file, offset + 20, 4, big_endian);
+                data = offset + 28;
+            }
+            if (interface >= link_types.size()) {
+                throw std::runtime_error("pcapng packet at byte " + std::to_string(offset)
+                                         + " names undescribed interface " + std::to_string(interface));
+            }
+            if (data + captured > offset + length) {
+                throw std::runtime_error("pcapng packet at byte " + std::to_string(offset) + " overruns its block");
+            }
+            size_t first = datagrams.size();
+            read_link_frame(link_types[interface], slice(file, data, captured), frame, datagrams);
+            // Simple packet blocks carry no timestamp
+            if (type != PCAPNG_SIMPLE_PACKET) {
+                set_time(datagrams, first, pcapng_time_ns(timestamp, resolutions[interface]));
+            }
+        }
+        offset += length;
+    }
+    return datagrams;
+}
+
+#ifdef MOQT_HAVE_OPENSSL
+
+// One run of stream bytes from a STREAM frame, and where it arrived
+struct StreamSegment {
+    uint64_t offset;
+    std::vector<uint8_t> data;
+    size_t frame;
+    uint64_t packet_number;
+};
+
+// The bytes one endpoint sent on one stream
+struct StreamFlow {
+    std::vector<StreamSegment> segments;
+    bool fin = false;
+};
+
+// Where a run of reassembled stream bytes starting at start arrived
+struct Piece {
+    size_t start;
+    size_t frame;
+    uint64_t packet_number;
+};
+
+// A stream's bytes in offset order up to the first gap
+struct Reassembled {
+    std::vector<uint8_t> bytes;
+    std::vector<Piece> pieces;
+    bool gap = false;
+
+    const Piece& piece_at(size_t position) const {
+        auto it = std::upper_bound(pieces.begin(), pieces.end(), position,
+                                   [](size_t value, const Piece& piece) { return value < piece.start; });
+        return *(it - 1);
+    }
+};
+
+Reassembled reassemble(const StreamFlow& flow) {
+    std::vector<StreamSegment> segments = flow.segments;
+    std::stable_sort(segments.begin(), segments.end(),
+                     [](const StreamSegment& a, const StreamSegment& b) { return a.offset < b.offset; });
+    Reassembled stream;
+    for (const auto& segment : segments) {
+        size_t end = stream.bytes.size();
+        if (segment.offset > end) {
+            stream.gap = true;
+            break;
+        }
+        if (segment.offset + segment.data.size() <= end) continue;
+        // Retransmissions may overlap bytes already placed
+        stream.pieces.push_back(Piece{end, segment.frame, segment.packet_number});
+        stream.bytes.insert(stream.bytes.end(), segment.data.begin() + (end - segment.offset), segment.data.end());
+    }
+    return stream;
+}
+
+// An object datagram and where it arrived
+struct DatagramFrame {
+    std::vector<uint8_t> data;
+    size_t frame;
+    uint64_t packet_number;
+};
+
+// A QUIC connection, named by its client and server addresses
+struct Connection {
+    std::string client;
+    std::string server;
+    // Keyed by stream ID and whether the client sent the bytes
+    std::map<std::pair<uint64_t, bool>, StreamFlow> flows;
+    std::vector<DatagramFrame> datagrams;
+    SessionState state;
+};
+
+// What validate_capture validates, in the order the last byte arrived
+struct Unit {
+    size_t completed;  // Capture frame of the last byte
+    Connection* connection;
+    bool control;
+    Direction direction;
+    std::vector<uint8_t> bytes;
+    std::string origin;
+    // Set when the bytes mix control messages and a data stream: the
+    // report to give instead of validating them, and the offset of the
+    // switch into bytes
+    std::string violation{};
+    size_t switch_offset = 0;
+};
+
+// Reads the frames of a decrypted packet's payload, collecting STREAM
+// and DATAGRAM frames into connection. Returns a note if a frame does not
+// parse, or an empty string.
+std::string read_frames(const std::vector<uint8_t>& payload, bool from_client, size_t frame, uint64_t packet_number,
+                        Connection& connection) {
+    size_t offset = 0;
+    uint64_t type = 0;
+    try {
+        while (offset < payload.size()) {
+            type = read_varint(payload, offset);
+            if (type >= 0x08 && type <= 0x0F) {
+                StreamSegment segment{0, {}, frame, packet_number};
+                uint64_t stream_id = read_varint(payload, offset);
+                if (type & 0x04) segment.offset = read_varint(payload, offset);
+                uint64_t length = payload.size() - offset;
+                if (type & 0x02) length = read_varint(payload, offset);
+                check_remaining(payload, offset, length, "STREAM frame overruns the packet");
+                segment.data.assign(payload.begin() + offset, payload.begin() + offset + length);
+                offset += length;
+                StreamFlow& flow = connection.flows[{stream_id, from_client}];
+                flow.segments.push_back(segment);
+                if (type & 0x01) flow.fin = true;
+                continue;
+            }
+            switch (type) {
+                case 0x00:  // PADDING
+                case 0x01:  // PING
+                case 0x1E:  // HANDSHAKE_DONE
+                    break;
+                case 0x02:  // ACK
+                case 0x03: {
+                    read_varint(payload, offset);
+                    read_varint(payload, offset);
+                    uint64_t ranges = read_varint(payload, offset);
+                    read_varint(payload, offset);
+                    for (uint64_t i = 0; i < ranges; ++i) {
+                        read_varint(payload, offset);
+                        read_varint(payload, offset);
+                    }
+                    if (type == 0x03) {
+                        for (int i = 0; i < 3; ++i) read_varint(payload, offset);
+                    }
+                    break;
+                }
+                case 0x04:  // RESET_STREAM
+                    for (int i = 0; i < 3; ++i) read_varint(payload, offset);
+                    break;
+                case 0x05:  // STOP_SENDING
+                case 0x11:  // MAX_STREAM_DATA
+                case 0x15:  // STREAM_DATA_BLOCKED
+                    read_varint(payload, offset);
+                    read_varint(payload, offset);
+                    break;
+                case 0x06: {  // CRYPTO
+                    read_varint(payload, offset);
+                    uint64_t length = read_varint(payload, offset);
+                    check_remaining(payload, offset, length, "CRYPTO frame overruns the packet");
+                    offset += length;
+                    break;
+                }
+                case 0x07:  // NEW_TOKEN
+                    read_lp_string(payload, offset);
+                    break;
+                case 0x10:  // MAX_DATA
+                case 0x12:  // MAX_STREAMS
+                case 0x13:
+                case 0x14:  // DATA_BLOCKED
+                case 0x16:  // STREAMS_BLOCKED
+                case 0x17:
+                case 0x19:  // RETIRE_CONNECTION_ID
+                    read_varint(payload, offset);
+                    break;
+                case 0x18: {  // NEW_CONNECTION_ID
+                    read_varint(payload, offset);
+                    read_varint(payload, offset);
+                    uint8_t length = read_u8(payload, offset);
+                    check_remaining(payload, offset, length + 16u, "NEW_CONNECTION_ID frame overruns the packet");
+                    offset += length + 16u;
+                    break;
+                }
+                case 0x1A:  // PATH_CHALLENGE
+                case 0x1B:  // PATH_RESPONSE
+                    check_remaining(payload, offset, 8, "path frame overruns the packet");
+                    offset += 8;
+                    break;
+                case 0x1C:  // CONNECTION_CLOSE
+                case 0x1D:
+                    read_varint(payload, offset);
+                    if (type == 0x1C) read_varint(payload, offset);
+                    read_lp_string(payload, offset);
+                    break;
+                case 0x30:  // DATAGRAM
+                case 0x31: {
+                    uint64_t length = payload.size() - offset;
+                    if (type == 0x31) length = read_varint(payload, offset);
+                    check_remaining(payload, offset, length, "DATAGRAM frame overruns the packet");
+                    connection.datagrams.push_back(DatagramFrame{
+                        std::vector<uint8_t>(payload.begin() + offset, payload.begin() + offset + length), frame,
+                        packet_number});
+                    offset += length;
+                    break;
+                }
+                default:
+                    return "frame " + std::to_string(frame) + ": unknown QUIC frame type " + std::to_string(type)
+                           + " in packet " + std::to_string(packet_number);
+            }
+        }
+    } catch (const std::out_of_range& e) {
+        return "frame " + std::to_string(frame) + ": QUIC frame type " + std::to_string(type) + " in packet "
+               + std::to_string(packet_number) + " is malformed: " + e.what();
+    }
+    return "";
+}
+
+// Skips the long header packet at offset, recording the length of the
+// connection ID its sender chose. Returns false if the version is not
+// QUIC v1 or the packet is malformed; Version Negotiation and Retry
+// packets run to the end of the datagram.
+bool skip_long_header_packet(const std::vector<uint8_t>& datagram, size_t& offset, size_t& source_cid_length) {
+    try {
+        size_t position = offset + 1;
+        uint32_t version = 0;
+        for (int i = 0; i < 4; ++i) version = version << 8 | read_u8(datagram, position);
+        uint8_t dcid_length = read_u8(datagram, position);
+        check_remaining(datagram, position, dcid_length, "connection ID overruns the packet");
+        position += dcid_length;
+        uint8_t scid_length = read_u8(datagram, position);
+        check_remaining(datagram, position, scid_length, "connection ID overruns the packet");
+        position += scid_length;
+        if (version == 0) {
+            offset = datagram.size();
+            return true;
+        }
+        if (version != QUIC_VERSION_1) return false;
+        source_cid_length = scid_length;
+        uint8_t type = (datagram[offset] >> 4) & 0x03;
+        if (type == 0x03) {
+            offset = datagram.size();
+            return true;
+        }
+        // Initial packets carry a token
+        if (type == 0x00) read_lp_string(datagram, position);
+        uint64_t length = read_varint(datagram, position);
+        check_remaining(datagram, position, length, "packet overruns the datagram");
+        offset = position + length;
+        return true;
+    } catch (const std::out_of_range&) {
+        return false;
+    }
+}
+
+struct CipherContextDeleter {
+    void operator()(EVP_CIPHER_CTX* context) const { EVP_CIPHER_CTX_free(context); }
+};
+using CipherContext = std::unique_ptr<EVP_CIPHER_CTX, CipherContextDeleter>;
+
+const size_t AEAD_TAG_LENGTH = 16;
+const size_t SAMPLE_LENGTH = 16;
+
+const char* digest_name(QuicCipher cipher) {
+    return cipher == QuicCipher::AES_256_GCM ? "SHA384" : "SHA256";
+}
+
+size_t secret_length(QuicCipher cipher) {
+    return cipher == QuicCipher::AES_256_GCM ? 48 : 32;
+}
+
+size_t key_length(QuicCipher cipher) {
+    return cipher == QuicCipher::AES_128_GCM ? 16 : 32;
+}
+
+// HKDF-Expand-Label from TLS 1.3 with an empty context. Every length
+// QUIC asks for fits in one block of the hash.
+std::vector<uint8_t> expand_label(QuicCipher cipher, const std::vector<uint8_t>& secret, const std::string& label,
+                                  size_t length) {
+    std::string full_label = "tls13 " + label;
+    std::vector<uint8_t> info = {static_cast<uint8_t>(length >> 8), static_cast<uint8_t>(length),
+                                 static_cast<uint8_t>(full_label.size())};
+    info.insert(info.end(), full_label.begin(), full_label.end());
+    info.push_back(0x00);
+    info.push_back(0x01);
+    uint8_t block[EVP_MAX_MD_SIZE];
+    size_t block_length = 0;
+    if (!EVP_Q_mac(nullptr, "HMAC", nullptr, digest_name(cipher), nullptr, secret.data(), secret.size(), info.data(),
+                   info.size(), block, sizeof(block), &block_length)) {
+        throw std::runtime_error("HKDF-Expand-Label failed");
+    }
+    return std::vector<uint8_t>(block, block + length);
+}
+
+// The packet protection keys derived from one traffic secret
+struct PacketKeys {
+    QuicCipher cipher;
+    std::vector<uint8_t> secret;
+    std::vector<uint8_t> key;
+    std::vector<uint8_t> iv;
+    std::vector<uint8_t> hp;
+};
+
+PacketKeys derive_keys(QuicCipher cipher, const std::vector<uint8_t>& secret) {
+    if (secret.size() != secret_length(cipher)) {
+        throw std::invalid_argument("traffic secret has " + std::to_string(secret.size()) + " bytes, expected "
+                                    + std::to_string(secret_length(cipher)));
+    }
+    PacketKeys keys{cipher, secret, {}, {}, {}};
+    keys.key = expand_label(cipher, secret, "quic key", key_length(cipher));
+    keys.iv = expand_label(cipher, secret, "quic iv", 12);
+    keys.hp = expand_label(cipher, secret, "quic hp", key_length(cipher));
+    return keys;
+}
+
+// The keys after a key update, which keeps the header protection key
+PacketKeys next_keys(const PacketKeys& keys) {
+    PacketKeys next = derive_keys(keys.cipher, expand_label(keys.cipher, keys.secret, "quic ku", keys.secret.size()));
+    next.hp = keys.hp;
+    return next;
+}
+
+// The header protection mask for a sample of the protected payload
+std::vector<uint8_t> header_mask(const PacketKeys& keys, const uint8_t* sample) {
+    CipherContext context(EVP_CIPHER_CTX_new());
+    std::vector<uint8_t> mask(SAMPLE_LENGTH);
+    int length = 0;
+    bool ok = false;
+    if (keys.cipher == QuicCipher::CHACHA20_POLY1305) {
+        // The sample is the block counter and nonce, and the mask the
+        // keystream for five zero bytes
+        const uint8_t zeros[5] = {};
+        ok = EVP_EncryptInit_ex(context.get(), EVP_chacha20(), nullptr, keys.hp.data(), sample) == 1
+             && EVP_EncryptUpdate(context.get(), mask.data(), &length, zeros, sizeof(zeros)) == 1;
+    } else {
+        const EVP_CIPHER* aes = keys.cipher == QuicCipher::AES_128_GCM ? EVP_aes_128_ecb() : EVP_aes_256_ecb();
+        ok = EVP_EncryptInit_ex(context.get(), aes, nullptr, keys.hp.data(), nullptr) == 1
+             && EVP_CIPHER_CTX_set_padding(context.get(), 0) == 1
+             && EVP_EncryptUpdate(context.get(), mask.data(), &length, sample, SAMPLE_LENGTH) == 1;
+    }
+    if (!ok) throw std::runtime_error("header protection failed");
+    mask.resize(5);
+    return mask;
+}
+
+// Seals plaintext into ciphertext and tag, or opens them when seal is
+// false. Returns false if the tag of a sealed payload does not verify.
+bool run_aead(const PacketKeys& keys, uint64_t packet_number, const std::vector<uint8_t>& header, const uint8_t* in,
+              size_t in_length, bool seal, std::vector<uint8_t>& out) {
+    if (!seal && in_length < AEAD_TAG_LENGTH) return false;
+    std::vector<uint8_t> nonce = keys.iv;
+    for (size_t i = 0; i < 8; ++i) nonce[nonce.size() - 1 - i] ^= static_cast<uint8_t>(packet_number >> (8 * i));
+    const EVP_CIPHER* cipher = keys.cipher == QuicCipher::AES_128_GCM   ? EVP_aes_128_gcm()
+                               : keys.cipher == QuicCipher::AES_256_GCM ? EVP_aes_256_gcm()
+                                                                        : EVP_chacha20_poly1305();
+    size_t text_length = seal ? in_length : in_length - AEAD_TAG_LENGTH;
+    CipherContext context(EVP_CIPHER_CTX_new());
+    out.assign(text_length + (seal ? AEAD_TAG_LENGTH : 0), 0);
+    int length = 0;
+    if (EVP_CipherInit_ex(context.get(), cipher, nullptr, keys.key.data(), nonce.data(), seal ? 1 : 0) != 1
+        || EVP_CipherUpdate(context.get(), nullptr, &length, header.data(), static_cast<int>(header.size())) != 1
+        || EVP_CipherUpdate(context.get(), out.data(), &length, in, static_cast<int>(text_length)) != 1) {
+        throw std::runtime_error("packet protection failed");
+    }
+    uint8_t tag[AEAD_TAG_LENGTH];
+    if (!seal) {
+        std::copy(in + text_length, in + in_length, tag);
+        EVP_CIPHER_CTX_ctrl(context.get(), EVP_CTRL_AEAD_SET_TAG, AEAD_TAG_LENGTH, tag);
+    }
+    if (EVP_CipherFinal_ex(context.get(), out.data() + length, &length) != 1) return false;
+    if (seal) {
+        EVP_CIPHER_CTX_ctrl(context.get(), EVP_CTRL_AEAD_GET_TAG, AEAD_TAG_LENGTH, tag);
+        std::copy(tag, tag + AEAD_TAG_LENGTH, out.begin() + text_length);
+    }
+    return true;
+}
+
+// A short header packet with header protection removed
+struct UnmaskedHeader {
+    std::vector<uint8_t> header;  // Up to the end of the packet number
+    uint64_t truncated_number;
+    size_t number_bits;
+    bool key_phase;
+};
+
+bool unmask_header(const PacketKeys& keys, const std::vector<uint8_t>& packet, size_t dcid_length,
+                   UnmaskedHeader& unmasked) {
+    size_t number_offset = 1 + dcid_length;
+    if (packet.size() < number_offset + 4 + SAMPLE_LENGTH) return false;
+    std::vector<uint8_t> mask = header_mask(keys, packet.data() + number_offset + 4);
+    uint8_t first = packet[0] ^ (mask[0] & 0x1F);
+    size_t number_length = (first & 0x03) + 1;
+    unmasked.header.assign(packet.begin(), packet.begin() + number_offset + number_length);
+    unmasked.header[0] = first;
+    unmasked.truncated_number = 0;
+    for (size_t i = 0; i < number_length; ++i) {
+        unmasked.header[number_offset + i] ^= mask[1 + i];
+        unmasked.truncated_number = unmasked.truncated_number << 8 | unmasked.header[number_offset + i];
+    }
+    unmasked.number_bits = number_length * 8;
+    unmasked.key_phase = (first & 0x04) != 0;
+    return true;
+}
+
+// Recovers a full packet number from its truncated form, per RFC 9000
+// Appendix A.3
+uint64_t decode_packet_number(uint64_t expected, uint64_t truncated, size_t bits) {
+    uint64_t window = uint64_t(1) << bits;
+    uint64_t half_window = window / 2;
+    uint64_t candidate = (expected & ~(window - 1)) | truncated;
+    if (candidate + half_window <= expected && candidate < (uint64_t(1) << 62) - window) return candidate + window;
+    if (candidate > expected + half_window && candidate >= window) return candidate - window;
+    return candidate;
+}
+
+bool open_payload(const PacketKeys& keys, const std::vector<uint8_t>& packet, const UnmaskedHeader& unmasked,
+                  uint64_t packet_number, std::vector<uint8_t>& payload) {
+    size_t start = unmasked.header.size();
+    return run_aead(keys, packet_number, unmasked.header, packet.data() + start, packet.size() - start, false,
+                    payload);
+}
+
+// Packet protection of one endpoint's packets to its peer, once a secret
+// has been found to open them
+struct SenderKeys {
+    bool from_client;
+    size_t dcid_length;
+    PacketKeys keys;
+    bool key_phase;
+    uint64_t expected_number;
+};
+
+// A secret that might protect some endpoint's packets
+struct CandidateKeys {
+    bool from_client;
+    PacketKeys keys;
+};
+
+std::vector<CandidateKeys> candidate_keys(const TrafficSecrets& secrets) {
+    std::vector<CandidateKeys> candidates;
+    for (bool from_client : {true, false}) {
+        for (const auto& secret : from_client ? secrets.client : secrets.server) {
+            // The secret's length narrows the cipher suite down
+            for (QuicCipher cipher :
+                 {QuicCipher::AES_128_GCM, QuicCipher::CHACHA20_POLY1305, QuicCipher::AES_256_GCM}) {
+                if (secret.size() == secret_length(cipher)) {
+                    candidates.push_back({from_client, derive_keys(cipher, secret)});
+                }
+            }
+        }
+    }
+    return candidates;
+}
+
+// Tries every candidate secret and connection ID length on a packet from
+// an endpoint not yet known, hint first
+bool find_sender_keys(const std::vector<CandidateKeys>& candidates, const std::vector<uint8_t>& packet, int hint,
+                      SenderKeys& sender, std::vector<uint8_t>& payload, uint64_t& packet_number) {
+    std::vector<size_t> lengths;
+    if (hint >= 0) lengths.push_back(static_cast<size_t>(hint));
+    for (size_t length = 0; length <= MAX_CONNECTION_ID_LENGTH; ++length) {
+        if (static_cast<int>(length) != hint) lengths.push_back(length);
+    }
+    for (const auto& candidate : candidates) {
+        for (size_t dcid_length : lengths) {
+            UnmaskedHeader unmasked;
+            if (!unmask_header(candidate.keys, packet, dcid_length, unmasked)) continue;
+            packet_number = decode_packet_number(0, unmasked.truncated_number, unmasked.number_bits);
+            // A capture may start after the first key update
+            for (const PacketKeys& keys : {candidate.keys, next_keys(candidate.keys)}) {
+                if (!open_payload(keys, packet, unmasked, packet_number, payload)) continue;
+                sender = SenderKeys{candidate.from_client, dcid_length, keys, unmasked.key_phase, packet_number + 1};
+                return true;
+            }
+        }
+    }
+    return false;
+}
+
+// Opens a packet from a known endpoint, following a key update when the
+// key phase flips
+bool open_known_sender(SenderKeys& sender, const std::vector<uint8_t>& packet, std::vector<uint8_t>& payload,
+                       uint64_t& packet_number) {
+    UnmaskedHeader unmasked;
+    if (!unmask_header(sender.keys, packet, sender.dcid_length, unmasked)) return false;
+    packet_number = decode_packet_number(sender.expected_number, unmasked.truncated_number, unmasked.number_bits);
+    if (unmasked.key_phase == sender.key_phase) {
+        if (!open_payload(sender.keys, packet, unmasked, packet_number, payload)) return false;
+    } else {
+        PacketKeys next = next_keys(sender.keys);
+        if (!open_payload(next, packet, unmasked, packet_number, payload)) return false;
+        sender.keys = next;
+        sender.key_phase = unmasked.key_phase;
+    }
+    sender.expected_number = std::max(sender.expected_number, packet_number + 1);
+    return true;
+}
+
+// Splits a control stream into its framed messages, leaving a partial
+// last message in remainder. A stream that opens with a legacy SETUP has
+// varint lengths when options accept one.
+std::vector<std::pair<size_t, size_t>> split_control_stream(const std::vector<uint8_t>& stream, size_t& remainder,
+                                                            const ValidationOptions& options) {
+    std::vector<std::pair<size_t, size_t>> messages;
+    size_t offset = 0;
+    bool varint_length = false;
+    while (offset < stream.size()) {
+        size_t start = offset;
+        try {
+            uint64_t type = read_varint_canonical(stream, offset);
+            varint_length = has_varint_length(type, varint_length, options);
+            uint64_t length = read_control_length(stream, offset, varint_length, options);
+            check_remaining(stream, offset, length, "incomplete control message");
+            offset += length;
+        } catch (const std::exception&) {
+            remainder = start;
+            return messages;
+        }
+        messages.emplace_back(start, offset);
+    }
+    remainder = stream.size();
+    return messages;
+}
+
+// The type of the subgroup or fetch stream bytes open, e.g.
+// "SUBGROUP_HEADER", if they validate as one, or an empty string
+std::string data_stream_type(const std::vector<uint8_t>& bytes, const ValidationOptions& options) {
+    if (bytes.empty()) return "";
+    uint8_t type = bytes[0];
+    if (type != FETCH_HEADER && (type < SUBGROUP_HEADER_MIN || type > SUBGROUP_HEADER_MAX)) return "";
+    std::string report = validate_data_message(bytes, options);
+    return make_result(bytes, report).valid ? result_message_type(report) : "";
+}
+
+std::string origin(const std::string& stream, const Piece& piece) {
+    return stream + ", frame=" + std::to_string(piece.frame) + ", packet_number=" + std::to_string(piece.packet_number);
+}
+
+// Turns the streams and datagrams of connection into units to validate
+void collect_units(Connection& connection, std::vector<Unit>& units, std::vector<std::string>& notes,
+                   const ValidationOptions& options) {
+    for (const auto& entry : connection.flows) {
+        uint64_t stream_id = entry.first.first;
+        bool from_client = entry.first.second;
+        std::string name = "stream=" + std::to_string(stream_id);
+        std::string sender = from_client ? "client" : "server";
+        Reassembled stream = reassemble(entry.second);
+        if (stream.gap) {
+            notes.push_back(name + " from the " + sender + ": bytes from offset " + std::to_string(stream.bytes.size())
+                            + " on are missing");
+        }
+        if (stream.bytes.empty()) continue;
+        bool bidirectional = (stream_id & 0x02) == 0;
+        if (bidirectional && stream_id != 0) {
+            notes.push_back(name + ": only the control stream, stream 0, is validated of the bidirectional streams");
+            continue;
+        }
+        Direction direction = from_client ? CLIENT_TO_SERVER : SERVER_TO_CLIENT;
+        size_t remainder = 0;
+        if (!bidirectional) {
+            Unit unit{stream.pieces.back().frame, &connection, false, DIRECTION_UNKNOWN, stream.bytes,
+                      origin(name, stream.piece_at(0))};
+            // Data stream types share values with control messages, so
+            // the bytes are only taken for control messages when they do
+            // not validate as a data stream and frame as messages to the end
+            std::string control_type = control_message_name(stream.bytes[0]);
+            if (control_type != "UNKNOWN" && data_stream_type(stream.bytes, options).empty()
+                && !split_control_stream(stream.bytes, remainder, options).empty()
+                && remainder == stream.bytes.size()) {
+                unit.violation = control_type + " protocol violation: " + name
+                                 + " carries control messages, not a data stream (byte_offset=0)";
+            }
+            units.push_back(unit);
+            continue;
+        }
+        for (const auto& message : split_control_stream(stream.bytes, remainder, options)) {
+            Unit unit{stream.piece_at(message.second - 1).frame, &connection, true, direction,
+                      std::vector<uint8_t>(stream.bytes.begin() + message.first, stream.bytes.begin() + message.second),
+                      origin(name, stream.piece_at(message.first))};
+            units.push_back(unit);
+        }
+        if (remainder == stream.bytes.size()) continue;
+        std::string data_type = data_stream_type(
+            std::vector<uint8_t>(stream.bytes.begin() + remainder, stream.bytes.end()), options);
+        if (!data_type.empty()) {
+            // Reported on the whole stream, so the offset of the switch
+            // is the byte_offset into the result's input
+            Unit unit{stream.pieces.back().frame, &connection, true, direction, stream.bytes,
+                      origin(name, stream.piece_at(remainder))};
+            unit.violation = data_type + " protocol violation: " + name + " switches from control messages to a "
+                             + "data stream (byte_offset=" + std::to_string(remainder) + ")";
+            unit.switch_offset = remainder;
+            units.push_back(unit);
+        } else {
+            notes.push_back(name + " from the " + sender + ": " + std::to_string(stream.bytes.size() - remainder)
+                            + " bytes at offset " + std::to_string(remainder) + " do not end a control message");
+        }
+    }
+    for (const auto& datagram : connection.datagrams) {
+        units.push_back(Unit{datagram.frame, &connection, false, DIRECTION_UNKNOWN, datagram.data,
+                             origin("datagram", Piece{0, datagram.frame, datagram.packet_number})});
+    }
+}
+
+#endif // MOQT_HAVE_OPENSSL
+
+} // namespace
+
+std::vector<CapturedDatagram> read_capture(const std::vector<uint8_t>& file) {
+    uint32_t magic = static_cast<uint32_t>(read_uint(file, 0, 4, true));
+    if (magic == PCAPNG_SECTION_HEADER) return read_pcapng(file);
+    uint32_t swapped = static_cast<uint32_t>(read_uint(file, 0, 4, false));
+    for (uint32_t known : {PCAP_MAGIC_MICROSECONDS, PCAP_MAGIC_NANOSECONDS}) {
+        if (magic == known || swapped == known) return read_pcap(file);
+    }
+    throw std::runtime_error("not a pcap or pcapng file");
+}
+
+TrafficSecrets read_keylog(const std::string& text) {
+    TrafficSecrets secrets;
+    std::istringstream lines(text);
+    std::string line;
+    for (size_t number = 1; std::getline(lines, line); ++number) {
+        std::istringstream fields(line.substr(0, line.find('#')));
+        std::string label;
+        std::string client_random;
+        std::string secret;
+        fields >> label >> client_random >> secret;
+        if (label != "CLIENT_TRAFFIC_SECRET_0" && label != "SERVER_TRAFFIC_SECRET_0") continue;
+        try {
+            if (secret.empty()) throw std::invalid_argument("missing secret");
+            (label[0] == 'C' ? secrets.client : secrets.server).push_back(from_hex(secret));
+        } catch (const std::invalid_argument& e) {
+            throw std::runtime_error("keylog line " + std::to_string(number) + ": " + e.what());
+        }
+    }
+    return secrets;
+}
+
+bool capture_decryption_available() {
+#ifdef MOQT_HAVE_OPENSSL
+    return true;
+#else
+    return false;
+#endif
+}
+
+#ifdef MOQT_HAVE_OPENSSL
+
+CaptureValidation validate_capture(const std::vector<CapturedDatagram>& datagrams, const TrafficSecrets& secrets,
+                                   const ValidationOptions& options) {
+    CaptureValidation validation;
+    std::vector<CandidateKeys> candidates = candidate_keys(secrets);
+    // Connections in the order they first appear, keyed by both endpoints
+    std::vector<std::unique_ptr<Connection>> connections;
+    std::map<std::string, Connection*> by_endpoints;
+    std::map<std::string, SenderKeys> senders;
+    std::map<std::string, size_t> cid_lengths;
+    std::map<size_t, uint64_t> frame_times;
+    for (const auto& datagram : datagrams) {
+        frame_times[datagram.frame] = datagram.time_ns;
+        size_t offset = 0;
+        while (offset < datagram.payload.size()) {
+            const std::vector<uint8_t>& payload = datagram.payload;
+            std::string frame = "frame " + std::to_string(datagram.frame);
+            if ((payload[offset] & 0x40) == 0) {
+                validation.notes.push_back(frame + ": not a QUIC packet");
+                break;
+            }
+            if (payload[offset] & 0x80) {
+                size_t cid_length = 0;
+                if (!skip_long_header_packet(payload, offset, cid_length)) {
+                    validation.notes.push_back(frame + ": long header packet is malformed or not QUIC v1");
+                    break;
+                }
+                cid_lengths[datagram.source] = cid_length;
+                continue;
+            }
+            std::vector<uint8_t> packet(payload.begin() + offset, payload.end());
+            offset = payload.size();
+            std::string direction = datagram.source + ">" + datagram.destination;
+            std::vector<uint8_t> plaintext;
+            uint64_t packet_number = 0;
+            auto known = senders.find(direction);
+            bool opened = false;
+            if (known != senders.end()) {
+                opened = open_known_sender(known->second, packet, plaintext, packet_number);
+            } else {
+                auto hint = cid_lengths.find(datagram.destination);
+                SenderKeys sender{};
+                opened = find_sender_keys(candidates, packet, hint == cid_lengths.end() ? -1 : int(hint->second),
+                                          sender, plaintext, packet_number);
+                if (opened) known = senders.emplace(direction, sender).first;
+            }
+            if (!opened) {
+                validation.notes.push_back(frame + ": no 1-RTT secret opens this packet");
+                break;
+            }
+            bool from_client = known->second.from_client;
+            std::string client = from_client ? datagram.source : datagram.destination;
+            std::string server = from_client ? datagram.destination : datagram.source;
+            Connection*& connection = by_endpoints[client + "|" + server];
+            if (!connection) {
+                connections.push_back(std::make_unique<Connection>());
+                connection = connections.back().get();
+                connection->client = client;
+                connection->server = server;
+            }
+            std::string note = read_frames(plaintext, from_client, datagram.frame, packet_number, *connection);
+            if (!note.empty()) validation.notes.push_back(note);
+        }
+    }
+
+    std::vector<Unit> units;
+    for (const auto& connection : connections) collect_units(*connection, units, validation.notes, options);
+    std::stable_sort(units.begin(), units.end(),
+                     [](const Unit& a, const Unit& b) { return a.completed < b.completed; });
+    for (const auto& unit : units) {
+        ValidationResult result;
+        if (!unit.violation.empty()) {
+            ValidationIssue issue{unit.switch_offset, "type", IssueSeverity::FATAL, unit.violation};
+            result = make_result(unit.bytes, unit.violation, {issue});
+        } else if (unit.control) {
+            ControlStreamResult stream = validate_control_stream(unit.bytes, unit.connection->state, unit.direction,
+                                                                 options);
+            result = stream.messages.front();
+        } else {
+            std::vector<ValidationIssue> issues;
+            DecodedMessage decoded;
+            ScopedIssueCollector locator(&issues, false);
+            ScopedMessageRecorder fields(&decoded);
+            std::string report = validate_data_message(unit.bytes, options);
+            result = make_result(unit.bytes, report, issues, decoded);
+        }
+        result.origin = unit.origin;
+        result.capture_time_ns = frame_times[unit.completed];
+        if (connections.size() > 1) result.origin = "client=" + unit.connection->client + ", " + result.origin;
+        validation.results.push_back(result);
+    }
+    return validation;
+}
+
+std::vector<uint8_t> protect_short_header_packet(QuicCipher cipher, const std::vector<uint8_t>& secret,
+                                                 const std::vector<uint8_t>& dcid, uint64_t packet_number,
+                                                 size_t pn_length, const std::vector<uint8_t>& payload,
+                                                 bool key_phase) {
+    if (pn_length < 1 || pn_length > 4) throw std::invalid_argument("packet number length must be 1-4 bytes");
+    PacketKeys keys = derive_keys(cipher, secret);
+    std::vector<uint8_t> header = {static_cast<uint8_t>(0x40 | (key_phase ? 0x04 : 0x00) | (pn_length - 1))};
+    header.insert(header.end(), dcid.begin(), dcid.end());
+    for (size_t i = pn_length; i > 0; --i) header.push_back(static_cast<uint8_t>(packet_number >> (8 * (i - 1))));
+    std::vector<uint8_t> sealed;
+    run_aead(keys, packet_number, header, payload.data(), payload.size(), true, sealed);
+    std::vector<uint8_t> packet = header;
+    packet.insert(packet.end(), sealed.begin(), sealed.end());
+    size_t number_offset = 1 + dcid.size();
+    if (packet.size() < number_offset + 4 + SAMPLE_LENGTH) {
+        throw std::invalid_argument("payload is too short to sample for header protection");
+    }
+    std::vector<uint8_t> mask = header_mask(keys, packet.data() + number_offset + 4);
+    packet[0] ^= mask[0] & 0x1F;
+    for (size_t i = 0; i < pn_length; ++i) packet[number_offset + i] ^= mask[1 + i];
+    return packet;
+}
+
+#else
+
+CaptureValidation validate_capture(const std::vector<CapturedDatagram>&, const TrafficSecrets&,
+                                   const ValidationOptions&) {
+    throw std::runtime_error("decrypting QUIC packets needs a build with OpenSSL");
+}
+
+std::vector<uint8_t> protect_short_header_packet(QuicCipher, const std::vector<uint8_t>&, const std::vector<uint8_t>&,
+                                                 uint64_t, size_t, const std::vector<uint8_t>&, bool) {
+    throw std::runtime_error("protecting QUIC packets needs a build with OpenSSL");
+}
+
+#endif // MOQT_HAVE_OPENSSL
+
+} // namespace moqt
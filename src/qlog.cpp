@@ -0,0 +1,367 @@
+// qlog.cpp
+// Reads MoQT events from qlog JSON and validates their raw bytes
+
+#include <moqt/qlog.hpp>
+#include <moqt/common.hpp>
+#include <moqt/control_parser.hpp>
+#include <moqt/data_parser.hpp>
+#include <moqt/encoder.hpp>
+#include <moqt/formatter.hpp>
+#include <moqt/json.hpp>
+#include <moqt/session.hpp>
+#include <moqt/validator.hpp>
+#include <cctype>
+#include <initializer_list>
+#include <stdexcept>
+#include <variant>
+
+namespace moqt {
+
+namespace {
+
+const JsonValue* find_path(const JsonValue& root, std::initializer_list<const char*> path) {
+    const JsonValue* value = &root;
+    for (const char* key : path) {
+        value = value->get(key);
+        if (!value) return nullptr;
+    }
+    return value;
+}
+
+// Normalises a message type name such as "subscribe_ok" to "SUBSCRIBE_OK"
+std::string normalise_type(const std::string& name) {
+    std::string out;
+    for (char c : name) {
+        out += (c == '-' || c == ' ') ? '_' : static_cast<char>(std::toupper(static_cast<unsigned char>(c)));
+    }
+    return out;
+}
+
+// Returns the message name a report starts with, e.g. "SUBSCRIBE"
+std::string report_type(const std::string& report) {
+    size_t end = report.find_first_of(": ");
+    return report.substr(0, end);
+}
+
+void collect_events(const JsonValue& events, std::vector<QlogEvent>& out) {
+    if (events.type != JsonValue::Array) return;
+    for (size_t i = 0; i < events.array.size(); ++i) {
+        const JsonValue& event = events.array[i];
+        const JsonValue* raw = find_path(event, {"data", "raw", "data"});
+        if (!raw || raw->type != JsonValue::String) continue;
+        QlogEvent parsed{};
+        parsed.index = i;
+        if (const JsonValue* name = event.get("name")) parsed.name = name->string;
+        parsed.data_message = parsed.name.find("header") != std::string::npos
+                              || parsed.name.find("datagram") != std::string::npos;
+        parsed.raw = from_hex(raw->string);
+        if (const JsonValue* message = find_path(event, {"data", "message"})) {
+            if (const JsonValue* type = message->get("type")) {
+                if (type->type == JsonValue::String) parsed.message_type = type->string;
+            }
+            for (const auto& member : message->object) {
+                if (member.second.type == JsonValue::Number && member.second.number >= 0) {
+                    parsed.fields.emplace_back(member.first, static_cast<uint64_t>(member.second.number));
+                }
+            }
+        }
+        out.push_back(parsed);
+    }
+}
+
+// Builds a JSON object member by member, in the order they are added
+class JsonObject {
+public:
+    JsonObject& raw(const std::string& key, const std::string& json) {
+        members_ += (members_.empty() ? "\"" : ",\"") + key + "\":" + json;
+        return *this;
+    }
+    JsonObject& number(const std::string& key, uint64_t value) { return raw(key, std::to_string(value)); }
+    JsonObject& text(const std::string& key, const std::string& value) {
+        return raw(key, "\"" + json_escape(value) + "\"");
+    }
+    std::string str() const { return "{" + members_ + "}"; }
+
+private:
+    std::string members_;
+};
+
+std::string compact_hex(const std::vector<uint8_t>& bytes) {
+    static const char digits[] = "0123456789abcdef";
+    std::string hex;
+    for (uint8_t byte : bytes) {
+        hex += digits[byte >> 4];
+        hex += digits[byte & 0x0F];
+    }
+    return hex;
+}
+
+std::string strings_json(const std::vector<std::string>& fields) {
+    std::string out = "[";
+    for (size_t i = 0; i < fields.size(); ++i) out += (i ? ",\"" : "\"") + json_escape(fields[i]) + "\"";
+    return out + "]";
+}
+
+std::string location_json(const Location& location) {
+    return JsonObject().number("group", location.group).number("object", location.object).str();
+}
+
+// Key-value pairs as objects: even types with a numeric value, odd types
+// with their bytes as hex
+std::string key_value_json(uint64_t type, bool has_number, uint64_t number, const std::vector<uint8_t>& bytes) {
+    JsonObject pair;
+    pair.number("type", type);
+    return (has_number ? pair.number("value", number) : pair.text("value_bytes", compact_hex(bytes))).str();
+}
+
+std::string parameters_json(const std::vector<Parameter>& params) {
+    std::string out = "[";
+    for (size_t i = 0; i < params.size(); ++i) {
+        const Parameter& param = params[i];
+        std::vector<uint8_t> bytes(param.bytes.begin(), param.bytes.end());
+        out += (i ? "," : "") + key_value_json(param.type, param.type % 2 == 0, param.value, bytes);
+    }
+    return out + "]";
+}
+
+// Decodes an extension header block as parameters are decoded. A block
+// that does not parse is written up to the header that overruns it.
+std::string extension_headers_json(const std::vector<uint8_t>& block) {
+    std::string out = "[";
+    size_t offset = 0;
+    try {
+        while (offset < block.size()) {
+            uint64_t type = read_varint(block, offset);
+            std::string header;
+            if (type % 2 == 0) {
+                header = key_value_json(type, true, read_varint(block, offset), {});
+            } else {
+                std::string value = read_lp_string(block, offset);
+                header = key_value_json(type, false, 0, std::vector<uint8_t>(value.begin(), value.end()));
+            }
+            out += (out.size() > 1 ? "," : "") + header;
+        }
+    } catch (const std::exception&) {
+    }
+    return out + "]";
+}
+
+// A capture time in nanoseconds as qlog's milliseconds
+std::string qlog_time(uint64_t time_ns) {
+    std::string time = std::to_string(time_ns / 1000000);
+    std::string fraction = std::to_string(time_ns % 1000000);
+    fraction = std::string(6 - fraction.size(), '0') + fraction;
+    fraction.erase(fraction.find_last_not_of('0') + 1);
+    return fraction.empty() ? time : time + "." + fraction;
+}
+
+std::string qlog_event(const std::string& time, const std::string& name, const std::string& data) {
+    return JsonObject().raw("time", time).text("name", name).raw("data", data).str();
+}
+
+// Writes the fields visit_fields hands over as qlog members: the
+// message's own into message, keeping the numeric ones in numbers, and
+// each stream object's into an event of its own
+class QlogFieldWriter : public FieldVisitor {
+public:
+    QlogFieldWriter(JsonObject& message, std::vector<std::pair<std::string, uint64_t>>& numbers)
+        : message_(message), numbers_(numbers) {}
+
+    // Starts every object event with fields, e.g. the subgroup's group_id
+    void object_events(const std::string& name, const JsonObject& fields, const std::string& time) {
+        object_name_ = name;
+        object_prefix_ = fields;
+        time_ = time;
+    }
+    const std::vector<std::string>& objects() const { return objects_; }
+
+    void varint(const char* name, uint64_t value) override {
+        target().number(name, value);
+        if (!in_object_) numbers_.emplace_back(name, value);
+    }
+    void byte(const char* name, uint8_t value) override { varint(name, value); }
+    void text(const char* name, const std::string& value) override { target().text(name, value); }
+    void tuple(const char* name, const std::vector<std::string>& value) override {
+        target().raw(name, strings_json(value));
+    }
+    void varints(const char* name, const std::vector<uint64_t>& value) override {
+        std::string out = "[";
+        for (size_t i = 0; i < value.size(); ++i) out += (i ? "," : "") + std::to_string(value[i]);
+        target().raw(name, out + "]");
+    }
+    void location(const char* name, const Location& value) override { target().raw(name, location_json(value)); }
+    void parameters(const char* name, const std::vector<Parameter>& value) override {
+        target().raw(name, parameters_json(value));
+    }
+    void extensions(const char* name, const std::vector<uint8_t>& block) override {
+        target().raw(name, extension_headers_json(block));
+    }
+    void payload(const char*, const std::vector<uint8_t>& value) override {
+        varint("object_payload_length", value.size());
+    }
+    void begin_object() override {
+        object_ = object_prefix_;
+        in_object_ = true;
+    }
+    // Without an event name, each object is kept as a JSON object
+    void end_object() override {
+        objects_.push_back(object_name_.empty() ? object_.str() : qlog_event(time_, object_name_, object_.str()));
+        in_object_ = false;
+    }
+
+private:
+    JsonObject& target() { return in_object_ ? object_ : message_; }
+
+    JsonObject& message_;
+    std::vector<std::pair<std::string, uint64_t>>& numbers_;
+    std::string object_name_;
+    JsonObject object_prefix_;
+    std::string time_ = "0";
+    JsonObject object_;
+    bool in_object_ = false;
+    std::vector<std::string> objects_;
+};
+
+std::string lowercase(const std::string& name) {
+    std::string out;
+    for (char c : name) out += static_cast<char>(std::tolower(static_cast<unsigned char>(c)));
+    return out;
+}
+
+// The data of a message-level event: the decoded message, the raw bytes
+// and the verdict
+std::string message_data(const JsonObject& message, const ValidationResult& result,
+                         const std::vector<uint8_t>& bytes) {
+    JsonObject data;
+    data.raw("message", message.str())
+        .raw("raw", JsonObject().number("length", bytes.size()).text("data", compact_hex(bytes)).str())
+        .raw("valid", result.valid ? "true" : "false");
+    if (!result.origin.empty()) data.text("origin", result.origin);
+    if (!result.valid) data.number("termination_code", result.termination_code);
+    return data.text("report", result.report).str();
+}
+
+// Builds the message-level event for result, writing its message into
+// message and any object events into objects
+QlogEvent build_event(const ValidationResult& result, JsonObject& message, std::vector<std::string>& objects) {
+    QlogEvent event{};
+    event.raw = from_hex(result.input);
+    event.message = result.message;
+    std::string name = "control_message_parsed";
+    std::string object_name;
+    JsonObject object_fields;
+    const DecodedMessage& decoded = result.message;
+    if (const auto* stream = std::get_if<SubgroupStreamMessage>(&decoded.fields)) {
+        name = "subgroup_header_parsed";
+        event.message_type = "subgroup_header";
+        object_name = "subgroup_object_parsed";
+        object_fields.number("group_id", stream->group_id).number("subgroup_id", stream->subgroup_id);
+    } else if (std::holds_alternative<FetchStreamMessage>(decoded.fields)) {
+        name = "fetch_header_parsed";
+        event.message_type = "fetch_header";
+        object_name = "fetch_object_parsed";
+    } else if (std::holds_alternative<ObjectDatagramMessage>(decoded.fields)) {
+        name = "object_datagram_parsed";
+        event.message_type = "object_datagram";
+    } else if (decoded.decoded()) {
+        event.message_type = lowercase(control_message_name(decoded.type));
+    } else {
+        // Without decoded fields, the report still names the message
+        std::string type = result_message_type(result.report);
+        if (type == "SUBGROUP_HEADER" || type == "FETCH_HEADER" || type == "OBJECT_DATAGRAM") {
+            name = lowercase(type) + "_parsed";
+        }
+        event.message_type = lowercase(type);
+    }
+    event.name = "moqt:" + name;
+    event.data_message = name != "control_message_parsed";
+    if (!event.message_type.empty()) message.text("type", event.message_type);
+    QlogFieldWriter writer(message, event.fields);
+    writer.object_events("moqt:" + object_name, object_fields, qlog_time(result.capture_time_ns));
+    visit_fields(decoded, writer);
+    objects = writer.objects();
+    return event;
+}
+
+// The numeric fields at the top level of a decoded message's qlog event
+std::vector<std::pair<std::string, uint64_t>> qlog_numbers(const DecodedMessage& message) {
+    JsonObject unused;
+    std::vector<std::pair<std::string, uint64_t>> numbers;
+    QlogFieldWriter writer(unused, numbers);
+    visit_fields(message, writer);
+    return numbers;
+}
+
+} // namespace
+
+std::string message_json(const DecodedMessage& message) {
+    JsonObject fields;
+    std::vector<std::pair<std::string, uint64_t>> numbers;
+    QlogFieldWriter writer(fields, numbers);
+    visit_fields(message, writer);
+    if (!writer.objects().empty()) {
+        std::string objects;
+        for (const auto& object : writer.objects()) objects += (objects.empty() ? "" : ",") + object;
+        fields.raw("objects", "[" + objects + "]");
+    }
+    return fields.str();
+}
+
+std::string qlog_events(const ValidationResult& result) {
+    JsonObject message;
+    std::vector<std::string> objects;
+    QlogEvent event = build_event(result, message, objects);
+    std::string events = qlog_event(qlog_time(result.capture_time_ns), event.name,
+                                    message_data(message, result, event.raw));
+    for (const auto& object : objects) events += "\n" + object;
+    return events;
+}
+
+QlogEvent to_qlog(const ValidationResult& result) {
+    JsonObject message;
+    std::vector<std::string> objects;
+    return build_event(result, message, objects);
+}
+
+std::vector<QlogEvent> read_qlog_events(const std::string& json_text) {
+    JsonValue root = parse_json(json_text);
+    std::vector<QlogEvent> events;
+    if (const JsonValue* top = root.get("events")) collect_events(*top, events);
+    if (const JsonValue* traces = root.get("traces")) {
+        for (const auto& trace : traces->array) {
+            if (const JsonValue* trace_events = trace.get("events")) collect_events(*trace_events, events);
+        }
+    }
+    return events;
+}
+
+std::vector<QlogVerdict> validate_qlog(const std::string& json_text, const ValidationOptions& options) {
+    std::vector<QlogVerdict> verdicts;
+    SessionState state;
+    for (const auto& event : read_qlog_events(json_text)) {
+        QlogVerdict verdict{event, "", {}, {}, {}};
+        {
+            ScopedIssueCollector locator(&verdict.issues, false);
+            ScopedMessageRecorder fields(&verdict.message);
+            verdict.report = event.data_message ? validate_data_message(event.raw, options)
+                                                : validate_control_message(event.raw, state, options);
+        }
+        if (!event.message_type.empty() && normalise_type(event.message_type) != report_type(verdict.report)) {
+            verdict.mismatches.push_back("type recorded " + event.message_type + ", decoded "
+                                         + report_type(verdict.report));
+        }
+        std::vector<std::pair<std::string, uint64_t>> decoded = qlog_numbers(verdict.message);
+        for (const auto& field : event.fields) {
+            for (const auto& number : decoded) {
+                if (number.first != field.first || number.second == field.second) continue;
+                verdict.mismatches.push_back(field.first + " recorded " + std::to_string(field.second)
+                                             + ", decoded " + std::to_string(number.second));
+                break;
+            }
+        }
+        verdicts.push_back(verdict);
+    }
+    return verdicts;
+}
+
+} // namespace moqt
@@ -0,0 +1,94 @@
+// session_report.cpp
+// Announce routing and request limit summaries built from the session state
+
+#include <moqt/session_report.hpp>
+#include <moqt/common.hpp>
+#include <sstream>
+
+namespace moqt {
+
+namespace {
+
+bool is_printable_field(const std::string& field) {
+    if (field.empty() || !is_valid_utf8(field)) return false;
+    for (unsigned char c : field) {
+        if (c < 0x20 || c == 0x7F || c == '/') return false;
+    }
+    return true;
+}
+
+bool has_prefix(const std::vector<std::string>& track_namespace, const std::vector<std::string>& prefix) {
+    if (prefix.size() > track_namespace.size()) return false;
+    for (size_t i = 0; i < prefix.size(); ++i) {
+        if (prefix[i] != track_namespace[i]) return false;
+    }
+    return true;
+}
+
+} // namespace
+
+std::string namespace_display(const std::vector<std::string>& fields) {
+    std::string out;
+    for (size_t i = 0; i < fields.size(); ++i) {
+        if (i > 0) out += "/";
+        if (is_printable_field(fields[i])) {
+            out += fields[i];
+            continue;
+        }
+        std::string hex = to_hex(std::vector<uint8_t>(fields[i].begin(), fields[i].end()));
+        out += "0x";
+        for (char c : hex) {
+            if (c != ' ') out += c;
+        }
+    }
+    return out;
+}
+
+std::string announce_routing_report(const SessionState& state) {
+    std::ostringstream out;
+    out << "ANNOUNCE_ROUTING: namespaces=" << state.announced_namespaces.size()
+        << ", prefixes=" << state.subscribed_namespace_prefixes.size() << "\n";
+    for (const auto& track_namespace : state.announced_namespaces) {
+        out << "  namespace " << namespace_display(track_namespace) << " <-";
+        bool routed = false;
+        for (const auto& prefix : state.subscribed_namespace_prefixes) {
+            if (!has_prefix(track_namespace, prefix)) continue;
+            out << " " << namespace_display(prefix);
+            routed = true;
+        }
+        if (!routed) out << " (no prefix)";
+        out << "\n";
+    }
+    for (const auto& prefix : state.subscribed_namespace_prefixes) {
+        out << "  prefix " << namespace_display(prefix) << " ->";
+        bool matched = false;
+        for (const auto& track_namespace : state.announced_namespaces) {
+            if (!has_prefix(track_namespace, prefix)) continue;
+            out << " " << namespace_display(track_namespace);
+            matched = true;
+        }
+        if (!matched) out << " (no namespace)";
+        out << "\n";
+    }
+    return out.str();
+}
+
+std::string request_limit_report(const SessionState& state) {
+    size_t outstanding = state.active_subscriptions.size() + state.active_fetches.size()
+                         + state.pending_announces.size() + state.pending_namespace_prefixes.size();
+    std::ostringstream out;
+    out << "REQUESTS: outstanding=" << outstanding << " (subscriptions=" << state.active_subscriptions.size()
+        << ", fetches=" << state.active_fetches.size() << ", announces=" << state.pending_announces.size()
+        << ", namespace_prefixes=" << state.pending_namespace_prefixes.size() << ")";
+    out << ", max_request_id=";
+    if (state.max_request_ids.empty()) out << "(none)";
+    bool first = true;
+    for (const auto& entry : state.max_request_ids) {
+        out << (first ? "" : ",") << direction_name(entry.first) << ":" << entry.second;
+        first = false;
+    }
+    out << "\n";
+    return out.str();
+}
+
+} // namespace moqt
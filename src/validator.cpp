@@ -1,26 +1,392 @@
 // validator.cpp
-// Entry point for validating MoQT control messages
+// Entry point for validating MoQT control and data messages
 
 #include <moqt/validator.hpp>
 #include <moqt/control_parser.hpp>
+#include <moqt/data_parser.hpp>
+#include <moqt/encoder.hpp>
+#include <algorithm>
+#include <istream>
+#include <mutex>
+#include <utility>
 
 namespace moqt {
 
-std::string validate_control_message(const std::vector<uint8_t>& data) {
-    if (data.empty()) return "Empty control message";
-    uint8_t type = data[0];
-    std::vector<uint8_t> payload(data.begin() + 1, data.end());
+namespace {
 
+// Validates the payload of a control message of the given type
+std::string dispatch_control_message(uint64_t type, const std::vector<uint8_t>& payload, SessionState& state,
+                                     Direction direction, const ValidationOptions& options) {
     switch (type) {
         case CLIENT_SETUP:
-            return parse_client_setup(payload);
+            return parse_client_setup(payload, state, direction, options);
         case SERVER_SETUP:
-            return parse_server_setup(payload);
+            return parse_server_setup(payload, state, direction, options);
+        case SUBSCRIBE_UPDATE:
+            return parse_subscribe_update(payload, state, direction, options);
         case SUBSCRIBE:
-            return parse_subscribe(payload);
+            return parse_subscribe(payload, state, direction, options);
+        case SUBSCRIBE_OK:
+            return parse_subscribe_ok(payload, state, direction, options);
+        case SUBSCRIBE_ERROR:
+            return parse_subscribe_error(payload, state, options);
+        case ANNOUNCE:
+            return parse_announce(payload, state, direction, options);
+        case ANNOUNCE_OK:
+            return parse_announce_ok(payload, state, options);
+        case ANNOUNCE_ERROR:
+            return parse_announce_error(payload, state, options);
+        case UNANNOUNCE:
+            return parse_unannounce(payload, state, options);
+        case UNSUBSCRIBE:
+            return parse_unsubscribe(payload, state, direction, options);
+        case SUBSCRIBE_DONE:
+            return parse_subscribe_done(payload, state, options);
+        case ANNOUNCE_CANCEL:
+            return parse_announce_cancel(payload, state, options);
+        case TRACK_STATUS_REQUEST:
+            return parse_track_status_request(payload, state, direction, options);
+        case TRACK_STATUS:
+            return parse_track_status(payload, state, direction, options);
+        case GOAWAY:
+            return parse_goaway(payload, direction, options);
+        case SUBSCRIBE_ANNOUNCES:
+            return parse_subscribe_announces(payload, state, direction, options);
+        case SUBSCRIBE_ANNOUNCES_OK:
+            return parse_subscribe_announces_ok(payload, state, options);
+        case SUBSCRIBE_ANNOUNCES_ERROR:
+            return parse_subscribe_announces_error(payload, state, options);
+        case UNSUBSCRIBE_ANNOUNCES:
+            return parse_unsubscribe_announces(payload, state, options);
+        case MAX_REQUEST_ID:
+            return parse_max_request_id(payload, state, direction, options);
+        case FETCH:
+            return parse_fetch(payload, state, options, direction);
+        case FETCH_CANCEL:
+            return parse_fetch_cancel(payload, state, options);
+        case FETCH_OK:
+            return parse_fetch_ok(payload, state, direction, options);
+        case FETCH_ERROR:
+            return parse_fetch_error(payload, state, direction, options);
+        case REQUESTS_BLOCKED:
+            return parse_requests_blocked(payload, state, direction, options);
+        case LEGACY_SETUP:
+        case LEGACY_CLIENT_SETUP:
+        case LEGACY_SERVER_SETUP:
+            if (options.accept_legacy_setup) return parse_legacy_setup(type, payload, state, direction, options);
+            [[fallthrough]];
         default:
             return "Unsupported or unimplemented message type: 0x" + std::to_string(type);
     }
 }
 
+// A control stream opens with CLIENT_SETUP and SERVER_SETUP, each sent
+// once. Returns a violation report for a message out of that order, or
+// an empty string if it may be validated.
+std::string check_setup_order(uint64_t type, const SessionState& state) {
+    std::string name = control_message_name(type);
+    if (name == "UNKNOWN") return "";
+    if ((type == CLIENT_SETUP && state.client_setup_seen) || (type == SERVER_SETUP && state.server_setup_seen)) {
+        return name + " protocol violation: " + name + " was already sent in this session";
+    }
+    if (type != CLIENT_SETUP && type != SERVER_SETUP && !state.server_setup_seen) {
+        return name + " protocol violation: sent before the setup exchange completed";
+    }
+    return "";
+}
+
+// Validates one framed control message of a stream, whose payload
+// follows the type and length
+ValidationResult validate_framed_message(uint64_t type, const std::vector<uint8_t>& message,
+                                         const std::vector<uint8_t>& payload, SessionState& state,
+                                         Direction direction, const ValidationOptions& options) {
+    std::vector<ValidationIssue> issues;
+    DecodedMessage decoded;
+    std::string report = check_setup_order(type, state);
+    if (report.empty()) {
+        ScopedIssueCollector locator(&issues, false);
+        ScopedMessageRecorder fields(&decoded);
+        ScopedByteOffsetBase header(message.size() - payload.size());
+        report = dispatch_control_message(type, payload, state, direction, options);
+    }
+    return make_result(message, report, issues, decoded);
+}
+
+// Reads up to count bytes from in onto the end of out. Returns false if
+// the stream ends first. out grows a chunk at a time, so a huge declared
+// length only costs the bytes that actually arrive.
+bool read_stream_bytes(std::istream& in, uint64_t count, std::vector<uint8_t>& out) {
+    const uint64_t chunk = 4096;
+    while (count > 0) {
+        size_t step = static_cast<size_t>(std::min(count, chunk));
+        size_t start = out.size();
+        out.resize(start + step);
+        in.read(reinterpret_cast<char*>(out.data() + start), static_cast<std::streamsize>(step));
+        out.resize(start + static_cast<size_t>(in.gcount()));
+        if (out.size() != start + step) return false;
+        count -= step;
+    }
+    return true;
+}
+
+// Rewrites the non-minimal varints validation logged in data with the
+// fewest bytes that hold them, as the encoders write them. A varint read
+// twice is logged twice.
+std::vector<uint8_t> minimal_varints(const std::vector<uint8_t>& data, std::vector<NonMinimalVarint> longer) {
+    std::sort(longer.begin(), longer.end(),
+              [](const NonMinimalVarint& a, const NonMinimalVarint& b) { return a.offset < b.offset; });
+    std::vector<uint8_t> out;
+    size_t copied = 0;
+    for (const auto& varint : longer) {
+        if (varint.offset < copied) continue;
+        out.insert(out.end(), data.begin() + copied, data.begin() + varint.offset);
+        write_varint(out, varint.value);
+        copied = varint.offset + varint.length;
+    }
+    out.insert(out.end(), data.begin() + copied, data.end());
+    return out;
+}
+
+// Formats up to 8 bytes of data from offset on for a round trip report
+std::string hex_from(const std::vector<uint8_t>& data, size_t offset) {
+    if (offset >= data.size()) return "end of message";
+    size_t end = std::min(data.size(), offset + 8);
+    std::string hex = to_hex(std::vector<uint8_t>(data.begin() + offset, data.begin() + end));
+    return "\"" + hex + (end < data.size() ? " ..." : "") + "\"";
+}
+
+// Validates a data message, checking track aliases against session if
+// one is given
+std::string dispatch_data_message(const std::vector<uint8_t>& data, const ValidationOptions& options,
+                                  const SessionState* session) {
+    if (data.empty()) return "Empty data message";
+    ScopedVarintMode varint_mode(options.canonical_varints ? VarintMode::CANONICAL : VarintMode::LENIENT);
+    uint8_t type = data[0];
+
+    if (type <= OBJECT_DATAGRAM_STATUS_EXT) return parse_object_datagram(data, options, session);
+    if (type == FETCH_HEADER) return parse_fetch_stream(data, options);
+    if (type >= SUBGROUP_HEADER_MIN && type <= SUBGROUP_HEADER_MAX) {
+        return parse_subgroup_stream(data, options, session);
+    }
+    return "Unsupported or unimplemented data stream type: 0x" + std::to_string(type);
+}
+
+} // namespace
+
+std::string validate_control_message(const std::vector<uint8_t>& data) {
+    SessionState state;
+    return validate_control_message(data, state);
+}
+
+std::string validate_control_message(const std::vector<uint8_t>& data, SessionState& state,
+                                     const ValidationOptions& options) {
+    return validate_control_message(data, state, DIRECTION_UNKNOWN, options);
+}
+
+std::string validate_control_message(const std::vector<uint8_t>& data, SessionState& state, Direction direction,
+                                     const ValidationOptions& options) {
+    if (data.empty()) return "Empty control message";
+    ScopedVarintMode varint_mode(options.canonical_varints ? VarintMode::CANONICAL : VarintMode::LENIENT);
+    if (options.accept_legacy_setup && data.size() >= 2 && data[0] == 0x40) {
+        // The legacy types above 0x3F take two bytes as a varint
+        size_t offset = 0;
+        uint64_t type = read_varint(data, offset);
+        if (type == LEGACY_CLIENT_SETUP || type == LEGACY_SERVER_SETUP) {
+            ScopedByteOffsetBase header(offset);
+            return dispatch_control_message(type, std::vector<uint8_t>(data.begin() + 2, data.end()), state,
+                                            direction, options);
+        }
+    }
+    std::vector<uint8_t> payload(data.begin() + 1, data.end());
+    ScopedByteOffsetBase header(1);
+    return dispatch_control_message(data[0], payload, state, direction, options);
+}
+
+ControlStreamResult validate_control_stream(const std::vector<uint8_t>& stream, SessionState& state,
+                                            Direction direction, const ValidationOptions& options) {
+    ScopedVarintMode varint_mode(options.canonical_varints ? VarintMode::CANONICAL : VarintMode::LENIENT);
+    ControlStreamResult result;
+    size_t offset = 0;
+    while (offset < stream.size()) {
+        size_t start = offset;
+        uint64_t type = 0;
+        uint64_t length = 0;
+        bool complete = true;
+        try {
+            type = read_varint_canonical(stream, offset);
+            length = read_control_length(stream, offset, has_varint_length(type, state.legacy_framing, options),
+                                         options);
+        } catch (const std::out_of_range&) {
+            complete = false;
+        } catch (const ProtocolViolation& e) {
+            result.error = "control message " + std::to_string(result.messages.size()) + " at offset "
+                           + std::to_string(start) + " has a malformed header: " + e.what();
+            break;
+        }
+        if (!complete || stream.size() - offset < length) {
+            result.truncated = true;
+            result.error = "incomplete control message " + std::to_string(result.messages.size()) + " at offset "
+                           + std::to_string(start) + ": " + std::to_string(stream.size() - start)
+                           + " trailing bytes";
+            break;
+        }
+        std::vector<uint8_t> message(stream.begin() + start, stream.begin() + offset + length);
+        std::vector<uint8_t> payload(stream.begin() + offset, stream.begin() + offset + length);
+        offset += length;
+        result.offsets.push_back(start);
+        result.messages.push_back(validate_framed_message(type, message, payload, state, direction, options));
+        if (!result.messages.back().valid && result.error.empty()) {
+            result.error = "control message " + std::to_string(result.messages.size() - 1) + " at offset "
+                           + std::to_string(start) + " is invalid";
+        }
+    }
+    return result;
+}
+
+std::string validate_control_stream_live(std::istream& in, SessionState& state,
+                                         const std::function<void(const ValidationResult&)>& on_result,
+                                         Direction direction, const ValidationOptions& options,
+                                         const std::atomic<bool>* stop) {
+    ScopedVarintMode varint_mode(options.canonical_varints ? VarintMode::CANONICAL : VarintMode::LENIENT);
+    size_t offset = 0;
+    for (size_t index = 0; !(stop && *stop); ++index) {
+        std::vector<uint8_t> message;
+        bool complete = read_stream_bytes(in, 1, message);
+        if (!complete && message.empty()) return "";
+        complete = complete && read_stream_bytes(in, (size_t{1} << (message[0] >> 6)) - 1, message);
+        size_t position = 0;
+        uint64_t type = 0;
+        size_t length_start = message.size();
+        try {
+            if (complete) type = read_varint_canonical(message, position);
+            // A varint Length says how long it is in its first byte
+            bool varint_length = has_varint_length(type, state.legacy_framing, options);
+            complete = complete && read_stream_bytes(in, varint_length ? 1 : 2, message);
+            if (complete && varint_length) {
+                complete = read_stream_bytes(in, (size_t{1} << (message[length_start] >> 6)) - 1, message);
+            }
+            if (complete) {
+                uint64_t length = read_control_length(message, position, varint_length, options);
+                complete = read_stream_bytes(in, length, message);
+            }
+        } catch (const ProtocolViolation& e) {
+            return "control message " + std::to_string(index) + " at offset " + std::to_string(offset)
+                   + " has a malformed header: " + e.what();
+        }
+        if (!complete) {
+            return "incomplete control message " + std::to_string(index) + " at offset " + std::to_string(offset)
+                   + ": " + std::to_string(message.size()) + " trailing bytes";
+        }
+        std::vector<uint8_t> payload(message.begin() + static_cast<std::ptrdiff_t>(position), message.end());
+        on_result(validate_framed_message(type, message, payload, state, direction, options));
+        offset += message.size();
+    }
+    return "";
+}
+
+std::string validate_data_message(const std::vector<uint8_t>& data, const ValidationOptions& options) {
+    return dispatch_data_message(data, options, nullptr);
+}
+
+std::string validate_data_message(const std::vector<uint8_t>& data, const SessionState& state,
+                                  const ValidationOptions& options) {
+    return dispatch_data_message(data, options, &state);
+}
+
+std::string validate_round_trip(const std::vector<uint8_t>& data, bool is_control, SessionState& state,
+                                const ValidationOptions& options) {
+    DecodedMessage decoded;
+    std::vector<NonMinimalVarint> longer;
+    std::string report;
+    {
+        ScopedMessageRecorder recorder(&decoded);
+        ScopedVarintLog log(&longer);
+        report = is_control ? validate_control_message(data, state, options)
+                            : validate_data_message(data, state, options);
+    }
+    if (!make_result(data, report).valid) return report;
+    if (!decoded.decoded()) return "round trip has no decoded fields to encode";
+    std::vector<uint8_t> expected = minimal_varints(data, longer);
+    std::vector<uint8_t> encoded;
+    try {
+        encoded = encode_message(decoded);
+    } catch (const std::exception& e) {
+        return std::string("round trip encoding failed: ") + e.what();
+    }
+    size_t offset = 0;
+    while (offset < expected.size() && offset < encoded.size() && expected[offset] == encoded[offset]) ++offset;
+    if (offset == expected.size() && offset == encoded.size()) return "";
+    return "round trip diverges at byte " + std::to_string(offset) + ": expected " + hex_from(expected, offset)
+           + ", got " + hex_from(encoded, offset);
+}
+
+std::string validate_round_trip(const std::vector<uint8_t>& data, bool is_control) {
+    SessionState state;
+    return validate_round_trip(data, is_control, state);
+}
+
+CollectedValidation validate_all(const std::vector<uint8_t>& data, bool is_control, SessionState& state,
+                                 const ValidationOptions& options) {
+    CollectedValidation collected;
+    DecodedMessage decoded;
+    std::string report;
+    {
+        ScopedIssueCollector collector(&collected.issues);
+        ScopedMessageRecorder fields(&decoded);
+        report = is_control ? validate_control_message(data, state, options)
+                            : validate_data_message(data, state, options);
+    }
+    collected.result = make_result(data, report, collected.issues, decoded);
+    bool ended_fatally = !collected.issues.empty() && collected.issues.back().severity == IssueSeverity::FATAL;
+    if (!collected.result.valid && !ended_fatally) {
+        // Reports built before any parser runs, such as for an empty
+        // message or an unsupported type
+        ValidationIssue issue;
+        issue.field = "type";
+        issue.severity = IssueSeverity::FATAL;
+        issue.message = report;
+        collected.issues.push_back(issue);
+    }
+    if (collected.result.valid && !collected.issues.empty()) {
+        collected.result.valid = false;
+        collected.result.termination_code = collected.issues.front().code;
+    }
+    return collected;
+}
+
+CollectedValidation validate_all(const std::vector<uint8_t>& data, bool is_control) {
+    SessionState state;
+    return validate_all(data, is_control, state);
+}
+
+SharedSession::SharedSession(SessionState state) : state_(std::move(state)) {}
+
+std::string SharedSession::validate_control_message(const std::vector<uint8_t>& data, Direction direction,
+                                                    const ValidationOptions& options) {
+    std::unique_lock<std::shared_mutex> lock(mutex_);
+    return moqt::validate_control_message(data, state_, direction, options);
+}
+
+ControlStreamResult SharedSession::validate_control_stream(const std::vector<uint8_t>& stream, Direction direction,
+                                                           const ValidationOptions& options) {
+    std::unique_lock<std::shared_mutex> lock(mutex_);
+    return moqt::validate_control_stream(stream, state_, direction, options);
+}
+
+std::string SharedSession::validate_data_message(const std::vector<uint8_t>& data,
+                                                 const ValidationOptions& options) const {
+    std::shared_lock<std::shared_mutex> lock(mutex_);
+    return moqt::validate_data_message(data, state_, options);
+}
+
+SessionState SharedSession::snapshot() const {
+    std::shared_lock<std::shared_mutex> lock(mutex_);
+    return state_;
+}
+
+void SharedSession::reset() {
+    std::unique_lock<std::shared_mutex> lock(mutex_);
+    state_.reset();
+}
+
 } // namespace moqt
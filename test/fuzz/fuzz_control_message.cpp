@@ -0,0 +1,40 @@
+// fuzz_control_message.cpp
+// libFuzzer entry point feeding arbitrary bytes to the control parsers
+
+#include <moqt/formatter.hpp>
+#include <moqt/validator.hpp>
+#include <cstdint>
+#include <cstdio>
+#include <cstdlib>
+#include <string>
+#include <vector>
+
+namespace {
+
+// A report either describes a valid message or names why it is not one.
+// Anything else means a parser let an error out in an unexpected form.
+void check_report(const moqt::ValidationResult& result) {
+    if (result.valid) return;
+    const std::string& report = result.report;
+    if (report.find(" parse error: ") != std::string::npos) return;
+    if (report.find(" protocol violation: ") != std::string::npos) return;
+    if (report.rfind("Unsupported or unimplemented message type", 0) == 0) return;
+    if (report == "Empty control message") return;
+    std::fprintf(stderr, "unexpected report: %s\n", report.c_str());
+    std::abort();
+}
+
+} // namespace
+
+// Validates the input as a single control message, then as a control
+// stream. An exception escaping either, or a crash, fails the run.
+extern "C" int LLVMFuzzerTestOneInput(const uint8_t* bytes, size_t size) {
+    std::vector<uint8_t> data(bytes, bytes + size);
+    moqt::SessionState state;
+    check_report(moqt::make_result(data, moqt::validate_control_message(data, state)));
+
+    moqt::SessionState stream_state;
+    moqt::ControlStreamResult stream = moqt::validate_control_stream(data, stream_state);
+    for (const auto& message : stream.messages) check_report(message);
+    return 0;
+}